@@ -1,99 +1,279 @@
 package archive
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"math"
 	"os"
 	"path/filepath"
 	"strings"
 
+	"github.com/marcboeker/supertar/compress"
 	"github.com/marcboeker/supertar/config"
 	"github.com/marcboeker/supertar/crypto"
 	"github.com/marcboeker/supertar/item"
 )
 
+const (
+	compactSuffix = ".compact"
+	// compactCommitSize is the amount of copied data after which a
+	// compaction is committed, so that it can be resumed from there.
+	compactCommitSize = 64 * 1024 * 1024
+)
+
 // Archive represents an archive.
 type Archive struct {
 	header *Header
 	path   string
-	file   *os.File
+	file   storage
+	start  int64 // offset of the first item
 	config *config.Config
+	links  map[inode]string
+	owners *owners
+	idx    *index
+	lock   *fileLock
+	solid  *solidBlock   // pending block, nil if solid mode is off
+	blocks *blockCache   // last decrypted solid block
+	chunks *chunkCache   // chunk offsets of opened items
+	out    *streamWriter // set for archives written as a stream
+	in     *streamReader // set for archives read as a stream
+	batch  *commitBatch  // set while AddRecursive commits in batches
+}
+
+// inode identifies a file on disk to detect hard links.
+type inode struct {
+	dev uint64
+	ino uint64
 }
 
 // NewArchive opens or creates a new archive. If an archive already
-// exists, the archive is opened and the keystore is read.
+// exists, the archive is opened and the keystore is read. The archive is
+// locked exclusively or shared if it is opened read-only.
 func NewArchive(c *config.Config) (*Archive, error) {
-	exists := true
-	if _, err := os.Stat(c.Path); os.IsNotExist(err) {
-		exists = false
+	flag := os.O_RDWR | os.O_CREATE
+	if c.ReadOnly {
+		flag = os.O_RDONLY
+	}
+	lock, err := lockArchive(storagePath(c.Path, c.VolumeSize, flag), flag&os.O_CREATE != 0, !c.ReadOnly, c.Wait)
+	if err != nil {
+		return nil, err
 	}
 
-	fh, err := os.OpenFile(c.Path, os.O_RDWR|os.O_CREATE, 0666)
+	arch, err := openArchive(c, flag)
 	if err != nil {
+		lock.unlock()
 		return nil, err
 	}
+	arch.lock = lock
 
-	arch := Archive{path: c.Path, file: fh, header: &Header{}}
+	return arch, nil
+}
+
+func openArchive(c *config.Config, flag int) (_ *Archive, err error) {
+	// An interrupted compaction, retraining or upgrade of a volume set is
+	// completed first.
+	for _, suffix := range []string{compactSuffix, retrainSuffix, upgradeSuffix} {
+		if err := finishRename(c.Path+suffix, c.Path); err != nil {
+			return nil, err
+		}
+	}
+
+	fh, err := openStorage(c.Path, c.VolumeSize, flag)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			fh.Close()
+		}
+	}()
+
+	// The file has already been created by the lock, so an empty file is
+	// a new archive.
+	stat, err := fh.Stat()
+	if err != nil {
+		return nil, err
+	}
+	exists := stat.Size() > 0 || c.ReadOnly
+
+	arch := Archive{path: c.Path, file: fh, links: map[inode]string{}, owners: newOwners(), idx: &index{}, blocks: &blockCache{}, chunks: &chunkCache{}}
+	if c.Solid {
+		arch.solid = &solidBlock{}
+	}
 	if exists {
 		if _, err := arch.file.Seek(0, io.SeekStart); err != nil {
 			return nil, err
 		}
 
-		if err := arch.header.Read(fh); err != nil {
+		if arch.header, err = readHeader(fh, c); err != nil {
+			return nil, err
+		}
+	} else {
+		if arch.header, err = newHeader(c); err != nil {
 			return nil, err
 		}
 
-		c.Compression = arch.header.compression
-		c.ChunkSize = arch.header.chunkSize
-
-		ks := crypto.KeyStore{
-			KDFSalt:  arch.header.kdfSalt,
-			KeyNonce: arch.header.KeyNonce,
-			Key:      arch.header.Key,
+		if _, err := arch.file.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		if err := arch.header.Write(fh); err != nil {
+			return nil, err
 		}
+		arch.start = headerLength
+		if c.Dict != nil {
+			rec := encodeDict(c.Dict, c)
+			if _, err := fh.Write(rec); err != nil {
+				return nil, err
+			}
+			arch.start += int64(len(rec))
+		}
+		if _, ok := fh.(*volumeSet); ok {
+			if _, err := fh.Write(encodeVolume(c.VolumeSize, c)); err != nil {
+				return nil, err
+			}
+			arch.start += volumeRecordLength
+		}
+	}
 
-		c.Crypto, err = crypto.ExistingCrypto(c.Password, &ks)
-		if err != nil {
+	arch.config = c
+
+	if exists {
+		if arch.start, err = arch.loadDict(); err != nil {
+			return nil, err
+		}
+		if arch.start, err = arch.loadVolume(arch.start); err != nil {
+			return nil, err
+		}
+		if err := arch.loadIndex(); err != nil {
 			return nil, err
 		}
 	} else {
-		var (
-			ks  *crypto.KeyStore
-			err error
-		)
-		c.Crypto, ks, err = crypto.NewCrypto(c.Password)
-		if err != nil {
+		// The initial commit distinguishes the archive from archives
+		// written before commit records were introduced.
+		*arch.idx = index{items: []*item.Item{}, end: arch.start, dirty: true}
+		if err := arch.commit(); err != nil {
 			return nil, err
 		}
+	}
 
-		arch.header.compression = c.Compression
-		arch.header.chunkSize = c.ChunkSize
-		arch.header.kdfSalt = ks.KDFSalt
-		arch.header.KeyNonce = ks.KeyNonce
-		arch.header.Key = ks.Key
+	return &arch, nil
+}
 
-		if _, err := arch.file.Seek(0, io.SeekStart); err != nil {
+// readHeader reads the header of an existing archive and sets up the
+// config for it.
+func readHeader(r io.Reader, c *config.Config) (*Header, error) {
+	h := &Header{}
+	if err := h.Read(r); err != nil {
+		return nil, err
+	}
+
+	if h.version > supertarVersion {
+		return nil, errUnsupportedVersion
+	}
+	c.Version = int(h.version)
+	if c.Version < item.Version1 {
+		c.Version = item.Version1
+	}
+	c.Compression = h.compression
+	c.Codec = h.codec
+	c.ChunkSize = h.chunkSize
+	if c.Compression {
+		if _, err := compress.Lookup(c.Codec); err != nil {
 			return nil, err
 		}
-		arch.header.Write(fh)
+	}
+	// Only a level set when opening the archive is checked. The stored
+	// level must never make an archive unreadable, it is clamped to the
+	// levels of the codec when writing.
+	if c.Level == 0 {
+		c.Level = h.level
+	} else if err := compress.CheckLevel(codecOf(c), c.Level); err != nil {
+		return nil, err
 	}
 
-	arch.config = c
-	arch.header.version = supertarVersion
+	ks := crypto.KeyStore{
+		KDFSalt:  h.kdfSalt,
+		KeyNonce: h.KeyNonce,
+		Key:      h.Key,
+	}
 
+	var err error
+	c.Crypto, err = crypto.ExistingCrypto(c.Password, &ks)
 	if err != nil {
 		return nil, err
 	}
 
-	return &arch, nil
+	return h, nil
 }
 
-// Close closes the file handler of the archive.
-// After an archive is closed, it is unusable.
-func (a Archive) Close() {
-	a.file.Close()
+// newHeader creates the header of a new archive and a new key.
+func newHeader(c *config.Config) (*Header, error) {
+	var (
+		ks  *crypto.KeyStore
+		err error
+	)
+	if err := compress.CheckLevel(codecOf(c), c.Level); err != nil {
+		return nil, err
+	}
+	if c.Dict != nil && codecOf(c) != compress.Zstd {
+		return nil, errDictCodec
+	}
+	if c.Version == 0 {
+		c.Version = supertarVersion
+	}
+	if c.Version > supertarVersion {
+		return nil, errUnsupportedVersion
+	}
+	c.Crypto, ks, err = crypto.NewCrypto(c.Password)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Header{
+		version:     uint8(c.Version),
+		compression: c.Compression,
+		codec:       c.Codec,
+		level:       c.Level,
+		chunkSize:   c.ChunkSize,
+		kdfSalt:     ks.KDFSalt,
+		KeyNonce:    ks.KeyNonce,
+		Key:         ks.Key,
+	}, nil
+}
+
+// codecOf returns the codec used by the config. Archives, which only have
+// compression enabled, use Zstandard.
+func codecOf(c *config.Config) compress.ID {
+	if !c.Compression {
+		return compress.None
+	}
+	if c.Codec == compress.None {
+		return compress.Zstd
+	}
+	return c.Codec
+}
+
+// Close writes the pending solid block and the index if the archive has
+// been modified and closes the file handler of the archive. The writer or
+// reader of a stream is not closed. After an archive is closed, it is
+// unusable.
+func (a Archive) Close() error {
+	err := a.flushSolid()
+	if err == nil && a.idx.dirty {
+		err = a.writeIndex()
+	}
+	if a.file != nil {
+		if cerr := a.file.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if cerr := a.lock.unlock(); err == nil {
+		err = cerr
+	}
+	return err
 }
 
 // Config returns the archive's config.
@@ -108,20 +288,24 @@ func (a Archive) Add(basePath, path string) error {
 	if path == basePath || path == a.path {
 		return nil
 	}
+	absPath := path
 
-	file, err := os.Open(path)
+	stat, err := os.Lstat(path)
 	if err != nil {
 		return err
 	}
 
-	stat, err := file.Stat()
-	if err != nil {
-		return err
+	// Sockets cannot be restored, so they are never stored.
+	if stat.Mode()&os.ModeSocket != 0 {
+		return nil
+	}
+	if a.config.SkipSpecial && stat.Mode()&(os.ModeNamedPipe|os.ModeDevice) != 0 {
+		return nil
 	}
 
 	size := int64(stat.Size())
 	chunks := math.Ceil(float64(size) / float64(a.config.ChunkSize))
-	if stat.IsDir() {
+	if !stat.Mode().IsRegular() {
 		size = 0
 		chunks = 0
 	}
@@ -147,18 +331,119 @@ func (a Archive) Add(basePath, path string) error {
 		Mode:   stat.Mode(),
 		Chunks: int64(chunks),
 	}
+	hdr.ATime, hdr.CTime = timesOf(stat)
+	if uid, gid, ok := ownerOf(stat); ok {
+		hdr.UID = uid
+		hdr.GID = gid
+		hdr.Uname = a.owners.userName(uid)
+		hdr.Gname = a.owners.groupName(gid)
+	}
+	if hdr.Xattrs, err = readXattrs(absPath, a.config.Xattrs, a.config.ACLs); err != nil {
+		return err
+	}
+
+	var (
+		src   io.Reader
+		first *inode // inode of the first link to a file
+	)
+	if stat.Mode()&os.ModeDevice != 0 {
+		hdr.DevMajor, hdr.DevMinor = deviceOf(stat)
+	} else if stat.Mode()&os.ModeSymlink != 0 {
+		if hdr.Link, err = os.Readlink(absPath); err != nil {
+			return err
+		}
+	} else if stat.Mode().IsRegular() {
+		// Further links to an already stored inode only reference the
+		// first path and are stored without a body.
+		if id, nlink, ok := inodeOf(stat); ok && nlink > 1 {
+			if target, ok := a.links[id]; ok {
+				hdr.Link = target
+				hdr.Size = 0
+				hdr.Chunks = 0
+				return a.write(&hdr, nil)
+			}
+			first = &id
+		}
+
+		file, err := os.Open(absPath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		src = file
+
+		// Only the data segments of sparse files are stored.
+		if hdr.Sparse, err = sparseSegments(file, stat); err != nil {
+			return err
+		}
+		if len(hdr.Sparse) > 0 {
+			readers := make([]io.Reader, len(hdr.Sparse))
+			for i, s := range hdr.Sparse {
+				readers[i] = io.NewSectionReader(file, s.Offset, s.Length)
+			}
+			src = io.MultiReader(readers...)
+			hdr.Chunks = int64(math.Ceil(float64(hdr.StoredSize()) / float64(a.config.ChunkSize)))
+		}
+
+	}
 
-	e := item.NewItem(&hdr)
-	if _, err := a.file.Seek(0, io.SeekEnd); err != nil {
+	if a.isSolid(&hdr) {
+		err = a.addSolid(&hdr, src)
+	} else {
+		err = a.write(&hdr, src)
+	}
+	// Further links only refer to the first path once it is stored.
+	if err == nil && first != nil {
+		a.links[*first] = path
+	}
+	return err
+}
+
+// write appends a new item with the given header and body to the archive.
+// A pending solid block is written first to keep the order of the items.
+func (a Archive) write(hdr *item.Header, src io.Reader) error {
+	if err := a.flushSolid(); err != nil {
+		return err
+	}
+	if a.out != nil {
+		return a.writeStream(hdr, src)
+	}
+
+	if err := a.beginWrite(); err != nil {
 		return err
 	}
 
-	return e.Write(a.file, file, a.config)
+	e := item.NewItem(hdr)
+	pos, err := a.file.Seek(a.idx.end, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	if err := e.Write(a.file, src, a.config); err != nil {
+		// Remove the incomplete item.
+		a.file.Truncate(pos)
+		return err
+	}
+
+	if a.idx.end, err = a.file.Seek(0, io.SeekCurrent); err != nil {
+		return err
+	}
+	if a.idx.items != nil {
+		e.Offset = pos + hdr.Len()
+		a.idx.items = append(a.idx.items, e)
+	}
+
+	return a.commitAppend()
 }
 
 // AddRecursive adds a directory and all its children to
 // an archive. All path names are made relative.
+//
+// The added items are committed in batches instead of one by one. When
+// AddRecursive returns, all items added so far are committed, even if an
+// error occurred.
 func (a Archive) AddRecursive(basePath, path string, ch chan string) error {
+	a.batch = &commitBatch{start: a.idx.end}
 	walkFnc := func(path string, info os.FileInfo, err error) error {
 		if ch != nil {
 			ch <- path
@@ -166,15 +451,65 @@ func (a Archive) AddRecursive(basePath, path string, ch chan string) error {
 		return a.Add(basePath, path)
 	}
 
-	return filepath.Walk(path, walkFnc)
+	err := filepath.Walk(path, walkFnc)
+	if cerr := a.commitBatch(); err == nil {
+		err = cerr
+	}
+	return err
 }
 
 func (a Archive) iterateItems(cb func(*item.Item) error) error {
-	if _, err := a.file.Seek(headerLength, io.SeekStart); err != nil {
+	if a.in != nil {
+		return a.iterateStream(cb)
+	}
+	if err := a.flushSolid(); err != nil {
+		return err
+	}
+
+	if _, err := a.file.Seek(a.start, io.SeekStart); err != nil {
 		return err
 	}
 
 	for {
+		pos, err := a.file.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		if pos >= a.idx.end {
+			return nil
+		}
+
+		typ, err := a.readRecordType(pos)
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case 0:
+		case recordCommit:
+			n, err := a.readCommit(pos)
+			if err != nil {
+				return err
+			}
+			a.idx.committed = pos + n
+			if _, err := a.file.Seek(pos+n, io.SeekStart); err != nil {
+				return err
+			}
+			continue
+		case recordBlock:
+			n, err := a.blockLength(pos)
+			if err != nil {
+				return err
+			}
+			if _, err := a.file.Seek(pos+n, io.SeekStart); err != nil {
+				return err
+			}
+			continue
+		case recordIndex:
+			return nil
+		default:
+			return errUnknownRecord
+		}
+
 		i, err := item.Read(a.file, a.config)
 		if err != nil {
 			return err
@@ -198,7 +533,7 @@ func (a Archive) List(ch chan *item.Item, pattern string) error {
 	defer func() {
 		close(ch)
 	}()
-	return a.iterateItems(func(i *item.Item) error {
+	return a.eachItem(func(i *item.Item) error {
 		if len(pattern) > 0 {
 			matched, err := filepath.Match(pattern, i.Header.Path)
 			if err != nil {
@@ -211,22 +546,21 @@ func (a Archive) List(ch chan *item.Item, pattern string) error {
 			ch <- i
 		}
 
-		if i.Header.Type() == item.ModeRegular {
-			a.skipChunks(i.Header.Chunks)
-		}
-
 		return nil
 	})
 }
 
 // Delete searches for the given glob and marks the entry as deleted.
+// Hard links to a deleted file are kept, see keepLinks.
 func (a Archive) Delete(ch chan *item.Item, pattern string) error {
 	if ch != nil {
 		defer func() {
 			close(ch)
 		}()
 	}
-	return a.iterateItems(func(i *item.Item) error {
+
+	var matchedItems []*item.Item
+	err := a.eachItem(func(i *item.Item) error {
 		matched, err := filepath.Match(pattern, i.Header.Path)
 		if err != nil {
 			return err
@@ -235,23 +569,31 @@ func (a Archive) Delete(ch chan *item.Item, pattern string) error {
 			if ch != nil {
 				ch <- i
 			}
-
-			i.Header.Deleted = 1
-			a.file.Seek(-i.Header.Len(), io.SeekCurrent)
-			i.Header.Write(a.file, a.config)
-		}
-
-		if i.Header.Type() == item.ModeRegular {
-			if _, err := a.skipChunks(i.Header.Chunks); err != nil {
-				return err
-			}
+			matchedItems = append(matchedItems, i)
 		}
 
 		return nil
 	})
+	if err != nil || len(matchedItems) == 0 {
+		return err
+	}
+
+	skip := map[int64]bool{}
+	for _, i := range matchedItems {
+		skip[i.Offset] = true
+	}
+	if err := a.keepLinks(matchedItems, skip); err != nil {
+		return err
+	}
+
+	if err := a.beginWrite(); err != nil {
+		return err
+	}
+	return a.markDeleted(matchedItems)
 }
 
 // Move moves items matched by the given pattern to its new destination.
+// Hard links to a moved file are linked to its new path.
 func (a Archive) Move(ch chan *item.Item, src, target string) error {
 	if ch != nil {
 		defer func() {
@@ -259,42 +601,18 @@ func (a Archive) Move(ch chan *item.Item, src, target string) error {
 		}()
 	}
 
-	type matchedItem struct {
-		item  *item.Item
-		start int64
-		end   int64
-	}
-
-	var matchedItems []*matchedItem
-	toIsFile := false
-	err := a.iterateItems(func(i *item.Item) error {
-		if toIsFile && target == i.Header.Path && i.Header.Type() == item.ModeRegular {
-			toIsFile = false
-		}
-
+	var matchedItems []*item.Item
+	err := a.eachItem(func(i *item.Item) error {
 		matched, err := filepath.Match(src, i.Header.Path)
 		if err != nil {
 			return err
 		}
-
-		start, err := a.file.Seek(0, io.SeekCurrent)
-		if err != nil {
-			return err
-		}
-		var end int64
-		if i.Header.Type() == item.ModeRegular {
-			end, err = a.skipChunks(i.Header.Chunks)
-			if err != nil {
-				return err
-			}
-		}
-
 		if matched {
 			if ch != nil {
 				ch <- i
 			}
 
-			matchedItems = append(matchedItems, &matchedItem{i, start, end})
+			matchedItems = append(matchedItems, i)
 		}
 
 		return nil
@@ -303,178 +621,643 @@ func (a Archive) Move(ch chan *item.Item, src, target string) error {
 		return err
 	}
 
-	writeFile, err := os.OpenFile(a.path, os.O_WRONLY, 0666)
+	// The new paths of the moved files, which hard links may refer to.
+	var targets []*item.Item
+	paths := map[string]string{}
+	skip := map[int64]bool{}
+	for _, i := range matchedItems {
+		skip[i.Offset] = true
+		if i.Header.Type() == item.ModeRegular && i.Header.Deleted == 0 {
+			targets = append(targets, i)
+			paths[i.Header.Path] = movedPath(i, target, len(matchedItems))
+		}
+	}
+	groups, err := a.linksTo(targets, skip)
 	if err != nil {
 		return err
 	}
-	defer func() {
-		writeFile.Sync()
-		writeFile.Close()
-	}()
 
-	if _, err := writeFile.Seek(0, io.SeekEnd); err != nil {
+	if err := a.beginWrite(); err != nil {
 		return err
 	}
+	defer a.invalidateIndex()
 
-	// If moving multiple items the destination path cannot be a file.
-	if len(matchedItems) > 1 && toIsFile {
-		return errors.New("destination path is an existing file, should be missing or directory")
-	}
+	writeFile := &offsetWriter{w: a.file, off: a.idx.end}
 
-	for _, mi := range matchedItems {
-		if _, err := a.file.Seek(mi.item.Offset-mi.item.Header.Len(), io.SeekStart); err != nil {
+	// The moved items are appended and committed before the original
+	// items are marked as deleted, so that no item is lost on a crash.
+	for _, i := range matchedItems {
+		// Make copy of header
+		hdr := *i.Header
+		hdr.Path = movedPath(i, target, len(matchedItems))
+		if p, ok := paths[hdr.Link]; ok && hdr.Type() == item.ModeHardlink {
+			hdr.Link = p
+		}
+
+		if err := a.appendCopy(writeFile, hdr, i); err != nil {
 			return err
 		}
+	}
 
-		// Make copy of header
-		hdr := *mi.item.Header
+	// Links, which are not moved themselves, are replaced by links to
+	// the new path.
+	for _, g := range groups {
+		for _, l := range g.links {
+			hdr := *l.Header
+			hdr.Link = paths[g.target.Header.Path]
+			if err := a.appendCopy(writeFile, hdr, l); err != nil {
+				return err
+			}
+			matchedItems = append(matchedItems, l)
+		}
+	}
+
+	a.idx.end = writeFile.off
+	if err := a.commit(); err != nil {
+		return err
+	}
+
+	return a.markDeleted(matchedItems)
+}
 
-		mi.item.Header.Deleted = 1
-		if err := mi.item.Header.Write(a.file, a.config); err != nil {
+// movedPath returns the path of the item i moved to target. Multiple
+// items are prefixed with the target path.
+func movedPath(i *item.Item, target string, count int) string {
+	if count > 1 {
+		return filepath.Join(target, i.Header.Path)
+	}
+	return target
+}
+
+// Compact removes all entries that are marked as deleted. The remaining
+// items are copied to a temporary file next to the archive, which then
+// replaces the archive, so that the archive is never left half compacted.
+// If a temporary file of an interrupted compaction is found, it is either
+// resumed or an error is returned.
+//
+// Solid blocks are copied once together with the headers of their
+// remaining files, at the position of the first of them. Blocks without
+// remaining files are dropped.
+//
+// Hard links to deleted files are kept, see keepLinks.
+func (a *Archive) Compact(resume bool) error {
+	tmpPath := a.path + compactSuffix
+	if Exists(tmpPath) && !resume {
+		return errCompactInProgress
+	}
+
+	var deleted []*item.Item
+	err := a.eachItem(func(i *item.Item) error {
+		if i.Header.Deleted != 0 && i.Header.Type() == item.ModeRegular {
+			deleted = append(deleted, i)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := a.keepLinks(deleted, nil); err != nil {
+		return err
+	}
+
+	slices, err := a.remainingSlices()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := a.openCompact(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer tmp.file.Close()
+
+	// Resume after the items which have already been copied, if they
+	// match the remaining items of the archive.
+	done, copied := 0, 0
+	for done < len(slices) && copied+len(slices[done].items) <= len(tmp.idx.items) {
+		for k, i := range slices[done].items {
+			if !sameItem(tmp.idx.items[copied+k].Header, i.Header) {
+				copied = -1
+				break
+			}
+		}
+		if copied < 0 {
+			break
+		}
+		copied += len(slices[done].items)
+		done++
+	}
+	if copied != len(tmp.idx.items) {
+		done = 0
+	}
+	if done == 0 && len(tmp.idx.items) > 0 {
+		if err := tmp.restartCompact(); err != nil {
 			return err
 		}
+	}
 
-		if len(matchedItems) > 1 {
-			// Multiple items are prefixed with the target path.
-			hdr.Path = filepath.Join(target, mi.item.Header.Path)
+	var uncommitted int64
+	for _, sl := range slices[done:] {
+		if sl.block {
+			err = tmp.copyBlock(a.file, sl.start, sl.end, sl.items)
 		} else {
-			hdr.Path = target
+			err = tmp.copyItem(a.file, sl.start, sl.end, sl.items[0])
 		}
-		if err := hdr.Write(writeFile, a.config); err != nil {
-			return nil
+		if err != nil {
+			return err
 		}
 
-		if _, err := io.CopyN(writeFile, a.file, mi.end-mi.start); err != nil {
-			return err
+		uncommitted += sl.end - sl.start
+		if uncommitted >= compactCommitSize {
+			if err := tmp.commit(); err != nil {
+				return err
+			}
+			uncommitted = 0
 		}
 	}
 
-	return nil
-}
-
-// Compact removes all entries that are marked as deleted.
-func (a Archive) Compact() error {
-	if _, err := a.file.Seek(headerLength, io.SeekStart); err != nil {
+	if err := tmp.commit(); err != nil {
+		return err
+	}
+	if err := tmp.writeIndex(); err != nil {
 		return err
 	}
 
-	slices := [][2]int64{}
-	curOffset := int64(headerLength)
+	return a.replace(tmp)
+}
 
-	err := a.iterateItems(func(i *item.Item) error {
-		lastOffset := curOffset
-		curOffset += i.Header.Len()
+// slice is a range of the archive, which is copied by a compaction. It is
+// either an item including its chunks or a solid block, which is copied
+// together with the headers of its items.
+type slice struct {
+	items      []*item.Item
+	start, end int64
+	block      bool
+}
 
-		if i.Header.Type() == item.ModeRegular && i.Header.Size > 0 {
+// remainingSlices returns the slices of all items, which are not marked
+// as deleted. Solid blocks are placed at the first of their items.
+func (a Archive) remainingSlices() ([]*slice, error) {
+	var slices []*slice
+	blocks := map[int64]*slice{}
+	err := a.iterateItems(func(i *item.Item) error {
+		end := i.Offset
+		if i.Header.Type() == item.ModeRegular && i.Header.Chunks > 0 {
 			pos, err := a.skipChunks(i.Header.Chunks)
 			if err != nil {
 				return err
 			}
-
-			curOffset = pos
+			end = pos
 		}
 
-		if i.Header.Deleted == 1 {
-			slices = append(slices, [2]int64{lastOffset, curOffset})
+		if i.Header.Deleted != 0 {
+			return nil
+		}
+		if i.Header.IsSolid() {
+			pos := blockOf(i)
+			if sl, ok := blocks[pos]; ok {
+				sl.items = append(sl.items, i)
+				return nil
+			}
+			n, err := a.blockLength(pos)
+			if err != nil {
+				return err
+			}
+			blocks[pos] = &slice{[]*item.Item{i}, pos, pos + n, true}
+			slices = append(slices, blocks[pos])
+			return nil
 		}
+		slices = append(slices, &slice{[]*item.Item{i}, i.Offset - i.Header.Len(), end, false})
 
 		return nil
 	})
-	if err != nil {
+
+	return slices, err
+}
+
+// replace replaces the archive by the completely written temporary
+// archive tmp and reopens it.
+func (a *Archive) replace(tmp *Archive) error {
+	vs, isSet := a.file.(*volumeSet)
+	if isSet {
+		// Every volume of the archive is replaced, the surplus ones by
+		// empty volumes, which are removed when the set is opened.
+		tvs := tmp.file.(*volumeSet)
+		for len(tvs.files) < len(vs.files) {
+			if err := tvs.addVolume(); err != nil {
+				return err
+			}
+		}
+		if err := tvs.Sync(); err != nil {
+			return err
+		}
+	}
+	if err := tmp.file.Close(); err != nil {
 		return err
 	}
 
-	stat, err := a.file.Stat()
+	// The new file is locked before it replaces the archive, so that
+	// processes waiting for the lock of the old file lock the new one.
+	tmpPath := tmp.path
+	if isSet {
+		tmpPath = volumePath(tmp.path, 1)
+	}
+	lock, err := lockArchive(tmpPath, false, true, false)
 	if err != nil {
 		return err
 	}
-	slices = append(slices, [2]int64{stat.Size(), 0})
 
-	writeFile, err := os.OpenFile(a.path, os.O_WRONLY, 0666)
+	if isSet {
+		err = renameVolumes(tmp.path, a.path)
+	} else {
+		if err = os.Rename(tmp.path, a.path); err == nil {
+			err = syncDir(filepath.Dir(a.path))
+		}
+	}
 	if err != nil {
+		lock.unlock()
 		return err
 	}
-	defer func() {
-		writeFile.Sync()
-		writeFile.Close()
-	}()
+	if a.lock != nil {
+		prev := *a.lock
+		*a.lock = *lock
+		prev.unlock()
+	} else {
+		lock.unlock()
+	}
 
-	if _, err := a.file.Seek(0, io.SeekStart); err != nil {
+	fh, err := openStorage(a.path, a.config.VolumeSize, os.O_RDWR)
+	if err != nil {
 		return err
 	}
+	a.file.Close()
+	a.file = fh
+	*a.idx = *tmp.idx
+	a.blocks.data = nil
+	a.chunks.reset()
 
-	newSize := int64(0)
-	offset := int64(0)
-	for _, slice := range slices {
-		n, err := io.CopyN(writeFile, a.file, slice[0]-offset)
+	return nil
+}
+
+// openCompact opens the temporary file of a compaction. A new file starts
+// with the header of the archive, an existing one is read like an archive
+// to drop an uncommitted tail.
+func (a Archive) openCompact(path string) (*Archive, error) {
+	fh, err := a.openTemp(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// The temporary file starts with the header and the dictionary of
+	// the archive.
+	tmp := &Archive{path: path, file: fh, header: a.header, start: a.start, config: a.config, idx: &index{}}
+	stat, err := fh.Stat()
+	if err != nil {
+		fh.Close()
+		return nil, err
+	}
+
+	if stat.Size() < a.start {
+		if err := fh.Truncate(0); err != nil {
+			fh.Close()
+			return nil, err
+		}
+		if _, err := io.Copy(fh, io.NewSectionReader(a.file, 0, a.start)); err != nil {
+			fh.Close()
+			return nil, err
+		}
+		if err := tmp.restartCompact(); err != nil {
+			fh.Close()
+			return nil, err
+		}
+		return tmp, nil
+	}
+
+	if err := tmp.loadIndex(); err != nil && err != errDamaged {
+		fh.Close()
+		return nil, err
+	}
+	if tmp.idx.items == nil || tmp.idx.end > stat.Size() {
+		// The temporary file is damaged or its last item is incomplete,
+		// start over.
+		if err := tmp.restartCompact(); err != nil {
+			fh.Close()
+			return nil, err
+		}
+	}
+	if tmp.idx.stored {
+		if err := fh.Truncate(tmp.idx.end); err != nil {
+			fh.Close()
+			return nil, err
+		}
+		tmp.idx.stored = false
+	}
+
+	return tmp, nil
+}
+
+// openTemp opens the temporary file or volume set at path, which later
+// replaces the archive. It gets the permissions and the owner of the
+// archive, so that they are kept by the rename.
+func (a Archive) openTemp(path string) (storage, error) {
+	stat, err := a.file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		fh    storage
+		files []*os.File
+	)
+	if vs, ok := a.file.(*volumeSet); ok {
+		tvs, err := openVolumes(path, vs.size, os.O_RDWR|os.O_CREATE)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		newSize += n
+		fh, files = tvs, tvs.files
+	} else {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, stat.Mode().Perm())
+		if err != nil {
+			return nil, err
+		}
+		fh, files = f, []*os.File{f}
+	}
 
-		offset = slice[1]
-		if offset > 0 {
-			if _, err := a.file.Seek(offset, io.SeekStart); err != nil {
-				return err
-			}
+	for _, f := range files {
+		if err := inheritMode(f, stat); err != nil {
+			fh.Close()
+			return nil, err
 		}
 	}
 
-	writeFile.Truncate(newSize)
+	return fh, nil
+}
 
+// inheritMode applies the permissions of the given file info to fh. The
+// owner is applied too, if running as root.
+func inheritMode(fh *os.File, stat os.FileInfo) error {
+	if err := fh.Chmod(stat.Mode().Perm()); err != nil {
+		return err
+	}
+	if uid, gid, ok := ownerOf(stat); ok && os.Geteuid() == 0 {
+		return fh.Chown(uid, gid)
+	}
 	return nil
 }
 
+// restartCompact truncates the temporary file of a compaction after the
+// header and commits it. The temporary file thus always has a commit
+// record, so that an incomplete item is removed when it is resumed.
+func (a Archive) restartCompact() error {
+	if err := a.file.Truncate(a.start); err != nil {
+		return err
+	}
+	*a.idx = index{items: []*item.Item{}, end: a.start}
+	return a.commit()
+}
+
+// sameItem returns whether both headers describe the same item.
+func sameItem(a, b *item.Header) bool {
+	return a.Path == b.Path && a.Size == b.Size && a.Chunks == b.Chunks &&
+		a.MTime.Equal(b.MTime) && bytes.Equal(a.Checksum, b.Checksum)
+}
+
+// syncDir syncs a directory to persist a rename.
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// offsetWriter writes sequentially to w starting at off.
+type offsetWriter struct {
+	w   io.WriterAt
+	off int64
+}
+
+func (o *offsetWriter) Write(p []byte) (int, error) {
+	n, err := o.w.WriteAt(p, o.off)
+	o.off += int64(n)
+	return n, err
+}
+
 // Extract extracts the archive to the give base path.
+// Links are created after all other items have been extracted, so that
+// hard link targets exist and no item is written through a symlink from
+// the archive. The times of directories are restored last, as extracting
+// their children modifies them.
+//
+// With more than one thread, the headers are read in order and the bodies
+// of files are extracted by a pool of workers using positional reads.
+// Items are sent to ch in the order of the archive, when their extraction
+// starts, but files may be completed in any order. Directories, FIFOs and
+// devices are created in order by the reader, before any file below them.
+// Files with the same path are extracted by the same worker, so the last
+// one in the archive wins as without workers.
 func (a Archive) Extract(ch chan *item.Item, dest string) error {
 	defer func() {
 		close(ch)
 	}()
-	return a.iterateItems(func(i *item.Item) error {
+
+	threads := a.config.Threads
+	if a.in != nil {
+		// A stream can only be read in order.
+		threads = 1
+	}
+	workers := newExtractWorkers(a, threads)
+
+	var hardlinks, symlinks, dirs []*item.Item
+	err := a.iterateItems(func(i *item.Item) error {
 		ch <- i
 
 		path := filepath.Join(dest, i.Header.Path)
-		if i.Header.Type() == item.ModeRegular {
-			if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
-				return err
-			}
-
-			dest, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+		if i.Header.IsSolid() {
+			// Only the block of the item is decrypted.
+			content, err := a.solidContent(i)
 			if err != nil {
 				return err
 			}
+			if workers == nil {
+				return a.extractFile(bytes.NewReader(content), path, i)
+			}
+			return workers.extract(bytes.NewReader(content), path, i)
+		} else if i.Header.Type() == item.ModeRegular {
+			if workers == nil {
+				return a.extractFile(a.reader(), path, i)
+			}
 
-			if i.Header.Size > 0 {
-				if err := i.Extract(a.file, dest, a.config); err != nil {
-					dest.Close()
+			src := io.NewSectionReader(a.file, i.Offset, 0)
+			if i.Header.Chunks > 0 {
+				end, err := a.skipChunks(i.Header.Chunks)
+				if err != nil {
 					return err
 				}
+				src = io.NewSectionReader(a.file, i.Offset, end-i.Offset)
 			}
-
-			dest.Close()
+			return workers.extract(src, path, i)
 		} else if i.Header.Type() == item.ModeDir {
 			if err := os.MkdirAll(path, os.ModePerm); err != nil {
 				return err
 			}
+			dirs = append(dirs, i)
+			return a.restoreAttrs(path, i)
+		} else if t := i.Header.Type(); t == item.ModeFIFO || t == item.ModeCharDevice || t == item.ModeBlockDevice {
+			created, err := extractSpecial(path, i.Header)
+			if err != nil || !created {
+				return err
+			}
+		} else if i.Header.Type() == item.ModeHardlink {
+			hardlinks = append(hardlinks, i)
+			return nil
+		} else if i.Header.Type() == item.ModeSymlink {
+			symlinks = append(symlinks, i)
+			return nil
+		}
+
+		if err := a.restoreAttrs(path, i); err != nil {
+			return err
 		}
 
-		return os.Chtimes(path, i.Header.MTime, i.Header.MTime)
+		return restoreTimes(path, i)
 	})
+	if werr := workers.wait(); err == nil {
+		err = werr
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, i := range append(hardlinks, symlinks...) {
+		if err := extractLink(dest, i); err != nil {
+			return err
+		}
+		if i.Header.Type() == item.ModeSymlink {
+			path := filepath.Join(dest, i.Header.Path)
+			if err := a.restoreAttrs(path, i); err != nil {
+				return err
+			}
+			if err := restoreTimes(path, i); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, i := range dirs {
+		if err := restoreTimes(filepath.Join(dest, i.Header.Path), i); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
-// Stream streams an item from the archive.
-func (a Archive) Stream(item *item.Item, dest io.Writer, start, end int) error {
-	if _, err := a.file.Seek(item.Offset, io.SeekStart); err != nil {
+// extractFile extracts the regular file i from src to path. The source
+// of a solid item is its content.
+func (a Archive) extractFile(src io.Reader, path string, i *item.Item) error {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+
+	dest, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
 		return err
 	}
 
-	if item.Header.Size > 0 {
-		if err := item.ExtractRange(a.file, dest, start, end, a.config); err != nil {
+	if i.Header.Size > 0 {
+		if i.Header.IsSolid() {
+			err = i.ExtractSolid(src, dest)
+		} else {
+			err = i.Extract(src, dest, a.config)
+		}
+		if err != nil {
+			dest.Close()
+			if err == item.ErrChecksumMismatch {
+				return fmt.Errorf("%s: %s", i.Header.Path, err)
+			}
 			return err
 		}
 	}
 
-	return nil
+	dest.Close()
+
+	if err := a.restoreAttrs(path, i); err != nil {
+		return err
+	}
+
+	return restoreTimes(path, i)
+}
+
+// restoreAttrs applies the stored ownership, extended attributes and ACLs
+// to the extracted item if requested. Only root is allowed to change the
+// owner of a file.
+func (a Archive) restoreAttrs(path string, i *item.Item) error {
+	if (a.config.SameOwner || a.config.NumericOwner) && os.Geteuid() == 0 {
+		if err := a.owners.chown(path, i.Header, a.config.NumericOwner); err != nil {
+			return err
+		}
+	}
+
+	return writeXattrs(path, i.Header.Xattrs, a.config.Xattrs, a.config.ACLs)
+}
+
+// restoreTimes applies the stored access and modification time to the
+// extracted item. The mtime is used if the access time is unknown.
+func restoreTimes(path string, i *item.Item) error {
+	atime := i.Header.ATime
+	if atime.IsZero() {
+		atime = i.Header.MTime
+	}
+
+	if i.Header.Type() == item.ModeSymlink {
+		return lchtimes(path, atime, i.Header.MTime)
+	}
+	return os.Chtimes(path, atime, i.Header.MTime)
+}
+
+// extractLink creates the symlink or hard link of the given item below
+// dest. An existing file at the same path is replaced.
+func extractLink(dest string, i *item.Item) error {
+	path := filepath.Join(dest, i.Header.Path)
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+
+	if _, err := os.Lstat(path); err == nil {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+
+	if i.Header.Type() == item.ModeHardlink {
+		return os.Link(filepath.Join(dest, i.Header.Link), path)
+	}
+	return os.Symlink(i.Header.Link, path)
+}
+
+// Stream writes the inclusive range [start, end] of the content of an
+// item to dest, see OpenItem. The range is cut at the end of the content.
+func (a Archive) Stream(i *item.Item, dest io.Writer, start, end int64) error {
+	if i.Header.Size == 0 {
+		return nil
+	}
+	if end >= i.Header.Size {
+		end = i.Header.Size - 1
+	}
+	if start > end {
+		return nil
+	}
+
+	r, err := a.OpenItem(i)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	_, err = io.Copy(dest, io.NewSectionReader(r, start, end-start+1))
+	return err
 }
 
 // UpdatePassword updates the password of the archive.
@@ -519,3 +1302,7 @@ func (a Archive) skipChunks(n int64) (int64, error) {
 
 	return pos, nil
 }
+
+var (
+	errCompactInProgress = errors.New("interrupted compaction found, resume it or remove the temporary file")
+)
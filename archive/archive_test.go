@@ -1,13 +1,19 @@
 package archive
 
 import (
+	"bytes"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"runtime"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/marcboeker/supertar/compress"
 	"github.com/marcboeker/supertar/config"
 	"github.com/marcboeker/supertar/item"
 	"github.com/stretchr/testify/suite"
@@ -42,7 +48,7 @@ func (s *ArchiveTestSuite) TestArchiveExists() {
 		s.T().Error("archive file does not exist")
 	}
 
-	s.Assert().Equal(headerLength, int(stat.Size()))
+	s.Assert().Equal(headerLength+commitLength, int(stat.Size()))
 }
 
 func (s *ArchiveTestSuite) TestConfig() {
@@ -74,9 +80,170 @@ func (s *ArchiveTestSuite) TestArchiveCompression() {
 	s.NotEqual(withCompression, withoutCompression)
 }
 
+func (s *ArchiveTestSuite) TestCodecs() {
+	for _, name := range compress.Names() {
+		s.arch.Close()
+		os.Remove(s.config.Path)
+
+		codec, err := compress.Parse(name)
+		s.Require().NoError(err)
+		c := *s.config
+		c.Compression = codec != compress.None
+		c.Codec = codec
+		arch, err := NewArchive(&c)
+		s.Require().NoError(err)
+		s.Require().NoError(arch.Add("", "archive.go"))
+		s.Require().NoError(arch.Close())
+
+		c = config.Config{Path: s.config.Path, Password: s.config.Password}
+		s.arch, err = NewArchive(&c)
+		s.Require().NoError(err)
+		s.Assert().Equal(codec, c.Codec, name)
+		s.Assert().True(s.arch.Verify(nil).OK(), name)
+	}
+}
+
+func (s *ArchiveTestSuite) TestLevel() {
+	s.arch.Close()
+	os.Remove(s.config.Path)
+
+	c := *s.config
+	c.Compression = true
+	c.Codec = compress.Zstd
+	c.Level = 19
+	arch, err := NewArchive(&c)
+	s.Require().NoError(err)
+	s.Require().NoError(arch.Close())
+
+	// The level of the header is used unless it is overridden.
+	c = config.Config{Path: s.config.Path, Password: s.config.Password}
+	arch, err = NewArchive(&c)
+	s.Require().NoError(err)
+	s.Assert().Equal(19, c.Level)
+	s.Require().NoError(arch.Close())
+
+	c = config.Config{Path: s.config.Path, Password: s.config.Password, Level: 1}
+	arch, err = NewArchive(&c)
+	s.Require().NoError(err)
+	s.Assert().Equal(1, c.Level)
+	s.Require().NoError(arch.Add("", "archive.go"))
+	s.Require().NoError(arch.Close())
+
+	c = config.Config{Path: s.config.Path, Password: s.config.Password, Level: compress.MaxLevel + 1}
+	_, err = NewArchive(&c)
+	s.Assert().Equal(compress.ErrInvalidLevel, err)
+
+	c = config.Config{Path: s.config.Path, Password: s.config.Password}
+	s.arch, err = NewArchive(&c)
+	s.Require().NoError(err)
+	s.Assert().Equal(19, c.Level)
+	s.Assert().True(s.arch.Verify(nil).OK())
+}
+
+func (s *ArchiveTestSuite) TestLevelAboveMax() {
+	s.arch.Close()
+	os.Remove(s.config.Path)
+
+	c := *s.config
+	c.Compression = true
+	c.Codec = compress.Zstd
+	arch, err := NewArchive(&c)
+	s.Require().NoError(err)
+	s.Require().NoError(arch.Close())
+
+	// Store a level above the highest level of the codec.
+	fh, err := os.OpenFile(s.config.Path, os.O_RDWR, 0)
+	s.Require().NoError(err)
+	pos := int64(magicNumberLength + versionLength)
+	_, err = fh.WriteAt([]byte{byte(compress.Zstd) | compress.MaxLevel<<levelShift}, pos)
+	s.Require().NoError(err)
+	s.Require().NoError(fh.Close())
+
+	// The archive is opened and written with the highest level.
+	c = config.Config{Path: s.config.Path, Password: s.config.Password}
+	s.arch, err = NewArchive(&c)
+	s.Require().NoError(err)
+	s.Assert().Equal(compress.MaxLevel, c.Level)
+	s.Require().NoError(s.arch.Add("", "archive.go"))
+	s.Assert().True(s.arch.Verify(nil).OK())
+}
+
 func (s *ArchiveTestSuite) TestOpenExisting() {
+	s.arch.Close()
+
+	var err error
+	s.arch, err = NewArchive(s.config)
+	s.Assert().NoError(err)
+}
+
+func (s *ArchiveTestSuite) TestLock() {
 	_, err := NewArchive(s.config)
+	s.Require().IsType(&LockedError{}, err)
+	if runtime.GOOS == "linux" {
+		s.Assert().Contains(err.Error(), fmt.Sprintf("pid %d", os.Getpid()))
+	}
+
+	readOnly := *s.config
+	readOnly.ReadOnly = true
+	_, err = NewArchive(&readOnly)
+	s.Assert().Error(err)
+
+	// Readers share the lock, but lock out writers.
+	s.arch.Close()
+	reader1, err := NewArchive(&readOnly)
+	s.Require().NoError(err)
+	reader2, err := NewArchive(&readOnly)
+	s.Require().NoError(err)
+
+	_, err = NewArchive(s.config)
+	s.Require().IsType(&LockedError{}, err)
+	s.Assert().Equal("archive is locked by another process", err.Error())
+
+	reader1.Close()
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		reader2.Close()
+	}()
+
+	wait := *s.config
+	wait.Wait = true
+	s.arch, err = NewArchive(&wait)
 	s.Assert().NoError(err)
+
+	// The archive file itself is locked.
+	_, err = os.Stat(s.config.Path + ".lock")
+	s.Assert().True(os.IsNotExist(err))
+}
+
+func (s *ArchiveTestSuite) TestLockCompact() {
+	s.Require().NoError(s.arch.Add("", "archive.go"))
+	s.Require().NoError(s.arch.Delete(nil, "archive.go"))
+
+	// A reader waiting for the lock of the replaced file locks the new
+	// file after the compaction.
+	readOnly := *s.config
+	readOnly.ReadOnly = true
+	readOnly.Wait = true
+	done := make(chan *Archive)
+	go func() {
+		arch, err := NewArchive(&readOnly)
+		s.Assert().NoError(err)
+		done <- arch
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	s.Require().NoError(s.arch.Compact(false))
+	_, err := NewArchive(&config.Config{Path: s.config.Path, Password: s.config.Password, ReadOnly: true})
+	s.Require().IsType(&LockedError{}, err)
+
+	s.Require().NoError(s.arch.Close())
+	reader := <-done
+	s.Require().NotNil(reader)
+	s.Assert().Empty(reader.idx.items)
+	s.Require().NoError(reader.Close())
+
+	s.arch, err = NewArchive(s.config)
+	s.Require().NoError(err)
 }
 
 func (s *ArchiveTestSuite) TestList() {
@@ -110,6 +277,31 @@ func (s *ArchiveTestSuite) TestList() {
 	s.Assert().False(notFound, "could not find file main.go")
 }
 
+func (s *ArchiveTestSuite) TestOwner() {
+	err := s.arch.AddRecursive(".", "archive.go", nil)
+	s.Assert().NoError(err)
+
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+
+	var items []*item.Item
+	ch := make(chan *item.Item)
+	go func() {
+		for i := range ch {
+			items = append(items, i)
+		}
+		wg.Done()
+	}()
+
+	err = s.arch.List(ch, "")
+	s.Assert().NoError(err)
+	wg.Wait()
+
+	s.Require().Len(items, 1)
+	s.Assert().Equal(os.Getuid(), items[0].Header.UID)
+	s.Assert().Equal(os.Getgid(), items[0].Header.GID)
+}
+
 func (s *ArchiveTestSuite) TestExtract() {
 	err := s.arch.AddRecursive(".", "archive.go", nil)
 	s.Assert().NoError(err)
@@ -132,6 +324,301 @@ func (s *ArchiveTestSuite) TestExtract() {
 	os.RemoveAll(path)
 }
 
+func (s *ArchiveTestSuite) TestExtractParallel() {
+	err := s.arch.AddRecursive("../", "../archive", nil)
+	s.Require().NoError(err)
+
+	// The last of several files with the same path wins.
+	dir, err := ioutil.TempDir("", "supertar")
+	s.Require().NoError(err)
+	defer os.RemoveAll(dir)
+	for _, content := range []string{"first", "second", "third"} {
+		s.Require().NoError(ioutil.WriteFile(filepath.Join(dir, "foo.txt"), []byte(content), 0666))
+		s.Require().NoError(s.arch.Add(dir, filepath.Join(dir, "foo.txt")))
+	}
+
+	path := filepath.Join(s.tmpDir, "archive-parallel-test")
+	defer os.RemoveAll(path)
+	s.arch.config.Threads = 4
+	ch := make(chan *item.Item)
+	go func() {
+		for range ch {
+		}
+	}()
+	s.Require().NoError(s.arch.Extract(ch, path))
+
+	files, err := filepath.Glob("*.go")
+	s.Require().NoError(err)
+	for _, f := range files {
+		orig, err := ioutil.ReadFile(f)
+		s.Assert().NoError(err)
+		data, err := ioutil.ReadFile(filepath.Join(path, "archive", f))
+		s.Assert().NoError(err)
+		s.Assert().Equal(orig, data, f)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(path, "foo.txt"))
+	s.Assert().NoError(err)
+	s.Assert().Equal("third", string(data))
+}
+
+func (s *ArchiveTestSuite) TestExtractParallelSameOwner() {
+	if os.Geteuid() != 0 {
+		s.T().Skip("changing the owner requires root")
+	}
+
+	src := filepath.Join(s.tmpDir, "archive-owner-src")
+	s.Require().NoError(os.MkdirAll(src, os.ModePerm))
+	defer os.RemoveAll(src)
+
+	// The files belong to several users, which are looked up by all
+	// workers at once.
+	owners := map[string]int{}
+	for n := 0; n < 64; n++ {
+		name := fmt.Sprintf("file-%d.txt", n)
+		s.Require().NoError(ioutil.WriteFile(filepath.Join(src, name), []byte(name), 0644))
+		s.Require().NoError(os.Chown(filepath.Join(src, name), n%4, n%4))
+		owners[name] = n % 4
+	}
+
+	err := s.arch.AddRecursive(s.tmpDir, src, nil)
+	s.Require().NoError(err)
+
+	path := filepath.Join(s.tmpDir, "archive-owner-test")
+	defer os.RemoveAll(path)
+	s.arch.config.Threads = 4
+	s.arch.config.SameOwner = true
+	ch := make(chan *item.Item)
+	go func() {
+		for range ch {
+		}
+	}()
+	s.Require().NoError(s.arch.Extract(ch, path))
+
+	for name, id := range owners {
+		stat, err := os.Lstat(filepath.Join(path, "archive-owner-src", name))
+		s.Require().NoError(err)
+		uid, gid, ok := ownerOf(stat)
+		s.Require().True(ok)
+		s.Assert().Equal(id, uid, name)
+		s.Assert().Equal(id, gid, name)
+	}
+}
+
+func (s *ArchiveTestSuite) TestExtractTimes() {
+	src := filepath.Join(s.tmpDir, "archive-times-src")
+	s.Require().NoError(os.MkdirAll(src, os.ModePerm))
+	defer os.RemoveAll(src)
+
+	file := filepath.Join(src, "foo.txt")
+	s.Require().NoError(ioutil.WriteFile(file, []byte("eekeek"), 0644))
+	mtime := time.Unix(1600000000, 123456789)
+	s.Require().NoError(os.Chtimes(file, mtime, mtime))
+	s.Require().NoError(os.Chtimes(src, mtime, mtime))
+
+	err := s.arch.AddRecursive(s.tmpDir, src, nil)
+	s.Assert().NoError(err)
+
+	path := filepath.Join(s.tmpDir, "archive-times-test")
+	defer os.RemoveAll(path)
+
+	ch := make(chan *item.Item)
+	go func() {
+		for range ch {
+		}
+	}()
+
+	err = s.arch.Extract(ch, path)
+	s.Assert().NoError(err)
+
+	for _, p := range []string{"archive-times-src", "archive-times-src/foo.txt"} {
+		stat, err := os.Stat(filepath.Join(path, p))
+		s.Require().NoError(err)
+		s.Assert().True(mtime.Equal(stat.ModTime()), p)
+	}
+}
+
+func (s *ArchiveTestSuite) TestExtractSymlink() {
+	src := filepath.Join(s.tmpDir, "archive-symlink-src")
+	s.Require().NoError(os.MkdirAll(src, os.ModePerm))
+	defer os.RemoveAll(src)
+
+	s.Require().NoError(ioutil.WriteFile(filepath.Join(src, "target.txt"), []byte("eekeek"), 0644))
+	s.Require().NoError(os.Symlink("target.txt", filepath.Join(src, "link.txt")))
+	s.Require().NoError(os.Symlink("missing.txt", filepath.Join(src, "dangling.txt")))
+
+	err := s.arch.AddRecursive(s.tmpDir, src, nil)
+	s.Assert().NoError(err)
+
+	path := filepath.Join(s.tmpDir, "archive-symlink-test")
+	defer os.RemoveAll(path)
+
+	ch := make(chan *item.Item)
+	go func() {
+		for range ch {
+		}
+	}()
+
+	err = s.arch.Extract(ch, path)
+	s.Assert().NoError(err)
+
+	target, err := os.Readlink(filepath.Join(path, "archive-symlink-src", "link.txt"))
+	s.Assert().NoError(err)
+	s.Assert().Equal("target.txt", target)
+
+	target, err = os.Readlink(filepath.Join(path, "archive-symlink-src", "dangling.txt"))
+	s.Assert().NoError(err)
+	s.Assert().Equal("missing.txt", target)
+}
+
+func (s *ArchiveTestSuite) TestExtractHardlink() {
+	src := filepath.Join(s.tmpDir, "archive-hardlink-src")
+	s.Require().NoError(os.MkdirAll(src, os.ModePerm))
+	defer os.RemoveAll(src)
+
+	s.Require().NoError(ioutil.WriteFile(filepath.Join(src, "a.txt"), []byte("eekeek"), 0644))
+	s.Require().NoError(os.Link(filepath.Join(src, "a.txt"), filepath.Join(src, "b.txt")))
+
+	err := s.arch.AddRecursive(s.tmpDir, src, nil)
+	s.Assert().NoError(err)
+
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+
+	var links []*item.Item
+	ch := make(chan *item.Item)
+	go func() {
+		for i := range ch {
+			if i.Header.Type() == item.ModeHardlink {
+				links = append(links, i)
+			}
+		}
+		wg.Done()
+	}()
+
+	err = s.arch.List(ch, "")
+	s.Assert().NoError(err)
+	wg.Wait()
+
+	s.Require().Len(links, 1)
+	s.Assert().Equal("archive-hardlink-src/b.txt", links[0].Header.Path)
+	s.Assert().Equal("archive-hardlink-src/a.txt", links[0].Header.Link)
+	s.Assert().Equal(int64(0), links[0].Header.Chunks)
+
+	path := filepath.Join(s.tmpDir, "archive-hardlink-test")
+	defer os.RemoveAll(path)
+
+	ch = make(chan *item.Item)
+	go func() {
+		for range ch {
+		}
+	}()
+
+	err = s.arch.Extract(ch, path)
+	s.Assert().NoError(err)
+
+	a, err := os.Stat(filepath.Join(path, "archive-hardlink-src", "a.txt"))
+	s.Require().NoError(err)
+	b, err := os.Stat(filepath.Join(path, "archive-hardlink-src", "b.txt"))
+	s.Require().NoError(err)
+	s.Assert().True(os.SameFile(a, b))
+}
+
+// hardlinkSource creates the hard links a.txt, b.txt and c.txt and
+// returns their directory.
+func (s *ArchiveTestSuite) hardlinkSource() string {
+	src := filepath.Join(s.tmpDir, "archive-hardlink-src")
+	s.Require().NoError(os.MkdirAll(src, os.ModePerm))
+	s.Require().NoError(ioutil.WriteFile(filepath.Join(src, "a.txt"), []byte("eekeek"), 0644))
+	s.Require().NoError(os.Link(filepath.Join(src, "a.txt"), filepath.Join(src, "b.txt")))
+	s.Require().NoError(os.Link(filepath.Join(src, "a.txt"), filepath.Join(src, "c.txt")))
+	return src
+}
+
+// extractLinks extracts the archive and checks that the given paths are
+// links to the same file with the content of a.txt.
+func (s *ArchiveTestSuite) extractLinks(paths ...string) {
+	path := filepath.Join(s.tmpDir, "archive-hardlink-test")
+	defer os.RemoveAll(path)
+
+	ch := make(chan *item.Item)
+	go func() {
+		for range ch {
+		}
+	}()
+	s.Require().NoError(s.arch.Extract(ch, path))
+
+	var first os.FileInfo
+	for _, p := range paths {
+		data, err := ioutil.ReadFile(filepath.Join(path, p))
+		s.Require().NoError(err, p)
+		s.Assert().Equal("eekeek", string(data), p)
+		stat, err := os.Stat(filepath.Join(path, p))
+		s.Require().NoError(err)
+		if first == nil {
+			first = stat
+		}
+		s.Assert().True(os.SameFile(first, stat), p)
+	}
+}
+
+func (s *ArchiveTestSuite) TestDeleteHardlinkTarget() {
+	src := s.hardlinkSource()
+	defer os.RemoveAll(src)
+
+	for _, solid := range []bool{false, true} {
+		s.arch.Close()
+		os.Remove(s.config.Path)
+		c := *s.config
+		c.Solid = solid
+		var err error
+		s.arch, err = NewArchive(&c)
+		s.Require().NoError(err)
+		s.Require().NoError(s.arch.AddRecursive(s.tmpDir, src, nil))
+
+		// The first remaining link takes over the content.
+		s.Require().NoError(s.arch.Delete(nil, "archive-hardlink-src/a.txt"))
+		s.Require().NoError(s.arch.Compact(false))
+		paths := s.listPaths()
+		s.Assert().NotContains(paths, "archive-hardlink-src/a.txt")
+		s.extractLinks("archive-hardlink-src/b.txt", "archive-hardlink-src/c.txt")
+	}
+
+	// Targets, which have been deleted without keeping their links, are
+	// replaced on compaction.
+	s.arch.Close()
+	os.Remove(s.config.Path)
+	var err error
+	s.arch, err = NewArchive(s.config)
+	s.Require().NoError(err)
+	s.Require().NoError(s.arch.AddRecursive(s.tmpDir, src, nil))
+	var target []*item.Item
+	for _, i := range s.arch.idx.items {
+		if i.Header.Path == "archive-hardlink-src/a.txt" {
+			target = append(target, i)
+		}
+	}
+	s.Require().NoError(s.arch.beginWrite())
+	s.Require().NoError(s.arch.markDeleted(target))
+	s.Require().NoError(s.arch.Compact(false))
+	s.extractLinks("archive-hardlink-src/b.txt", "archive-hardlink-src/c.txt")
+}
+
+func (s *ArchiveTestSuite) TestMoveHardlinkTarget() {
+	src := s.hardlinkSource()
+	defer os.RemoveAll(src)
+	s.Require().NoError(s.arch.AddRecursive(s.tmpDir, src, nil))
+
+	s.Require().NoError(s.arch.Move(nil, "archive-hardlink-src/a.txt", "archive-hardlink-src/d.txt"))
+	s.Require().NoError(s.arch.Compact(false))
+	s.extractLinks("archive-hardlink-src/d.txt", "archive-hardlink-src/b.txt", "archive-hardlink-src/c.txt")
+
+	// Moved links to a moved file are linked to its new path.
+	s.Require().NoError(s.arch.Move(nil, "archive-hardlink-src/*", "moved"))
+	s.Require().NoError(s.arch.Compact(false))
+	s.extractLinks("moved/archive-hardlink-src/d.txt", "moved/archive-hardlink-src/b.txt", "moved/archive-hardlink-src/c.txt")
+}
+
 func (s *ArchiveTestSuite) TestDelete() {
 	err := s.arch.AddRecursive("../", "../main.go", nil)
 	s.Assert().NoError(err)
@@ -243,7 +730,7 @@ func (s *ArchiveTestSuite) TestCompact() {
 	err = s.arch.Delete(nil, "archive")
 	s.Assert().NoError(err)
 
-	err = s.arch.Compact()
+	err = s.arch.Compact(false)
 	s.Assert().NoError(err)
 
 	wg := sync.WaitGroup{}
@@ -273,6 +760,1010 @@ func (s *ArchiveTestSuite) TestCompact() {
 	wg.Wait()
 }
 
+func (s *ArchiveTestSuite) TestCompactMode() {
+	err := s.arch.AddRecursive("../", "../item", nil)
+	s.Require().NoError(err)
+	s.Require().NoError(s.arch.Delete(nil, "item/*_test.go"))
+
+	s.Require().NoError(os.Chmod(s.config.Path, 0600))
+	owner := os.Geteuid() == 0
+	if owner {
+		s.Require().NoError(os.Chown(s.config.Path, 1, 1))
+	}
+
+	s.Require().NoError(s.arch.Compact(false))
+
+	stat, err := os.Stat(s.config.Path)
+	s.Require().NoError(err)
+	s.Assert().Equal(os.FileMode(0600), stat.Mode().Perm())
+	if owner {
+		uid, gid, ok := ownerOf(stat)
+		s.Require().True(ok)
+		s.Assert().Equal(1, uid)
+		s.Assert().Equal(1, gid)
+	}
+}
+
+func (s *ArchiveTestSuite) TestIndex() {
+	err := s.arch.AddRecursive("../", "../archive", nil)
+	s.Assert().NoError(err)
+
+	err = s.arch.Delete(nil, "archive/header.go")
+	s.Assert().NoError(err)
+
+	scanned := s.listPaths()
+
+	s.Assert().NoError(s.arch.Close())
+	s.arch, err = NewArchive(s.config)
+	s.Require().NoError(err)
+
+	s.Assert().True(s.arch.idx.stored)
+	s.Assert().Equal(scanned, s.listPaths())
+
+	err = s.arch.Compact(false)
+	s.Assert().NoError(err)
+
+	s.Assert().NoError(s.arch.Close())
+	s.arch, err = NewArchive(s.config)
+	s.Require().NoError(err)
+
+	s.Assert().True(s.arch.idx.stored)
+	s.Assert().Len(s.arch.idx.items, len(scanned)-1)
+	s.Assert().NotContains(s.listPaths(), "archive/header.go")
+}
+
+func (s *ArchiveTestSuite) TestIndexStale() {
+	err := s.arch.AddRecursive("../", "../archive", nil)
+	s.Assert().NoError(err)
+	s.Assert().NoError(s.arch.Close())
+
+	// Overwrite the magic number of the footer.
+	f, err := os.OpenFile(s.config.Path, os.O_RDWR, 0666)
+	s.Require().NoError(err)
+	stat, err := f.Stat()
+	s.Require().NoError(err)
+	_, err = f.WriteAt([]byte{0, 0, 0, 0}, stat.Size()-indexMagicLength)
+	s.Require().NoError(err)
+	f.Close()
+
+	s.arch, err = NewArchive(s.config)
+	s.Require().NoError(err)
+
+	s.Assert().Contains(s.listPaths(), "archive/header.go")
+
+	// Appending replaces the unreadable index.
+	err = s.arch.Add("../", "../main.go")
+	s.Assert().NoError(err)
+	s.Assert().NoError(s.arch.Close())
+
+	s.arch, err = NewArchive(s.config)
+	s.Require().NoError(err)
+
+	s.Assert().True(s.arch.idx.stored)
+	paths := s.listPaths()
+	s.Assert().Contains(paths, "archive/header.go")
+	s.Assert().Contains(paths, "main.go")
+}
+
+func (s *ArchiveTestSuite) TestVerify() {
+	err := s.arch.AddRecursive("../", "../item", nil)
+	s.Assert().NoError(err)
+
+	report := s.arch.Verify(nil)
+	s.Assert().True(report.OK())
+	s.Assert().NotZero(report.Items)
+
+	// Corrupt the first chunk of a file.
+	var corrupt *item.Item
+	for _, i := range s.arch.idx.items {
+		if i.Header.Path == "item/header.go" {
+			corrupt = i
+		}
+	}
+	s.Require().NotNil(corrupt)
+	_, err = s.arch.file.WriteAt([]byte{0xff, 0xff}, corrupt.Offset+16)
+	s.Require().NoError(err)
+
+	report = s.arch.Verify(nil)
+	s.Assert().False(report.OK())
+	s.Assert().Len(report.Problems, 1)
+	s.Assert().Equal("item/header.go", report.Problems[0].Path)
+	s.Assert().Equal(len(s.arch.idx.items), report.Items)
+}
+
+func (s *ArchiveTestSuite) TestSalvage() {
+	err := s.arch.AddRecursive("../", "../item", nil)
+	s.Assert().NoError(err)
+	total := len(s.arch.idx.items)
+
+	// Corrupt the header of one file and the first chunk of another.
+	for _, i := range s.arch.idx.items {
+		switch i.Header.Path {
+		case "item/header.go":
+			_, err = s.arch.file.WriteAt([]byte{0xff, 0xff}, i.Offset-i.Header.Len()+16)
+		case "item/body.go":
+			_, err = s.arch.file.WriteAt([]byte{0xff, 0xff}, i.Offset+16)
+		}
+		s.Require().NoError(err)
+	}
+
+	path := s.config.Path + ".fixed"
+	defer os.Remove(path)
+
+	report, err := s.arch.Salvage(path, nil)
+	s.Require().NoError(err)
+	s.Assert().False(report.OK())
+	s.Assert().Equal(total-2, report.Items)
+	s.Assert().Len(report.Problems, 2)
+
+	arch, err := NewArchive(&config.Config{Path: path, Password: []byte("foobar")})
+	s.Require().NoError(err)
+	defer arch.Close()
+
+	s.Assert().True(arch.idx.stored)
+	s.Assert().True(arch.Verify(nil).OK())
+
+	paths := map[string]bool{}
+	for _, i := range arch.idx.items {
+		paths[i.Header.Path] = true
+	}
+	s.Assert().Len(paths, total-2)
+	s.Assert().True(paths["item/item.go"])
+	s.Assert().False(paths["item/header.go"])
+	s.Assert().False(paths["item/body.go"])
+}
+
+func (s *ArchiveTestSuite) TestSalvageLargeDamage() {
+	dir, err := ioutil.TempDir("", "supertar")
+	s.Require().NoError(err)
+	defer os.RemoveAll(dir)
+
+	rnd := rand.New(rand.NewSource(1))
+	big := make([]byte, 8*1024*1024)
+	rnd.Read(big)
+	s.Require().NoError(ioutil.WriteFile(filepath.Join(dir, "big"), big, 0644))
+	for _, name := range []string{"a", "big", "b"} {
+		if name != "big" {
+			s.Require().NoError(ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644))
+		}
+		s.Require().NoError(s.arch.Add(dir, filepath.Join(dir, name)))
+	}
+
+	// Overwrite the header and the body of the large file.
+	i := s.arch.idx.items[1]
+	start := i.Offset - i.Header.Len()
+	end := s.arch.skipChunksAt(i, s.arch.idx.end)
+	s.Require().NotZero(end)
+	rnd.Read(big)
+	for pos := start; pos < end; pos += int64(len(big)) {
+		n := end - pos
+		if n > int64(len(big)) {
+			n = int64(len(big))
+		}
+		_, err = s.arch.file.WriteAt(big[:n], pos)
+		s.Require().NoError(err)
+	}
+
+	path := s.config.Path + ".fixed"
+	defer os.Remove(path)
+
+	began := time.Now()
+	report, err := s.arch.Salvage(path, nil)
+	s.Require().NoError(err)
+	s.Assert().True(time.Since(began) < 10*time.Second, time.Since(began).String())
+	s.Assert().Equal(2, report.Items)
+	s.Require().Len(report.Problems, 1)
+	s.Assert().Equal(start, report.Problems[0].Offset)
+}
+
+func (s *ArchiveTestSuite) TestUncommittedTail() {
+	err := s.arch.AddRecursive("../", "../item", nil)
+	s.Assert().NoError(err)
+	paths := s.listPaths()
+
+	stat, err := os.Stat(s.config.Path)
+	s.Require().NoError(err)
+	committed := stat.Size()
+
+	// Simulate a crash while appending an item: the item is written
+	// without a commit record and its last bytes are missing.
+	data := bytes.Repeat([]byte("foo"), 1000)
+	hdr := &item.Header{Path: "crash.txt", Size: int64(len(data)), Chunks: 1, MTime: time.Now(), Mode: 0644}
+	_, err = s.arch.file.Seek(0, io.SeekEnd)
+	s.Require().NoError(err)
+	err = item.NewItem(hdr).Write(s.arch.file, bytes.NewReader(data), s.config)
+	s.Require().NoError(err)
+	s.Require().NoError(s.arch.file.Truncate(committed + hdr.Len() + 10))
+	s.arch.file.Close()
+	s.arch.lock.unlock()
+
+	s.arch, err = NewArchive(s.config)
+	s.Require().NoError(err)
+
+	stat, err = os.Stat(s.config.Path)
+	s.Require().NoError(err)
+	s.Assert().Equal(committed, stat.Size())
+	s.Assert().Equal(paths, s.listPaths())
+
+	err = s.arch.Add("../", "../main.go")
+	s.Assert().NoError(err)
+	s.Assert().Contains(s.listPaths(), "main.go")
+}
+
+// damageSecond stores three committed files without an index, flips a
+// byte in the header of the second one and returns the archive size.
+func (s *ArchiveTestSuite) damageSecond() int64 {
+	dir, err := ioutil.TempDir("", "supertar")
+	s.Require().NoError(err)
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"f1", "f2", "f3"} {
+		s.Require().NoError(ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644))
+		s.Require().NoError(s.arch.Add(dir, filepath.Join(dir, name)))
+	}
+
+	i := s.arch.idx.items[1]
+	buf := make([]byte, 1)
+	pos := i.Offset - i.Header.Len() + 10
+	_, err = s.arch.file.ReadAt(buf, pos)
+	s.Require().NoError(err)
+	buf[0] ^= 0xff
+	_, err = s.arch.file.WriteAt(buf, pos)
+	s.Require().NoError(err)
+
+	stat, err := s.arch.file.Stat()
+	s.Require().NoError(err)
+	s.arch.file.Close()
+	s.arch.lock.unlock()
+	return stat.Size()
+}
+
+func (s *ArchiveTestSuite) TestDamagedBetweenCommits() {
+	size := s.damageSecond()
+
+	// Committed items behind the damage are never truncated.
+	_, err := NewArchive(s.config)
+	s.Assert().Equal(errDamaged, err)
+	stat, err := os.Stat(s.config.Path)
+	s.Require().NoError(err)
+	s.Assert().Equal(size, stat.Size())
+
+	readOnly := *s.config
+	readOnly.ReadOnly = true
+	s.arch, err = NewArchive(&readOnly)
+	s.Require().NoError(err)
+	s.Assert().Nil(s.arch.idx.items)
+	stat, err = os.Stat(s.config.Path)
+	s.Require().NoError(err)
+	s.Assert().Equal(size, stat.Size())
+}
+
+func (s *ArchiveTestSuite) TestVerifyDamaged() {
+	s.damageSecond()
+	second := s.arch.idx.items[1]
+
+	readOnly := *s.config
+	readOnly.ReadOnly = true
+	var err error
+	s.arch, err = NewArchive(&readOnly)
+	s.Require().NoError(err)
+
+	// The items behind the damaged header are verified as well.
+	report := s.arch.Verify(nil)
+	s.Assert().False(report.OK())
+	s.Assert().Equal(2, report.Items)
+	s.Require().Len(report.Problems, 1)
+	s.Assert().Empty(report.Problems[0].Path)
+	s.Assert().Equal(second.Offset-second.Header.Len(), report.Problems[0].Offset)
+}
+
+func (s *ArchiveTestSuite) TestCommitBatch() {
+	start := s.arch.idx.end
+	err := s.arch.AddRecursive("../", "../item", nil)
+	s.Require().NoError(err)
+	s.Require().Nil(s.arch.batch)
+
+	// The items are committed together by a single record at the end.
+	s.Require().Greater(len(s.arch.idx.items), 1)
+	commits := 0
+	for pos := start; pos < s.arch.idx.end; {
+		typ, err := s.arch.readRecordType(pos)
+		s.Require().NoError(err)
+		if typ == recordCommit {
+			commits++
+			pos += commitLength
+			continue
+		}
+		i, err := item.Read(io.NewSectionReader(s.arch.file, pos, s.arch.idx.end-pos), s.config)
+		s.Require().NoError(err)
+		_, err = s.arch.file.Seek(pos+i.Header.Len(), io.SeekStart)
+		s.Require().NoError(err)
+		end, err := s.arch.skipChunks(i.Header.Chunks)
+		s.Require().NoError(err)
+		pos = pos + i.Header.Len()
+		if i.Header.Chunks > 0 {
+			pos = end
+		}
+	}
+	s.Assert().Equal(1, commits)
+	typ, err := s.arch.readRecordType(s.arch.idx.end - commitLength)
+	s.Require().NoError(err)
+	s.Assert().Equal(byte(recordCommit), typ)
+}
+
+func (s *ArchiveTestSuite) TestLegacyWithoutCommit() {
+	path := s.config.Path + ".legacy"
+	defer os.Remove(path)
+
+	// Archives without commit records are never truncated.
+	f, err := os.Create(path)
+	s.Require().NoError(err)
+	_, err = io.Copy(f, io.NewSectionReader(s.arch.file, 0, headerLength))
+	s.Require().NoError(err)
+	data := []byte("foo")
+	hdr := &item.Header{Path: "foo.txt", Size: int64(len(data)), Chunks: 1, MTime: time.Now(), Mode: 0644}
+	err = item.NewItem(hdr).Write(f, bytes.NewReader(data), s.config)
+	s.Require().NoError(err)
+	stat, err := f.Stat()
+	s.Require().NoError(err)
+	f.Close()
+
+	arch, err := NewArchive(&config.Config{Path: path, Password: []byte("foobar")})
+	s.Require().NoError(err)
+	defer arch.Close()
+
+	s.Assert().Len(arch.idx.items, 1)
+	reopened, err := os.Stat(path)
+	s.Require().NoError(err)
+	s.Assert().Equal(stat.Size(), reopened.Size())
+}
+
+func (s *ArchiveTestSuite) listPaths() map[string]bool {
+	paths := map[string]bool{}
+	ch := make(chan *item.Item)
+	go func() {
+		s.Assert().NoError(s.arch.List(ch, ""))
+	}()
+	for i := range ch {
+		paths[i.Header.Path] = i.Header.Deleted == 1
+	}
+	return paths
+}
+
+func (s *ArchiveTestSuite) TestCompactResume() {
+	err := s.arch.AddRecursive("../", "../item", nil)
+	s.Assert().NoError(err)
+	err = s.arch.Delete(nil, "item/header.go")
+	s.Assert().NoError(err)
+
+	paths := s.listPaths()
+	delete(paths, "item/header.go")
+
+	// Simulate a compaction which has been interrupted after copying the
+	// first two items and committing them.
+	tmp, err := s.arch.openCompact(s.config.Path + compactSuffix)
+	s.Require().NoError(err)
+	defer os.Remove(tmp.path)
+	for _, i := range s.arch.idx.items[:2] {
+		_, err = s.arch.file.Seek(i.Offset, io.SeekStart)
+		s.Require().NoError(err)
+		end, err := s.arch.skipChunks(i.Header.Chunks)
+		s.Require().NoError(err)
+		if i.Header.Chunks == 0 {
+			end = i.Offset
+		}
+		s.Require().NoError(tmp.copyItem(s.arch.file, i.Offset-i.Header.Len(), end, i))
+	}
+	s.Require().NoError(tmp.commit())
+	tmp.file.Close()
+
+	err = s.arch.Compact(false)
+	s.Assert().Equal(errCompactInProgress, err)
+
+	err = s.arch.Compact(true)
+	s.Require().NoError(err)
+	s.Assert().Equal(paths, s.listPaths())
+
+	_, err = os.Stat(tmp.path)
+	s.Assert().True(os.IsNotExist(err))
+
+	s.Assert().NoError(s.arch.Close())
+	s.arch, err = NewArchive(s.config)
+	s.Require().NoError(err)
+	s.Assert().True(s.arch.idx.stored)
+	s.Assert().Equal(paths, s.listPaths())
+	s.Assert().True(s.arch.Verify(nil).OK())
+}
+
+func (s *ArchiveTestSuite) TestCompactResumeIncomplete() {
+	err := s.arch.AddRecursive("../", "../item", nil)
+	s.Require().NoError(err)
+	s.Require().NoError(s.arch.Delete(nil, "item/header.go"))
+	paths := s.listPaths()
+	delete(paths, "item/header.go")
+
+	// Simulate a compaction which has been interrupted while copying the
+	// first items, before anything but the header has been committed.
+	tmp, err := s.arch.openCompact(s.config.Path + compactSuffix)
+	s.Require().NoError(err)
+	defer os.Remove(tmp.path)
+	var last int64
+	for _, i := range s.arch.idx.items[:3] {
+		_, err = s.arch.file.Seek(i.Offset, io.SeekStart)
+		s.Require().NoError(err)
+		end, err := s.arch.skipChunks(i.Header.Chunks)
+		s.Require().NoError(err)
+		if i.Header.Chunks == 0 {
+			end = i.Offset
+		}
+		s.Require().NoError(tmp.copyItem(s.arch.file, i.Offset-i.Header.Len(), end, i))
+		last = end - i.Offset
+	}
+	s.Require().True(last > 10)
+	s.Require().NoError(tmp.file.Truncate(tmp.idx.end - 10))
+	tmp.file.Close()
+
+	s.Require().NoError(s.arch.Compact(true))
+	s.Assert().Equal(paths, s.listPaths())
+	s.Assert().True(s.arch.Verify(nil).OK())
+}
+
+func (s *ArchiveTestSuite) TestStream() {
+	c := &config.Config{Password: []byte("foobar"), Compression: true, ChunkSize: 1024 * 1024}
+	buf := bytes.NewBuffer(nil)
+	arch, err := NewStreamWriter(buf, c)
+	s.Require().NoError(err)
+	s.Assert().NoError(arch.AddRecursive("../", "../archive", nil))
+	s.Assert().NoError(arch.Close())
+
+	c = &config.Config{Password: []byte("foobar")}
+	arch, err = NewStreamReader(bytes.NewReader(buf.Bytes()), c)
+	s.Require().NoError(err)
+	ch := make(chan *item.Item)
+	go func() {
+		s.Assert().NoError(arch.List(ch, "*/stream.go"))
+	}()
+	var paths []string
+	for i := range ch {
+		paths = append(paths, i.Header.Path)
+		s.Assert().Len(i.Header.Checksum, item.ChecksumLength)
+	}
+	s.Assert().Equal([]string{"archive/stream.go"}, paths)
+
+	path := filepath.Join(s.tmpDir, "archive-stream-test")
+	defer os.RemoveAll(path)
+	arch, err = NewStreamReader(bytes.NewReader(buf.Bytes()), c)
+	s.Require().NoError(err)
+	ch = make(chan *item.Item)
+	go func() {
+		for range ch {
+		}
+	}()
+	s.Assert().NoError(arch.Extract(ch, path))
+
+	data, err := ioutil.ReadFile(filepath.Join(path, "archive", "stream.go"))
+	s.Assert().NoError(err)
+	orig, err := ioutil.ReadFile("stream.go")
+	s.Assert().NoError(err)
+	s.Assert().Equal(orig, data)
+
+	// A stored stream is a regular archive with an index.
+	s.arch.Close()
+	s.Require().NoError(ioutil.WriteFile(s.config.Path, buf.Bytes(), 0666))
+	s.arch, err = NewArchive(s.config)
+	s.Require().NoError(err)
+	s.Assert().True(s.arch.idx.stored)
+	s.Assert().Contains(s.listPaths(), "archive/stream.go")
+}
+
+func (s *ArchiveTestSuite) TestDict() {
+	s.arch.Close()
+	os.Remove(s.config.Path)
+
+	samples, err := SampleFiles([]string{"../item"})
+	s.Require().NoError(err)
+	dict, err := compress.TrainDict(samples, 16*1024)
+	s.Require().NoError(err)
+
+	c := *s.config
+	c.Codec = compress.Gzip
+	c.Dict = dict
+	_, err = NewArchive(&c)
+	s.Assert().Equal(errDictCodec, err)
+	os.Remove(s.config.Path)
+
+	c.Codec = compress.Zstd
+	arch, err := NewArchive(&c)
+	s.Require().NoError(err)
+	s.Require().NoError(arch.AddRecursive("../", "../item", nil))
+	s.Require().NoError(arch.Delete(nil, "item/body.go"))
+	s.Require().NoError(arch.Close())
+
+	c = config.Config{Path: s.config.Path, Password: s.config.Password}
+	s.arch, err = NewArchive(&c)
+	s.Require().NoError(err)
+	s.Assert().Equal(dict, c.Dict)
+	s.Assert().True(s.arch.Verify(nil).OK())
+
+	// Compaction keeps the dictionary.
+	s.Require().NoError(s.arch.Compact(false))
+	s.Assert().True(s.arch.Verify(nil).OK())
+	s.Assert().NotContains(s.listPaths(), "item/body.go")
+
+	s.Require().NoError(s.arch.Retrain(8 * 1024))
+	s.Assert().NotEqual(dict, c.Dict)
+	s.Assert().True(s.arch.Verify(nil).OK())
+	s.Require().NoError(s.arch.Close())
+	s.Assert().False(Exists(s.config.Path + retrainSuffix))
+
+	dict = c.Dict
+	c = config.Config{Path: s.config.Path, Password: s.config.Password}
+	s.arch, err = NewArchive(&c)
+	s.Require().NoError(err)
+	s.Assert().Equal(dict, c.Dict)
+	s.Assert().Contains(s.listPaths(), "item/header.go")
+
+	path := filepath.Join(s.tmpDir, "archive-dict-test")
+	defer os.RemoveAll(path)
+	ch := make(chan *item.Item)
+	go func() {
+		for range ch {
+		}
+	}()
+	s.Require().NoError(s.arch.Extract(ch, path))
+	orig, err := ioutil.ReadFile("../item/header.go")
+	s.Assert().NoError(err)
+	data, err := ioutil.ReadFile(filepath.Join(path, "item", "header.go"))
+	s.Assert().NoError(err)
+	s.Assert().Equal(orig, data)
+
+	// Streams store the dictionary in front of the items as well.
+	sc := &config.Config{Password: []byte("foobar"), Compression: true, ChunkSize: 1024 * 1024, Dict: dict}
+	buf := bytes.NewBuffer(nil)
+	stream, err := NewStreamWriter(buf, sc)
+	s.Require().NoError(err)
+	s.Require().NoError(stream.Add("../", "../item/item.go"))
+	s.Require().NoError(stream.Close())
+
+	sc = &config.Config{Password: []byte("foobar")}
+	stream, err = NewStreamReader(bytes.NewReader(buf.Bytes()), sc)
+	s.Require().NoError(err)
+	s.Assert().Equal(dict, sc.Dict)
+	ch = make(chan *item.Item)
+	go func() {
+		for range ch {
+		}
+	}()
+	s.Require().NoError(stream.Extract(ch, path))
+	orig, err = ioutil.ReadFile("../item/item.go")
+	s.Assert().NoError(err)
+	data, err = ioutil.ReadFile(filepath.Join(path, "item", "item.go"))
+	s.Assert().NoError(err)
+	s.Assert().Equal(orig, data)
+}
+
+func (s *ArchiveTestSuite) TestSolid() {
+	s.Require().NoError(s.arch.AddRecursive("../", "../item", nil))
+	s.Require().NoError(s.arch.Close())
+	stat, err := os.Stat(s.config.Path)
+	s.Require().NoError(err)
+	size := stat.Size()
+	os.Remove(s.config.Path)
+
+	c := *s.config
+	c.Solid = true
+	arch, err := NewArchive(&c)
+	s.Require().NoError(err)
+	s.Require().NoError(arch.AddRecursive("../", "../item", nil))
+	s.Require().NoError(arch.Close())
+	stat, err = os.Stat(s.config.Path)
+	s.Require().NoError(err)
+	s.Assert().True(stat.Size() < size)
+
+	c = config.Config{Path: s.config.Path, Password: s.config.Password}
+	s.arch, err = NewArchive(&c)
+	s.Require().NoError(err)
+	s.Assert().True(s.arch.Verify(nil).OK())
+
+	var hdr *item.Item
+	for _, i := range s.arch.idx.items {
+		if i.Header.Path == "item/header.go" {
+			hdr = i
+		}
+	}
+	s.Require().NotNil(hdr)
+	s.Assert().True(hdr.Header.IsSolid())
+	s.Assert().EqualValues(0, hdr.Header.Chunks)
+
+	orig, err := ioutil.ReadFile("../item/header.go")
+	s.Require().NoError(err)
+	buf := bytes.NewBuffer(nil)
+	s.Require().NoError(s.arch.Stream(hdr, buf, 10, 19))
+	s.Assert().Equal(orig[10:20], buf.Bytes())
+
+	// Compaction drops deleted files and keeps the blocks of the others.
+	s.Require().NoError(s.arch.Delete(nil, "item/body.go"))
+	s.Require().NoError(s.arch.Move(nil, "item/item.go", "moved.go"))
+	s.Require().NoError(s.arch.Compact(false))
+	s.Assert().True(s.arch.Verify(nil).OK())
+	paths := s.listPaths()
+	s.Assert().NotContains(paths, "item/body.go")
+	s.Assert().NotContains(paths, "item/item.go")
+	s.Assert().Contains(paths, "moved.go")
+
+	path := filepath.Join(s.tmpDir, "archive-solid-test")
+	defer os.RemoveAll(path)
+	ch := make(chan *item.Item)
+	go func() {
+		for range ch {
+		}
+	}()
+	s.Require().NoError(s.arch.Extract(ch, path))
+	data, err := ioutil.ReadFile(filepath.Join(path, "item", "header.go"))
+	s.Assert().NoError(err)
+	s.Assert().Equal(orig, data)
+	orig, err = ioutil.ReadFile("../item/item.go")
+	s.Require().NoError(err)
+	data, err = ioutil.ReadFile(filepath.Join(path, "moved.go"))
+	s.Assert().NoError(err)
+	s.Assert().Equal(orig, data)
+
+	// Salvaging copies the blocks together with their files.
+	fixed := s.config.Path + ".fixed"
+	defer os.Remove(fixed)
+	report, err := s.arch.Salvage(fixed, nil)
+	s.Require().NoError(err)
+	s.Assert().True(report.OK())
+	s.Assert().Equal(len(s.arch.idx.items), report.Items)
+
+	// Streams keep the last block to extract its files.
+	sc := &config.Config{Password: []byte("foobar"), Compression: true, ChunkSize: 1024 * 1024, Solid: true}
+	out := bytes.NewBuffer(nil)
+	stream, err := NewStreamWriter(out, sc)
+	s.Require().NoError(err)
+	s.Require().NoError(stream.AddRecursive("../", "../item", nil))
+	s.Require().NoError(stream.Close())
+
+	sc = &config.Config{Password: []byte("foobar")}
+	stream, err = NewStreamReader(bytes.NewReader(out.Bytes()), sc)
+	s.Require().NoError(err)
+	ch = make(chan *item.Item)
+	go func() {
+		for range ch {
+		}
+	}()
+	s.Require().NoError(stream.Extract(ch, path))
+	data, err = ioutil.ReadFile(filepath.Join(path, "item", "item.go"))
+	s.Assert().NoError(err)
+	s.Assert().Equal(orig, data)
+}
+
+func (s *ArchiveTestSuite) TestUpgrade() {
+	s.arch.Close()
+	os.Remove(s.config.Path)
+
+	src := filepath.Join(s.tmpDir, "archive-upgrade-src")
+	s.Require().NoError(os.MkdirAll(src, 0755))
+	defer os.RemoveAll(src)
+	big := bytes.Repeat([]byte("supertar"), 40*1024)
+	s.Require().NoError(ioutil.WriteFile(filepath.Join(src, "big.bin"), big, 0644))
+
+	c := *s.config
+	c.Version = item.Version1
+	c.Solid = true
+	arch, err := NewArchive(&c)
+	s.Require().NoError(err)
+	s.Require().NoError(arch.AddRecursive("../", "../item", nil))
+	s.Require().NoError(arch.AddRecursive(s.tmpDir, src, nil))
+	s.Require().NoError(arch.Delete(nil, "item/body.go"))
+	s.Require().NoError(arch.Close())
+
+	version := func() byte {
+		hdr := make([]byte, headerLength)
+		fh, err := os.Open(s.config.Path)
+		s.Require().NoError(err)
+		defer fh.Close()
+		_, err = io.ReadFull(fh, hdr)
+		s.Require().NoError(err)
+		return hdr[magicNumberLength]
+	}
+	s.Assert().EqualValues(item.Version1, version())
+
+	c = config.Config{Path: s.config.Path, Password: s.config.Password}
+	s.arch, err = NewArchive(&c)
+	s.Require().NoError(err)
+	s.Assert().Equal(item.Version1, c.Version)
+	s.Assert().True(s.arch.Verify(nil).OK())
+
+	s.Require().NoError(s.arch.Upgrade())
+	s.Assert().Equal(item.Version2, c.Version)
+	s.Assert().EqualValues(item.Version2, version())
+	s.Assert().True(s.arch.Verify(nil).OK())
+	s.Assert().NotContains(s.listPaths(), "item/body.go")
+	s.Assert().False(Exists(s.config.Path + upgradeSuffix))
+
+	// Upgrading an archive of the current version does nothing.
+	stat, err := os.Stat(s.config.Path)
+	s.Require().NoError(err)
+	s.Require().NoError(s.arch.Upgrade())
+	s.Require().NoError(s.arch.Close())
+	after, err := os.Stat(s.config.Path)
+	s.Require().NoError(err)
+	s.Assert().Equal(stat.Size(), after.Size())
+
+	c = config.Config{Path: s.config.Path, Password: s.config.Password}
+	s.arch, err = NewArchive(&c)
+	s.Require().NoError(err)
+	s.Assert().Equal(item.Version2, c.Version)
+	s.Assert().True(s.arch.Verify(nil).OK())
+
+	path := filepath.Join(s.tmpDir, "archive-upgrade-test")
+	defer os.RemoveAll(path)
+	ch := make(chan *item.Item)
+	go func() {
+		for range ch {
+		}
+	}()
+	s.Require().NoError(s.arch.Extract(ch, path))
+	orig, err := ioutil.ReadFile("../item/header.go")
+	s.Require().NoError(err)
+	data, err := ioutil.ReadFile(filepath.Join(path, "item", "header.go"))
+	s.Assert().NoError(err)
+	s.Assert().Equal(orig, data)
+	data, err = ioutil.ReadFile(filepath.Join(path, "archive-upgrade-src", "big.bin"))
+	s.Assert().NoError(err)
+	s.Assert().Equal(big, data)
+}
+
+func (s *ArchiveTestSuite) TestOpen() {
+	s.Require().NoError(s.arch.AddRecursive("../", "../item", nil))
+	s.Require().NoError(s.arch.Delete(nil, "item/body.go"))
+
+	orig, err := ioutil.ReadFile("../item/header.go")
+	s.Require().NoError(err)
+	r, err := s.arch.Open("item/header.go")
+	s.Require().NoError(err)
+	s.Assert().EqualValues(len(orig), r.Size())
+	p := make([]byte, 100)
+	_, err = r.ReadAt(p, 1000)
+	s.Assert().NoError(err)
+	s.Assert().Equal(orig[1000:1100], p)
+	_, err = r.Seek(-100, io.SeekEnd)
+	s.Require().NoError(err)
+	data, err := ioutil.ReadAll(r)
+	s.Assert().NoError(err)
+	s.Assert().Equal(orig[len(orig)-100:], data)
+	s.Assert().NoError(r.Close())
+
+	_, err = s.arch.Open("item/body.go")
+	s.Assert().True(os.IsNotExist(err))
+	_, err = s.arch.Open("item")
+	s.Assert().Equal(errNotRegular, err)
+
+	s.arch.Close()
+	os.Remove(s.config.Path)
+
+	c := *s.config
+	c.Solid = true
+	s.arch, err = NewArchive(&c)
+	s.Require().NoError(err)
+	s.Require().NoError(s.arch.AddRecursive("../", "../item", nil))
+
+	r, err = s.arch.Open("item/header.go")
+	s.Require().NoError(err)
+	_, err = r.ReadAt(p, 1000)
+	s.Assert().NoError(err)
+	s.Assert().Equal(orig[1000:1100], p)
+
+	var i *item.Item
+	for _, e := range s.arch.idx.items {
+		if e.Header.Path == "item/header.go" {
+			i = e
+		}
+	}
+	s.Require().NotNil(i)
+	buf := bytes.NewBuffer(nil)
+	s.Require().NoError(s.arch.Stream(i, buf, int64(len(orig)-10), int64(len(orig)+10)))
+	s.Assert().Equal(orig[len(orig)-10:], buf.Bytes())
+}
+
+func (s *ArchiveTestSuite) TestOpenCache() {
+	s.arch.Close()
+	os.Remove(s.config.Path)
+
+	c := *s.config
+	c.ChunkSize = 1024
+	var err error
+	s.arch, err = NewArchive(&c)
+	s.Require().NoError(err)
+	s.Require().NoError(s.arch.AddRecursive("../", "../item", nil))
+
+	orig, err := ioutil.ReadFile("../item/header.go")
+	s.Require().NoError(err)
+	read := func(path string) []byte {
+		r, err := s.arch.Open(path)
+		s.Require().NoError(err)
+		defer r.Close()
+		data, err := ioutil.ReadAll(r)
+		s.Require().NoError(err)
+		return data
+	}
+
+	// The chunk offsets are read once and reused by every reader.
+	s.Assert().Equal(orig, read("item/header.go"))
+	s.Require().Len(s.arch.chunks.offsets, 1)
+	for _, offsets := range s.arch.chunks.offsets {
+		s.Assert().Len(offsets, (len(orig)+c.ChunkSize-1)/c.ChunkSize)
+	}
+	s.Assert().Equal(orig, read("item/header.go"))
+	s.Assert().Len(s.arch.chunks.offsets, 1)
+
+	// Items appended after the first lookup are found by their path.
+	dir, err := ioutil.TempDir("", "supertar")
+	s.Require().NoError(err)
+	defer os.RemoveAll(dir)
+	s.Require().NoError(os.Mkdir(filepath.Join(dir, "item"), os.ModePerm))
+	s.Require().NoError(ioutil.WriteFile(filepath.Join(dir, "item", "header.go"), []byte("eekeek"), 0644))
+	s.Require().NoError(s.arch.Add(dir, filepath.Join(dir, "item", "header.go")))
+	s.Assert().Equal([]byte("eekeek"), read("item/header.go"))
+
+	// A compaction moves the items, so their offsets are read again.
+	s.Require().NoError(s.arch.Delete(nil, "item/*_test.go"))
+	s.Require().NoError(s.arch.Compact(false))
+	s.Assert().Empty(s.arch.chunks.offsets)
+	orig, err = ioutil.ReadFile("../item/body.go")
+	s.Require().NoError(err)
+	s.Assert().Equal(orig, read("item/body.go"))
+}
+
+func (s *ArchiveTestSuite) TestVolumes() {
+	s.arch.Close()
+	os.Remove(s.config.Path)
+	defer func() {
+		for n := 1; os.Remove(volumePath(s.config.Path, n)) == nil; n++ {
+		}
+		s.config.VolumeSize = 0
+		s.arch, _ = NewArchive(s.config)
+	}()
+
+	c := *s.config
+	c.VolumeSize = 64 * 1024
+	c.Compression = false
+	arch, err := NewArchive(&c)
+	s.Require().NoError(err)
+	s.Require().NoError(arch.AddRecursive("../", "../archive", nil))
+	s.Require().NoError(arch.Close())
+
+	_, err = os.Stat(s.config.Path)
+	s.Assert().True(os.IsNotExist(err))
+	volumes := 0
+	for n := 1; ; n++ {
+		stat, err := os.Stat(volumePath(s.config.Path, n))
+		if err != nil {
+			break
+		}
+		s.Assert().True(stat.Size() <= c.VolumeSize)
+		volumes++
+	}
+	s.Assert().True(volumes > 1)
+
+	// The volume size is taken from the first volume.
+	s.arch, err = NewArchive(s.config)
+	s.Require().NoError(err)
+	s.Assert().Equal(c.VolumeSize, s.arch.file.(*volumeSet).size)
+	paths := s.listPaths()
+	s.Assert().Contains(paths, "archive/volume.go")
+
+	path := filepath.Join(s.tmpDir, "archive-volume-test")
+	defer os.RemoveAll(path)
+	ch := make(chan *item.Item)
+	go func() {
+		for range ch {
+		}
+	}()
+	s.Require().NoError(s.arch.Extract(ch, path))
+	data, err := ioutil.ReadFile(filepath.Join(path, "archive", "volume.go"))
+	s.Assert().NoError(err)
+	orig, err := ioutil.ReadFile("volume.go")
+	s.Assert().NoError(err)
+	s.Assert().Equal(orig, data)
+
+	// The volumes of the compacted set keep their permissions.
+	for n := 1; n <= volumes; n++ {
+		s.Require().NoError(os.Chmod(volumePath(s.config.Path, n), 0600))
+	}
+	s.Require().NoError(s.arch.Delete(nil, "archive/*.go"))
+	s.Require().NoError(s.arch.Compact(false))
+	s.Require().NoError(s.arch.Close())
+	for n := 1; Exists(volumePath(s.config.Path, n)); n++ {
+		stat, err := os.Stat(volumePath(s.config.Path, n))
+		s.Require().NoError(err)
+		s.Assert().Equal(os.FileMode(0600), stat.Mode().Perm())
+	}
+
+	s.arch, err = NewArchive(s.config)
+	s.Require().NoError(err)
+	s.Assert().True(s.arch.idx.stored)
+	s.Assert().NotContains(s.listPaths(), "archive/volume.go")
+	s.Assert().True(len(s.arch.file.(*volumeSet).files) < volumes)
+	s.Assert().False(Exists(s.config.Path + compactSuffix))
+	s.Require().NoError(s.arch.Close())
+}
+
+func (s *ArchiveTestSuite) TestVolumeSizeStored() {
+	s.arch.Close()
+	os.Remove(s.config.Path)
+	defer func() {
+		for n := 1; os.Remove(volumePath(s.config.Path, n)) == nil; n++ {
+		}
+		s.config.VolumeSize = 0
+		s.arch, _ = NewArchive(s.config)
+	}()
+
+	// A single file cannot be split into volumes.
+	c := *s.config
+	c.VolumeSize = 64 * 1024
+	s.Require().NoError(ioutil.WriteFile(s.config.Path, nil, 0666))
+	_, err := NewArchive(&c)
+	s.Assert().Equal(errNoVolumeSet, err)
+	s.Require().NoError(os.Remove(s.config.Path))
+
+	c.Compression = false
+	arch, err := NewArchive(&c)
+	s.Require().NoError(err)
+	s.Require().NoError(arch.Add("", "archive.go"))
+	s.Require().NoError(arch.Close())
+	s.Require().False(Exists(volumePath(s.config.Path, 2)))
+
+	// The volume size of a set with a single volume is read from the
+	// archive.
+	c = *s.config
+	arch, err = NewArchive(&c)
+	s.Require().NoError(err)
+	s.Assert().Equal(int64(64*1024), c.VolumeSize)
+	s.Require().NoError(arch.AddRecursive("../", "../archive", nil))
+	s.Require().NoError(arch.Close())
+	s.Require().True(Exists(volumePath(s.config.Path, 2)))
+	for n := 1; Exists(volumePath(s.config.Path, n)); n++ {
+		stat, err := os.Stat(volumePath(s.config.Path, n))
+		s.Require().NoError(err)
+		s.Assert().True(stat.Size() <= 64*1024)
+	}
+
+	s.arch, err = NewArchive(s.config)
+	s.Require().NoError(err)
+	s.Assert().Contains(s.listPaths(), "archive/volume.go")
+	s.Assert().True(s.arch.Verify(nil).OK())
+	s.Require().NoError(s.arch.Close())
+}
+
+func (s *ArchiveTestSuite) TestFinishRename() {
+	dir, err := ioutil.TempDir("", "supertar")
+	s.Require().NoError(err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "foo.star")
+	tmp := path + compactSuffix
+	for n := 1; n <= 3; n++ {
+		s.Require().NoError(ioutil.WriteFile(volumePath(path, n), []byte("old"), 0666))
+		s.Require().NoError(ioutil.WriteFile(volumePath(tmp, n), []byte("new"), 0666))
+	}
+
+	// The replacement has not begun yet.
+	s.Require().NoError(finishRename(tmp, path))
+	s.Assert().True(Exists(tmp))
+
+	s.Require().NoError(os.Rename(volumePath(tmp, 1), volumePath(path, 1)))
+	s.Require().NoError(os.Rename(volumePath(tmp, 2), volumePath(path, 2)))
+	s.Require().NoError(finishRename(tmp, path))
+	for n := 1; n <= 3; n++ {
+		data, err := ioutil.ReadFile(volumePath(path, n))
+		s.Assert().NoError(err)
+		s.Assert().Equal("new", string(data))
+	}
+	_, err = os.Stat(volumePath(tmp, 3))
+	s.Assert().True(os.IsNotExist(err))
+}
+
 func (s *ArchiveTestSuite) TestInvalidPaths() {
 	err := s.arch.Add("/tmp/", s.config.Path)
 	s.Assert().NoError(err)
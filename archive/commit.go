@@ -0,0 +1,142 @@
+package archive
+
+import (
+	"bytes"
+	"errors"
+	"io"
+
+	"github.com/marcboeker/supertar/crypto"
+)
+
+const (
+	recordMarkerLength = 2
+	recordTypeLength   = 1
+	recordHeaderLength = recordMarkerLength + recordTypeLength
+
+	recordIndex  = 1
+	recordCommit = 2
+
+	commitLength = recordHeaderLength + crypto.Overhead
+
+	// commitBatchItems and commitBatchSize limit the number and the size
+	// of the items, which are appended before a batch is committed.
+	commitBatchItems = 1024
+	commitBatchSize  = 64 * 1024 * 1024
+)
+
+// Special records are stored between the items and start with an empty
+// header length followed by the record type, so that they cannot be
+// confused with an item header.
+//
+// A commit record marks all items in front of it as complete. It only
+// consists of the record header and an authentication tag over it.
+// Every append is followed by a commit record, so that an append, which
+// has been interrupted by a crash, is detected and removed when the
+// archive is opened again. The appends of AddRecursive are committed in
+// batches, as syncing every small file is slow.
+//
+// Archives without any commit record have been written before commit
+// records were introduced and are never truncated.
+
+// readRecordType returns the type of the special record at pos or 0 if
+// an item header is stored at pos.
+func (a Archive) readRecordType(pos int64) (byte, error) {
+	buf := make([]byte, recordHeaderLength)
+	if n, err := a.file.ReadAt(buf, pos); n < recordHeaderLength {
+		if err == io.EOF {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return recordType(buf), nil
+}
+
+// recordType returns the type of the special record starting with the
+// given record header or 0 if it is the start of an item header.
+func recordType(buf []byte) byte {
+	if !bytes.Equal(buf[:recordMarkerLength], make([]byte, recordMarkerLength)) {
+		return 0
+	}
+	return buf[recordMarkerLength]
+}
+
+// readCommit checks the commit record at pos and returns its length.
+func (a Archive) readCommit(pos int64) (int64, error) {
+	buf := make([]byte, commitLength)
+	if _, err := a.file.ReadAt(buf, pos); err != nil {
+		return 0, err
+	}
+	if err := a.checkCommit(buf); err != nil {
+		return 0, err
+	}
+	return int64(len(buf)), nil
+}
+
+// checkCommit authenticates the given commit record.
+func (a Archive) checkCommit(buf []byte) error {
+	if _, err := a.config.Crypto.OpenBytes(buf[recordHeaderLength:], buf[:recordHeaderLength]); err != nil {
+		return errInvalidCommit
+	}
+	return nil
+}
+
+// commitBatch collects appended items, which are committed together.
+type commitBatch struct {
+	items int   // number of uncommitted items
+	start int64 // end of the last commit
+}
+
+// commitAppend commits an append. While a batch is collected, the append
+// is only committed once the batch is full.
+func (a Archive) commitAppend() error {
+	if a.batch == nil {
+		return a.commit()
+	}
+	a.batch.items++
+	if a.batch.items < commitBatchItems && a.idx.end-a.batch.start < commitBatchSize {
+		return nil
+	}
+	return a.commitBatch()
+}
+
+// commitBatch commits the items of the batch, if there are any.
+func (a Archive) commitBatch() error {
+	if a.batch.items == 0 {
+		return nil
+	}
+	if err := a.commit(); err != nil {
+		return err
+	}
+	*a.batch = commitBatch{start: a.idx.end}
+	return nil
+}
+
+// commit syncs all items written so far, appends a commit record and
+// syncs it. The items are synced first, so that a commit record never
+// refers to data which is not on disk. A stream is flushed instead.
+func (a Archive) commit() error {
+	hdr := []byte{0, 0, recordCommit}
+	rec := append(hdr, a.config.Crypto.SealBytes(nil, hdr)...)
+	if a.out != nil {
+		if _, err := a.out.Write(rec); err != nil {
+			return err
+		}
+		a.idx.end = a.out.n
+		return a.out.w.Flush()
+	}
+
+	if err := a.file.Sync(); err != nil {
+		return err
+	}
+	if _, err := a.file.WriteAt(rec, a.idx.end); err != nil {
+		return err
+	}
+	a.idx.end += int64(len(rec))
+
+	return a.file.Sync()
+}
+
+var (
+	errInvalidCommit = errors.New("commit record is invalid")
+	errUnknownRecord = errors.New("unknown record type")
+)
@@ -0,0 +1,48 @@
+package archive
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/marcboeker/supertar/item"
+	"golang.org/x/sys/unix"
+)
+
+// deviceOf returns the major and minor number of the given device.
+func deviceOf(stat os.FileInfo) (uint32, uint32) {
+	st, ok := stat.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0
+	}
+	return unix.Major(uint64(st.Rdev)), unix.Minor(uint64(st.Rdev))
+}
+
+// extractSpecial creates the FIFO or device of the given item at path.
+// Devices can only be created by root and are skipped otherwise. It
+// reports whether the item has been created.
+func extractSpecial(path string, hdr *item.Header) (bool, error) {
+	if hdr.Type() != item.ModeFIFO && os.Geteuid() != 0 {
+		return false, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return false, err
+	}
+	if _, err := os.Lstat(path); err == nil {
+		if err := os.Remove(path); err != nil {
+			return false, err
+		}
+	}
+
+	mode := uint32(hdr.Mode.Perm())
+	switch hdr.Type() {
+	case item.ModeFIFO:
+		return true, unix.Mkfifo(path, mode)
+	case item.ModeCharDevice:
+		mode |= unix.S_IFCHR
+	default:
+		mode |= unix.S_IFBLK
+	}
+	return true, unix.Mknod(path, mode, int(unix.Mkdev(hdr.DevMajor, hdr.DevMinor)))
+}
@@ -0,0 +1,67 @@
+package archive
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/marcboeker/supertar/item"
+	"golang.org/x/sys/unix"
+)
+
+func (s *ArchiveTestSuite) TestFIFO() {
+	src := filepath.Join(s.tmpDir, "archive-fifo-src")
+	s.Require().NoError(os.MkdirAll(src, os.ModePerm))
+	defer os.RemoveAll(src)
+
+	s.Require().NoError(unix.Mkfifo(filepath.Join(src, "pipe"), 0644))
+
+	err := s.arch.AddRecursive(s.tmpDir, src, nil)
+	s.Assert().NoError(err)
+
+	path := filepath.Join(s.tmpDir, "archive-fifo-test")
+	defer os.RemoveAll(path)
+
+	ch := make(chan *item.Item)
+	go func() {
+		for range ch {
+		}
+	}()
+
+	err = s.arch.Extract(ch, path)
+	s.Assert().NoError(err)
+
+	stat, err := os.Lstat(filepath.Join(path, "archive-fifo-src", "pipe"))
+	s.Require().NoError(err)
+	s.Assert().True(stat.Mode()&os.ModeNamedPipe != 0)
+}
+
+func (s *ArchiveTestSuite) TestSkipSpecial() {
+	src := filepath.Join(s.tmpDir, "archive-skip-src")
+	s.Require().NoError(os.MkdirAll(src, os.ModePerm))
+	defer os.RemoveAll(src)
+
+	s.Require().NoError(unix.Mkfifo(filepath.Join(src, "pipe"), 0644))
+
+	s.config.SkipSpecial = true
+	err := s.arch.AddRecursive(s.tmpDir, src, nil)
+	s.Assert().NoError(err)
+
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+
+	var paths []string
+	ch := make(chan *item.Item)
+	go func() {
+		for i := range ch {
+			paths = append(paths, i.Header.Path)
+		}
+		wg.Done()
+	}()
+
+	err = s.arch.List(ch, "")
+	s.Assert().NoError(err)
+	wg.Wait()
+
+	s.Assert().Equal([]string{"archive-skip-src"}, paths)
+}
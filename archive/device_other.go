@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package archive
+
+import (
+	"os"
+
+	"github.com/marcboeker/supertar/item"
+)
+
+// deviceOf is only supported on Linux.
+func deviceOf(stat os.FileInfo) (uint32, uint32) {
+	return 0, 0
+}
+
+// extractSpecial is only supported on Linux, so FIFOs and devices are
+// skipped on other platforms.
+func extractSpecial(path string, hdr *item.Header) (bool, error) {
+	return false, nil
+}
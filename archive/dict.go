@@ -0,0 +1,327 @@
+package archive
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+
+	"github.com/marcboeker/supertar/compress"
+	"github.com/marcboeker/supertar/config"
+	"github.com/marcboeker/supertar/crypto"
+	"github.com/marcboeker/supertar/item"
+)
+
+const (
+	recordDictionary = 3
+
+	dictLengthLength = 4
+	dictHeaderLength = recordHeaderLength + dictLengthLength
+	maxDictLength    = 2 * 1024 * 1024
+
+	// DefaultDictSize is the default size of a trained dictionary.
+	DefaultDictSize = 112640
+	// dictSamples is the maximum number of files sampled for training.
+	dictSamples = 4096
+	// dictSampleLength is the maximum number of bytes sampled per file.
+	dictSampleLength = 8 * 1024
+
+	retrainSuffix = ".retrain"
+)
+
+// A dictionary record follows the archive header if all chunks are
+// compressed with a Zstandard dictionary. It consists of the record
+// header, the length of the encrypted dictionary (4 bytes) and the
+// dictionary, which is encrypted with the record header and the length as
+// additional data. The items start after the dictionary record.
+
+// encodeDict returns the dictionary record of dict.
+func encodeDict(dict []byte, c *config.Config) []byte {
+	hdr := make([]byte, dictHeaderLength)
+	hdr[recordMarkerLength] = recordDictionary
+	binary.LittleEndian.PutUint32(hdr[recordHeaderLength:], uint32(len(dict)+crypto.Overhead))
+
+	return append(hdr, c.Crypto.SealBytes(dict, hdr)...)
+}
+
+// readDict reads the dictionary record from r and returns the dictionary
+// and the length of the record.
+func readDict(r io.Reader, c *config.Config) ([]byte, int64, error) {
+	hdr := make([]byte, dictHeaderLength)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, 0, err
+	}
+	if recordType(hdr) != recordDictionary {
+		return nil, 0, errInvalidDict
+	}
+
+	size := binary.LittleEndian.Uint32(hdr[recordHeaderLength:])
+	if size > maxDictLength {
+		return nil, 0, errInvalidDict
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, 0, err
+	}
+
+	dict, err := c.Crypto.OpenBytes(buf, hdr)
+	if err != nil {
+		return nil, 0, errInvalidDict
+	}
+
+	return dict, int64(len(hdr) + len(buf)), nil
+}
+
+// loadDict reads the dictionary of an existing archive into the config
+// and returns the offset of the first item.
+func (a Archive) loadDict() (int64, error) {
+	a.config.Dict = nil
+
+	typ, err := a.readRecordType(headerLength)
+	if err != nil || typ != recordDictionary {
+		return headerLength, err
+	}
+
+	src := io.NewSectionReader(a.file, headerLength, maxDictLength+dictHeaderLength)
+	dict, n, err := readDict(src, a.config)
+	if err != nil {
+		return 0, err
+	}
+	a.config.Dict = dict
+
+	return headerLength + n, nil
+}
+
+// SampleFiles returns samples of the regular files below the given paths
+// to train a dictionary. Only the beginning of every file is sampled.
+// Files, which cannot be read, are skipped.
+func SampleFiles(paths []string) ([][]byte, error) {
+	var samples [][]byte
+	for _, path := range paths {
+		err := filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
+			if err != nil || !info.Mode().IsRegular() || info.Size() == 0 {
+				return nil
+			}
+			if len(samples) >= dictSamples {
+				return errEnoughSamples
+			}
+
+			fh, err := os.Open(path)
+			if err != nil {
+				return nil
+			}
+			defer fh.Close()
+
+			buf := make([]byte, dictSampleLength)
+			n, err := io.ReadFull(fh, buf)
+			if err != nil && err != io.ErrUnexpectedEOF {
+				return nil
+			}
+			samples = append(samples, buf[:n])
+
+			return nil
+		})
+		if err == errEnoughSamples {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return samples, nil
+}
+
+// sampleItems returns samples of the stored files to train a dictionary.
+// Only the first chunk of every file is decrypted and sampled.
+func (a Archive) sampleItems() ([][]byte, error) {
+	var samples [][]byte
+	err := a.eachItem(func(i *item.Item) error {
+		if len(samples) >= dictSamples || i.Header.Deleted != 0 || i.Header.Type() != item.ModeRegular {
+			return nil
+		}
+		if i.Header.IsSolid() {
+			content, err := a.solidContent(i)
+			if err != nil {
+				return err
+			}
+			if len(content) > dictSampleLength {
+				content = content[:dictSampleLength]
+			}
+			samples = append(samples, append([]byte(nil), content...))
+			return nil
+		}
+		if i.Header.Chunks == 0 {
+			return nil
+		}
+
+		buf := bytes.NewBuffer(nil)
+		src := io.NewSectionReader(a.file, i.Offset, math.MaxInt64-i.Offset)
+		if err := new(item.Body).Extract(src, buf, 1, a.config); err != nil {
+			return err
+		}
+		sample := buf.Bytes()
+		if len(sample) > dictSampleLength {
+			sample = append([]byte(nil), sample[:dictSampleLength]...)
+		}
+		samples = append(samples, sample)
+
+		return nil
+	})
+
+	return samples, err
+}
+
+// Retrain trains a new dictionary of the given size from the stored files
+// and recompresses all items with it. Like a compaction, the items are
+// written to a temporary file next to the archive, which then replaces
+// the archive, and deleted items are dropped. The chunks are only
+// decrypted in memory, so no plaintext is written to disk. Solid items
+// are packed into new blocks. An interrupted retraining is started over.
+func (a *Archive) Retrain(size int) error {
+	if codecOf(a.config) != compress.Zstd {
+		return errDictCodec
+	}
+
+	samples, err := a.sampleItems()
+	if err != nil {
+		return err
+	}
+	dict, err := compress.TrainDict(samples, size)
+	if err != nil {
+		return err
+	}
+
+	c := *a.config
+	c.Dict = dict
+	tmp, err := a.openRewrite(a.path+retrainSuffix, &c)
+	if err != nil {
+		return err
+	}
+	defer tmp.file.Close()
+	tmp.solid = &solidBlock{}
+
+	var uncommitted int64
+	err = a.eachItem(func(i *item.Item) error {
+		if i.Header.Deleted != 0 {
+			return nil
+		}
+
+		hdr := *i.Header
+		if hdr.IsSolid() {
+			content, err := a.solidContent(i)
+			if err != nil {
+				return err
+			}
+			hdr.Block = 0
+			return tmp.addSolid(&hdr, bytes.NewReader(content))
+		}
+		if err := tmp.flushSolid(); err != nil {
+			return err
+		}
+
+		var src io.Reader
+		if hdr.Type() == item.ModeRegular && hdr.Size > 0 {
+			r, w := io.Pipe()
+			defer r.Close()
+			src = r
+			go func() {
+				body := io.NewSectionReader(a.file, i.Offset, math.MaxInt64-i.Offset)
+				w.CloseWithError(new(item.Body).Extract(body, w, hdr.Chunks, a.config))
+			}()
+		}
+
+		pos, err := tmp.file.Seek(tmp.idx.end, io.SeekStart)
+		if err != nil {
+			return err
+		}
+		e := item.NewItem(&hdr)
+		if err := e.Write(tmp.file, src, tmp.config); err != nil {
+			return err
+		}
+
+		if tmp.idx.end, err = tmp.file.Seek(0, io.SeekCurrent); err != nil {
+			return err
+		}
+		e.Offset = pos + hdr.Len()
+		tmp.idx.items = append(tmp.idx.items, e)
+
+		uncommitted += tmp.idx.end - pos
+		if uncommitted >= compactCommitSize {
+			if err := tmp.commit(); err != nil {
+				return err
+			}
+			uncommitted = 0
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := tmp.flushSolid(); err != nil {
+		return err
+	}
+	if err := tmp.commit(); err != nil {
+		return err
+	}
+	if err := tmp.writeIndex(); err != nil {
+		return err
+	}
+	if err := a.replace(tmp); err != nil {
+		return err
+	}
+
+	a.config.Dict = dict
+	a.start = tmp.start
+
+	return nil
+}
+
+// openRewrite creates the temporary file of a retraining or an upgrade,
+// which starts with the header of the archive and the dictionary of the
+// given config. The version in the header is taken from the config. A
+// stale file of an interrupted rewrite is overwritten.
+func (a Archive) openRewrite(path string, c *config.Config) (*Archive, error) {
+	fh, err := a.openTemp(path)
+	if err != nil {
+		return nil, err
+	}
+
+	tmp := &Archive{path: path, file: fh, header: a.header, config: c, idx: &index{items: []*item.Item{}}}
+
+	hdr := make([]byte, headerLength)
+	if _, err := a.file.ReadAt(hdr, 0); err != nil {
+		fh.Close()
+		return nil, err
+	}
+	hdr[magicNumberLength] = byte(c.Version)
+	if c.Dict != nil {
+		hdr = append(hdr, encodeDict(c.Dict, c)...)
+	}
+	if vs, ok := a.file.(*volumeSet); ok {
+		hdr = append(hdr, encodeVolume(vs.size, c)...)
+	}
+	if err := fh.Truncate(0); err != nil {
+		fh.Close()
+		return nil, err
+	}
+	if _, err := fh.WriteAt(hdr, 0); err != nil {
+		fh.Close()
+		return nil, err
+	}
+	tmp.start = int64(len(hdr))
+	tmp.idx.end = tmp.start
+
+	return tmp, nil
+}
+
+var (
+	errInvalidDict   = errors.New("dictionary record is invalid")
+	errDictCodec     = errors.New("dictionaries require the zstd codec")
+	errEnoughSamples = errors.New("enough samples")
+)
@@ -0,0 +1,98 @@
+package archive
+
+import (
+	"hash/fnv"
+	"io"
+	"sync"
+
+	"github.com/marcboeker/supertar/item"
+)
+
+// extractQueueLength is the number of files queued per worker, so that
+// the reader does not block on a worker extracting a large file.
+const extractQueueLength = 64
+
+// extractJob is a file to extract from its body.
+type extractJob struct {
+	src  io.Reader
+	path string
+	item *item.Item
+}
+
+// extractWorkers extracts files in parallel. Every path is assigned to a
+// single worker, so that files with the same path are extracted in order.
+type extractWorkers struct {
+	queues []chan extractJob
+	wg     sync.WaitGroup
+	mu     sync.Mutex
+	err    error
+}
+
+// newExtractWorkers starts the given number of workers extracting files
+// of the archive. nil is returned for a single thread.
+func newExtractWorkers(a Archive, threads int) *extractWorkers {
+	if threads <= 1 {
+		return nil
+	}
+
+	w := &extractWorkers{queues: make([]chan extractJob, threads)}
+	for n := range w.queues {
+		q := make(chan extractJob, extractQueueLength)
+		w.queues[n] = q
+
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			for j := range q {
+				if w.failed() != nil {
+					continue
+				}
+				if err := a.extractFile(j.src, j.path, j.item); err != nil {
+					w.mu.Lock()
+					if w.err == nil {
+						w.err = err
+					}
+					w.mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	return w
+}
+
+// extract queues the file i, whose body is read from src, for extraction
+// to path. The error of a failed extraction is returned to stop reading.
+func (w *extractWorkers) extract(src io.Reader, path string, i *item.Item) error {
+	if err := w.failed(); err != nil {
+		return err
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(path))
+	w.queues[int(h.Sum32()%uint32(len(w.queues)))] <- extractJob{src: src, path: path, item: i}
+
+	return nil
+}
+
+// failed returns the first error of a worker.
+func (w *extractWorkers) failed() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// wait waits until all queued files have been extracted and returns the
+// first error.
+func (w *extractWorkers) wait() error {
+	if w == nil {
+		return nil
+	}
+
+	for _, q := range w.queues {
+		close(q)
+	}
+	w.wg.Wait()
+
+	return w.err
+}
@@ -0,0 +1,138 @@
+package archive
+
+import (
+	"io"
+
+	"github.com/marcboeker/supertar/item"
+)
+
+// Hard links are stored as link items without a body, which refer to the
+// path of the first link stored, the target. A target must not be removed
+// while links to it are left. If a target is deleted, the first of its
+// links takes over the content and the other links are linked to it. If
+// a target is moved, its links are linked to the new path.
+
+// linkGroup is a target together with the hard links to it.
+type linkGroup struct {
+	target *item.Item
+	links  []*item.Item
+}
+
+// linksTo returns the hard links to the given targets, which are not
+// deleted and not in skip. A link refers to the last regular item stored
+// in front of it at its link path. The groups are in the order of the
+// archive. Items are identified by their offset.
+func (a Archive) linksTo(targets []*item.Item, skip map[int64]bool) ([]*linkGroup, error) {
+	isTarget := map[int64]bool{}
+	for _, i := range targets {
+		isTarget[i.Offset] = true
+	}
+
+	var groups []*linkGroup
+	byPath := map[string]*linkGroup{}
+	err := a.eachItem(func(i *item.Item) error {
+		switch {
+		case i.Header.Type() == item.ModeRegular && isTarget[i.Offset]:
+			byPath[i.Header.Path] = &linkGroup{target: i}
+		case i.Header.Type() == item.ModeRegular && i.Header.Deleted == 0:
+			delete(byPath, i.Header.Path)
+		case i.Header.Type() == item.ModeHardlink && i.Header.Deleted == 0 && !skip[i.Offset]:
+			g, ok := byPath[i.Header.Link]
+			if !ok {
+				return nil
+			}
+			if len(g.links) == 0 {
+				groups = append(groups, g)
+			}
+			g.links = append(g.links, i)
+		}
+		return nil
+	})
+
+	return groups, err
+}
+
+// keepLinks keeps the hard links to the given targets, which are about
+// to be deleted. The first link of every target is appended as a copy of
+// the target and the other links are appended linking to it. The
+// replaced links are marked as deleted after the appended items have been
+// committed. The index is invalidated if any item has been appended.
+func (a Archive) keepLinks(targets []*item.Item, skip map[int64]bool) error {
+	groups, err := a.linksTo(targets, skip)
+	if err != nil || len(groups) == 0 {
+		return err
+	}
+
+	if err := a.beginWrite(); err != nil {
+		return err
+	}
+	defer a.invalidateIndex()
+
+	w := &offsetWriter{w: a.file, off: a.idx.end}
+	var replaced []*item.Item
+	for _, g := range groups {
+		first := g.links[0]
+		hdr := *g.target.Header
+		hdr.Path = first.Header.Path
+		hdr.Deleted = 0
+		if err := a.appendCopy(w, hdr, g.target); err != nil {
+			return err
+		}
+
+		for _, l := range g.links[1:] {
+			hdr := *l.Header
+			hdr.Link = first.Header.Path
+			if err := a.appendCopy(w, hdr, l); err != nil {
+				return err
+			}
+		}
+		replaced = append(replaced, g.links...)
+	}
+
+	a.idx.end = w.off
+	if err := a.commit(); err != nil {
+		return err
+	}
+
+	return a.markDeleted(replaced)
+}
+
+// appendCopy appends the header hdr followed by a copy of the body of the
+// item i to w. A solid header is adjusted to refer to the block of i.
+func (a Archive) appendCopy(w *offsetWriter, hdr item.Header, i *item.Item) error {
+	end := i.Offset
+	if i.Header.Type() == item.ModeRegular && i.Header.Chunks > 0 {
+		if _, err := a.file.Seek(i.Offset, io.SeekStart); err != nil {
+			return err
+		}
+		var err error
+		if end, err = a.skipChunks(i.Header.Chunks); err != nil {
+			return err
+		}
+	}
+
+	if hdr.IsSolid() {
+		hdr.Block = w.off - blockOf(i)
+	}
+	if err := hdr.Write(w, a.config); err != nil {
+		return err
+	}
+
+	_, err := io.Copy(w, io.NewSectionReader(a.file, i.Offset, end-i.Offset))
+	return err
+}
+
+// markDeleted marks the given items as deleted.
+func (a Archive) markDeleted(items []*item.Item) error {
+	for _, i := range items {
+		if _, err := a.file.Seek(i.Offset-i.Header.Len(), io.SeekStart); err != nil {
+			return err
+		}
+
+		i.Header.Deleted = 1
+		if err := i.Header.Write(a.file, a.config); err != nil {
+			return err
+		}
+	}
+	return nil
+}
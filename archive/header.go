@@ -5,6 +5,9 @@ import (
 	"encoding/binary"
 	"errors"
 	"io"
+
+	"github.com/marcboeker/supertar/compress"
+	"github.com/marcboeker/supertar/item"
 )
 
 const (
@@ -20,9 +23,17 @@ const (
 	headerLength = magicNumberLength + versionLength + compressionLength + chunkSizeLength + kdfSaltLength + keyNonceLength + keyLength + tagLength
 
 	compressionDisabled = 0
-	compressionEnabled  = 1
+	compressionEnabled  = byte(compress.Zstd)
+
+	// The compression byte holds the codec in the lower bits and the
+	// compression level in the upper bits.
+	codecMask  = 0x07
+	levelShift = 3
 
-	supertarVersion = 1
+	// supertarVersion is the version of new archives, which selects the
+	// format of the item headers. Archives of version 0 and 1 contain
+	// item.Version1 headers.
+	supertarVersion = item.Version2
 )
 
 var (
@@ -37,6 +48,9 @@ type Header struct {
 	kdfSalt     []byte // kdfSaltLength
 	KeyNonce    []byte // keyNonceLength
 	Key         []byte // keyLength + tagLength
+
+	codec compress.ID // stored instead of compressionEnabled
+	level int         // stored in the upper bits of the codec
 }
 
 // Write serializes and writes the header to given file handler.
@@ -50,7 +64,12 @@ func (h Header) Write(w io.Writer) error {
 	}
 
 	if h.compression {
-		if _, err := w.Write([]byte{compressionEnabled}); err != nil {
+		codec := byte(h.codec)
+		if h.codec == compress.None {
+			codec = compressionEnabled
+		}
+		codec |= byte(h.level) << levelShift
+		if _, err := w.Write([]byte{codec}); err != nil {
 			return err
 		}
 	} else {
@@ -94,7 +113,9 @@ func (h *Header) Read(r io.Reader) error {
 
 	h.version, _ = buf.ReadByte()
 	compression, _ := buf.ReadByte()
-	h.compression = compression == compressionEnabled
+	h.compression = compression != compressionDisabled
+	h.codec = compress.ID(compression & codecMask)
+	h.level = int(compression >> levelShift)
 	chunkSize := h.readNBytes(buf, chunkSizeLength)
 	h.chunkSize = int(binary.LittleEndian.Uint64(chunkSize))
 	h.kdfSalt = h.readNBytes(buf, kdfSaltLength)
@@ -114,4 +135,5 @@ func (h *Header) readNBytes(r io.Reader, n int) []byte {
 
 var (
 	errInvalidMagicNumber = errors.New("invalid magic number")
+	errUnsupportedVersion = errors.New("archive version is not supported, upgrade supertar")
 )
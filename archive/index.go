@@ -0,0 +1,406 @@
+package archive
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+
+	"github.com/marcboeker/supertar/item"
+)
+
+const (
+	indexOffsetLength = 8
+	indexChunksLength = 8
+	indexMagicLength  = 4
+	indexFooterLength = indexOffsetLength + indexChunksLength + indexMagicLength
+
+	indexEndLength    = 8
+	indexCountLength  = 8
+	entryOffsetLength = 8
+	entryLength       = 4
+)
+
+var (
+	indexMagic = []byte{7, 3, 3, 1}
+)
+
+// index is the encrypted directory of all items, which is stored at the
+// end of the archive. It allows to list an archive without seeking from
+// header to header. The index is removed before the archive is modified
+// and written again on close, so a stored index is never stale.
+//
+// The index starts with a special record header (3 bytes), so that
+// scanning the items stops in front of it. It is followed by chunks
+// (see item.Body) of the following data:
+//
+//	End of the items (8 bytes)
+//	Number of entries (8 bytes)
+//	Entries 0..n
+//	  Offset of the item header (8 bytes)
+//	  Length of the header (4 bytes)
+//	  Header and metadata, see item.Header.MarshalBinary
+//
+// It is followed by a plain footer:
+//
+//	Offset of the index (8 bytes)
+//	Number of chunks (8 bytes)
+//	Magic number (4 bytes)
+type index struct {
+	items     []*item.Item // nil if the archive has to be scanned
+	end       int64        // offset where the items end
+	stored    bool         // whether the index is stored after end
+	dirty     bool         // whether the index has to be written on close
+	committed int64        // end of the last commit record while scanning
+
+	paths     map[string][]*item.Item // items by path, see lookup
+	pathItems int                     // number of items in paths
+}
+
+// loadIndex reads the index from the end of the archive. If the index
+// is missing or cannot be read, the archive is scanned instead.
+func (a Archive) loadIndex() error {
+	stat, err := a.file.Stat()
+	if err != nil {
+		return err
+	}
+	size := stat.Size()
+
+	if size < a.start+indexFooterLength {
+		return a.scanIndex(size)
+	}
+
+	footer := make([]byte, indexFooterLength)
+	if _, err := a.file.ReadAt(footer, size-indexFooterLength); err != nil {
+		return err
+	}
+	if !bytes.Equal(footer[indexOffsetLength+indexChunksLength:], indexMagic) {
+		return a.scanIndex(size)
+	}
+
+	offset := int64(binary.LittleEndian.Uint64(footer))
+	chunks := int64(binary.LittleEndian.Uint64(footer[indexOffsetLength:]))
+	if offset < a.start || offset+recordHeaderLength > size-indexFooterLength {
+		return a.scanIndex(size)
+	}
+	if typ, err := a.readRecordType(offset); err != nil || typ != recordIndex {
+		return a.scanIndex(size)
+	}
+
+	start := offset + recordHeaderLength
+	src := io.NewSectionReader(a.file, start, size-indexFooterLength-start)
+	buf := bytes.NewBuffer(nil)
+	if err := new(item.Body).Extract(src, buf, chunks, a.config); err != nil {
+		return a.scanIndex(size)
+	}
+
+	items, err := parseIndex(buf.Bytes(), offset, a.config.Version)
+	if err != nil {
+		return a.scanIndex(size)
+	}
+
+	*a.idx = index{items: items, end: offset, stored: true}
+
+	return nil
+}
+
+// scanIndex rebuilds the index by scanning the archive of the given size.
+// Items after the last commit record are incomplete and are removed. If
+// the archive cannot be scanned otherwise, the items are left unknown, so
+// that the error is reported when they are accessed.
+//
+// A scan error is only caused by an incomplete append if no commit record
+// follows it. Otherwise committed items are hidden behind damaged data, so
+// the archive is never truncated and cannot be opened for writing.
+func (a Archive) scanIndex(size int64) error {
+	*a.idx = index{end: size}
+
+	items, err := a.scanItems()
+	committed := a.idx.committed
+	if err != nil && committed == 0 {
+		return nil
+	}
+	if err != nil {
+		damaged, cerr := a.commitAfter(committed, size)
+		if cerr != nil {
+			return cerr
+		}
+		if damaged {
+			if !a.config.ReadOnly {
+				return errDamaged
+			}
+			*a.idx = index{end: size}
+			return nil
+		}
+	}
+
+	end := a.start
+	if err == nil && len(items) > 0 {
+		last := items[len(items)-1]
+		if end, err = a.file.Seek(last.Offset, io.SeekStart); err != nil {
+			return err
+		}
+		if last.Header.Chunks > 0 {
+			if end, err = a.skipChunks(last.Header.Chunks); err != nil {
+				return err
+			}
+		}
+	}
+
+	if committed > 0 && (err != nil || end > committed) {
+		for len(items) > 0 && items[len(items)-1].Offset > committed {
+			items = items[:len(items)-1]
+		}
+		// Read-only archives are truncated before the next write.
+		if !a.config.ReadOnly {
+			if err := a.file.Truncate(committed); err != nil {
+				return err
+			}
+			size = committed
+		}
+	}
+	if committed > end {
+		end = committed
+	}
+
+	*a.idx = index{items: items, end: end, stored: end < size}
+
+	return nil
+}
+
+// lookup returns the items stored at path in the order of the archive.
+// The items are mapped by path on first use. Later calls only add the
+// items, which have been appended since.
+func (x *index) lookup(path string) []*item.Item {
+	if x.paths == nil || x.pathItems > len(x.items) {
+		x.paths, x.pathItems = map[string][]*item.Item{}, 0
+	}
+	for _, i := range x.items[x.pathItems:] {
+		x.paths[i.Header.Path] = append(x.paths[i.Header.Path], i)
+	}
+	x.pathItems = len(x.items)
+	return x.paths[path]
+}
+
+// commitAfter returns whether a valid commit record is stored between
+// from and end.
+func (a Archive) commitAfter(from, end int64) (bool, error) {
+	marker := []byte{0, 0, recordCommit}
+	buf := make([]byte, 1024*1024)
+	for pos := from; pos+commitLength <= end; {
+		n, err := a.file.ReadAt(buf, pos)
+		if err != nil && err != io.EOF {
+			return false, err
+		}
+		data := buf[:n]
+		for k := 0; ; k++ {
+			m := bytes.Index(data[k:], marker)
+			if m < 0 || k+m+commitLength > len(data) {
+				break
+			}
+			k += m
+			if a.checkCommit(data[k:k+commitLength]) == nil {
+				return true, nil
+			}
+		}
+		if n < len(buf) {
+			break
+		}
+		// The windows overlap, so that no record is cut.
+		pos += int64(n - commitLength + 1)
+	}
+	return false, nil
+}
+
+// parseIndex parses the decrypted index whose items end at end. The
+// headers are of the given version.
+func parseIndex(buf []byte, end int64, version int) ([]*item.Item, error) {
+	if len(buf) < indexEndLength+indexCountLength {
+		return nil, errInvalidIndex
+	}
+	if int64(binary.LittleEndian.Uint64(buf)) != end {
+		return nil, errInvalidIndex
+	}
+	count := binary.LittleEndian.Uint64(buf[indexEndLength:])
+	buf = buf[indexEndLength+indexCountLength:]
+
+	items := make([]*item.Item, 0, count)
+	for n := uint64(0); n < count; n++ {
+		if len(buf) < entryOffsetLength+entryLength {
+			return nil, errInvalidIndex
+		}
+		offset := int64(binary.LittleEndian.Uint64(buf))
+		l := int(binary.LittleEndian.Uint32(buf[entryOffsetLength:]))
+		buf = buf[entryOffsetLength+entryLength:]
+		if len(buf) < l {
+			return nil, errInvalidIndex
+		}
+
+		hdr, err := item.ParseHeader(buf[:l], version)
+		if err != nil {
+			return nil, err
+		}
+		buf = buf[l:]
+
+		i := item.NewItem(hdr)
+		i.Offset = offset + hdr.Len()
+		if i.Offset > end {
+			return nil, errInvalidIndex
+		}
+		items = append(items, i)
+	}
+
+	return items, nil
+}
+
+// beginWrite removes the stored index before the archive is modified.
+// A crash during the modification thus leaves an archive without index
+// instead of one with a stale index.
+func (a Archive) beginWrite() error {
+	if a.idx.stored {
+		if err := a.file.Truncate(a.idx.end); err != nil {
+			return err
+		}
+		a.idx.stored = false
+	}
+	a.idx.dirty = true
+	return nil
+}
+
+// invalidateIndex forgets the indexed items after the archive has been
+// rewritten, so that they are scanned again before the index is written.
+func (a Archive) invalidateIndex() error {
+	stat, err := a.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	a.idx.items = nil
+	a.idx.paths = nil
+	a.idx.end = stat.Size()
+
+	return nil
+}
+
+// writeIndex writes the index to the end of the archive or the stream.
+// If the items are unknown, the archive is scanned first.
+func (a Archive) writeIndex() error {
+	if a.idx.items == nil {
+		items, err := a.scanItems()
+		if err != nil {
+			return err
+		}
+		a.idx.items = items
+	}
+
+	if a.out != nil {
+		if err := a.encodeIndex(a.out); err != nil {
+			return err
+		}
+		a.idx.dirty = false
+		return a.out.w.Flush()
+	}
+
+	if err := a.file.Truncate(a.idx.end); err != nil {
+		return err
+	}
+	if _, err := a.file.Seek(a.idx.end, io.SeekStart); err != nil {
+		return err
+	}
+	if err := a.encodeIndex(a.file); err != nil {
+		return err
+	}
+
+	a.idx.stored = true
+	a.idx.dirty = false
+
+	return a.file.Sync()
+}
+
+// encodeIndex writes the index record and the footer to w, which is
+// positioned at the end of the items.
+func (a Archive) encodeIndex(w io.Writer) error {
+	buf := bytes.NewBuffer(nil)
+	head := make([]byte, indexEndLength+indexCountLength)
+	binary.LittleEndian.PutUint64(head, uint64(a.idx.end))
+	binary.LittleEndian.PutUint64(head[indexEndLength:], uint64(len(a.idx.items)))
+	buf.Write(head)
+
+	for _, i := range a.idx.items {
+		hdr, err := i.Header.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		entry := make([]byte, entryOffsetLength+entryLength)
+		binary.LittleEndian.PutUint64(entry, uint64(i.Offset-i.Header.Len()))
+		binary.LittleEndian.PutUint32(entry[entryOffsetLength:], uint32(len(hdr)))
+		buf.Write(entry)
+		buf.Write(hdr)
+	}
+
+	if _, err := w.Write([]byte{0, 0, recordIndex}); err != nil {
+		return err
+	}
+
+	chunks := math.Ceil(float64(buf.Len()) / float64(a.config.ChunkSize))
+	if err := new(item.Body).Write(w, buf, a.config); err != nil {
+		return err
+	}
+
+	footer := make([]byte, indexFooterLength)
+	binary.LittleEndian.PutUint64(footer, uint64(a.idx.end))
+	binary.LittleEndian.PutUint64(footer[indexOffsetLength:], uint64(chunks))
+	copy(footer[indexOffsetLength+indexChunksLength:], indexMagic)
+	_, err := w.Write(footer)
+	return err
+}
+
+// scanItems reads all items by seeking from header to header.
+func (a Archive) scanItems() ([]*item.Item, error) {
+	a.idx.committed = 0
+	items := []*item.Item{}
+	err := a.iterateItems(func(i *item.Item) error {
+		items = append(items, i)
+		_, err := a.skipChunks(i.Header.Chunks)
+		return err
+	})
+	return items, err
+}
+
+// eachItem calls cb for every item of the archive. The index is used if
+// available, otherwise the archive is scanned.
+func (a Archive) eachItem(cb func(*item.Item) error) error {
+	// A stream skips the bodies on its own.
+	if a.in != nil {
+		return a.iterateItems(cb)
+	}
+	if err := a.flushSolid(); err != nil {
+		return err
+	}
+
+	if a.idx.items != nil {
+		for _, i := range a.idx.items {
+			if err := cb(i); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return a.iterateItems(func(i *item.Item) error {
+		if err := cb(i); err != nil {
+			return err
+		}
+		if _, err := a.file.Seek(i.Offset, io.SeekStart); err != nil {
+			return err
+		}
+		_, err := a.skipChunks(i.Header.Chunks)
+		return err
+	})
+}
+
+var (
+	errInvalidIndex = errors.New("archive index is invalid")
+	errDamaged      = errors.New("archive is damaged, run repair to salvage its items")
+)
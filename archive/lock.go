@@ -0,0 +1,107 @@
+package archive
+
+import (
+	"os"
+)
+
+// fileLock is an advisory lock of an archive. The lock is taken on the
+// archive file itself or on the first volume of a volume set, so that no
+// lock file is left next to the archive. As compaction replaces the
+// archive file, the new file is locked before it replaces the old one,
+// and a lock taken on a file, which has been replaced in the meantime,
+// is taken again on the new file.
+type fileLock struct {
+	file      *os.File
+	exclusive bool
+}
+
+// LockedError is returned if an archive is locked by another process.
+type LockedError struct {
+	// Holder is the pid and command line of the process holding an
+	// exclusive lock. It is empty if the archive is locked by readers or
+	// if the holder cannot be determined.
+	Holder string
+}
+
+func (e *LockedError) Error() string {
+	if len(e.Holder) == 0 {
+		return "archive is locked by another process"
+	}
+	return "archive is locked by " + e.Holder
+}
+
+// lockArchive locks the archive file at the given path, see storagePath.
+// The file is created if create is set. Writers take an exclusive lock,
+// readers a shared lock. If the archive is locked by another process,
+// lockArchive waits for the lock or returns a LockedError.
+func lockArchive(path string, create, exclusive, wait bool) (*fileLock, error) {
+	flag := os.O_RDONLY
+	if exclusive {
+		flag = os.O_RDWR
+	}
+	if create {
+		flag |= os.O_CREATE
+	}
+
+	for {
+		fh, err := os.OpenFile(path, flag, 0666)
+		if err != nil {
+			return nil, err
+		}
+
+		locked, err := tryLock(fh, exclusive)
+		if err != nil {
+			fh.Close()
+			return nil, err
+		}
+		if !locked {
+			if !wait {
+				holder := lockHolder(fh)
+				fh.Close()
+				return nil, &LockedError{Holder: holder}
+			}
+			if err := lock(fh, exclusive); err != nil {
+				fh.Close()
+				return nil, err
+			}
+		}
+
+		// The file may have been replaced while waiting for the lock.
+		same, err := isFile(fh, path)
+		if err != nil {
+			fh.Close()
+			return nil, err
+		}
+		if same {
+			return &fileLock{file: fh, exclusive: exclusive}, nil
+		}
+		fh.Close()
+	}
+}
+
+// isFile returns whether fh is the file currently stored at path.
+func isFile(fh *os.File, path string) (bool, error) {
+	stat, err := fh.Stat()
+	if err != nil {
+		return false, err
+	}
+	cur, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return os.SameFile(stat, cur), nil
+}
+
+// unlock releases the lock.
+func (l *fileLock) unlock() error {
+	if l == nil || l.file == nil {
+		return nil
+	}
+	// Closing the file releases the lock.
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
@@ -0,0 +1,49 @@
+package archive
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// lockHolder returns the pid and command line of the process holding an
+// exclusive lock on fh. The holder is looked up in /proc/locks, whose
+// entries name the file by device and inode number.
+func lockHolder(fh *os.File) string {
+	stat, err := fh.Stat()
+	if err != nil {
+		return ""
+	}
+	node, _, ok := inodeOf(stat)
+	if !ok {
+		return ""
+	}
+	id := fmt.Sprintf("%02x:%02x:%d", unix.Major(node.dev), unix.Minor(node.dev), node.ino)
+
+	locks, err := os.Open("/proc/locks")
+	if err != nil {
+		return ""
+	}
+	defer locks.Close()
+
+	// 1: FLOCK  ADVISORY  WRITE 1234 08:01:5678 0 EOF
+	scanner := bufio.NewScanner(locks)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 || fields[1] != "FLOCK" || fields[3] != "WRITE" || fields[5] != id {
+			continue
+		}
+		pid, err := strconv.Atoi(fields[4])
+		if err != nil {
+			return ""
+		}
+		cmd, _ := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+		return fmt.Sprintf("pid %d (%s)", pid, strings.TrimSpace(strings.Replace(string(cmd), "\x00", " ", -1)))
+	}
+	return ""
+}
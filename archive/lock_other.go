@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package archive
+
+import "os"
+
+// lockHolder is only supported on Linux.
+func lockHolder(fh *os.File) string {
+	return ""
+}
@@ -0,0 +1,36 @@
+//go:build !windows
+// +build !windows
+
+package archive
+
+import (
+	"os"
+	"syscall"
+)
+
+// tryLock takes a lock on the file without waiting. It returns false if
+// the file is locked by another process.
+func tryLock(fh *os.File, exclusive bool) (bool, error) {
+	err := syscall.Flock(int(fh.Fd()), lockHow(exclusive)|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// lock takes a lock on the file and waits until it is available.
+func lock(fh *os.File, exclusive bool) error {
+	for {
+		err := syscall.Flock(int(fh.Fd()), lockHow(exclusive))
+		if err != syscall.EINTR {
+			return err
+		}
+	}
+}
+
+func lockHow(exclusive bool) int {
+	if exclusive {
+		return syscall.LOCK_EX
+	}
+	return syscall.LOCK_SH
+}
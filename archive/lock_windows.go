@@ -0,0 +1,13 @@
+package archive
+
+import "os"
+
+// tryLock is not supported on Windows, so archives are not locked.
+func tryLock(fh *os.File, exclusive bool) (bool, error) {
+	return true, nil
+}
+
+// lock is not supported on Windows.
+func lock(fh *os.File, exclusive bool) error {
+	return nil
+}
@@ -0,0 +1,126 @@
+package archive
+
+import (
+	"os"
+	"os/user"
+	"strconv"
+	"sync"
+
+	"github.com/marcboeker/supertar/item"
+)
+
+// owners caches the mapping between user and group IDs and their names,
+// as every lookup may hit the network for directory services. It is used
+// by all extraction workers at once.
+type owners struct {
+	mu       sync.Mutex
+	users    map[int]string
+	groups   map[int]string
+	userIDs  map[string]int
+	groupIDs map[string]int
+}
+
+func newOwners() *owners {
+	return &owners{
+		users:    map[int]string{},
+		groups:   map[int]string{},
+		userIDs:  map[string]int{},
+		groupIDs: map[string]int{},
+	}
+}
+
+// userName returns the name of the user with the given ID or an empty
+// string if the user is unknown.
+func (o *owners) userName(uid int) string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if name, ok := o.users[uid]; ok {
+		return name
+	}
+	var name string
+	if u, err := user.LookupId(strconv.Itoa(uid)); err == nil {
+		name = u.Username
+	}
+	o.users[uid] = name
+	return name
+}
+
+// groupName returns the name of the group with the given ID or an empty
+// string if the group is unknown.
+func (o *owners) groupName(gid int) string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if name, ok := o.groups[gid]; ok {
+		return name
+	}
+	var name string
+	if g, err := user.LookupGroupId(strconv.Itoa(gid)); err == nil {
+		name = g.Name
+	}
+	o.groups[gid] = name
+	return name
+}
+
+// userID returns the local ID of the user with the given name.
+// If the user does not exist, fallback is returned.
+func (o *owners) userID(name string, fallback int) int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if len(name) == 0 {
+		return fallback
+	}
+	id, ok := o.userIDs[name]
+	if !ok {
+		id = -1
+		if u, err := user.Lookup(name); err == nil {
+			if uid, err := strconv.Atoi(u.Uid); err == nil {
+				id = uid
+			}
+		}
+		o.userIDs[name] = id
+	}
+	if id < 0 {
+		return fallback
+	}
+	return id
+}
+
+// groupID returns the local ID of the group with the given name.
+// If the group does not exist, fallback is returned.
+func (o *owners) groupID(name string, fallback int) int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if len(name) == 0 {
+		return fallback
+	}
+	id, ok := o.groupIDs[name]
+	if !ok {
+		id = -1
+		if g, err := user.LookupGroup(name); err == nil {
+			if gid, err := strconv.Atoi(g.Gid); err == nil {
+				id = gid
+			}
+		}
+		o.groupIDs[name] = id
+	}
+	if id < 0 {
+		return fallback
+	}
+	return id
+}
+
+// chown applies the ownership of the item to the given path. Unless
+// numeric is set, the user and group names take precedence over the
+// stored IDs. Links are not followed.
+func (o *owners) chown(path string, hdr *item.Header, numeric bool) error {
+	uid, gid := hdr.UID, hdr.GID
+	if !numeric {
+		uid = o.userID(hdr.Uname, uid)
+		gid = o.groupID(hdr.Gname, gid)
+	}
+	return os.Lchown(path, uid, gid)
+}
@@ -0,0 +1,137 @@
+package archive
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/marcboeker/supertar/config"
+	"github.com/marcboeker/supertar/item"
+)
+
+// ItemReader reads the content of an item at any offset. Seeking does
+// not read anything, reading decrypts only the chunk holding the offset.
+type ItemReader interface {
+	io.ReadSeekCloser
+	io.ReaderAt
+	// Size returns the size of the content.
+	Size() int64
+}
+
+// Open returns a reader of the content of the file stored at path. Hard
+// links are resolved to the file they are linked to. If a path is stored
+// more than once, the last item is opened.
+func (a Archive) Open(path string) (ItemReader, error) {
+	i, err := a.findItem(path)
+	if err != nil {
+		return nil, err
+	}
+	if i.Header.Type() == item.ModeHardlink {
+		if i, err = a.findItem(i.Header.Link); err != nil {
+			return nil, err
+		}
+	}
+	return a.OpenItem(i)
+}
+
+// OpenItem returns a reader of the content of the regular item i.
+func (a Archive) OpenItem(i *item.Item) (ItemReader, error) {
+	if a.in != nil || a.out != nil {
+		return nil, errStreamAccess
+	}
+	if i.Header.Type() != item.ModeRegular {
+		return nil, errNotRegular
+	}
+
+	if i.Header.IsSolid() {
+		pos := blockOf(i)
+		if pos < a.start {
+			return nil, errInvalidBlock
+		}
+		block, err := a.readBlock(pos)
+		if err != nil {
+			return nil, err
+		}
+		return item.NewSolidReader(i, block)
+	}
+	offsets, err := a.chunks.get(i, a.file, a.config)
+	if err != nil {
+		return nil, err
+	}
+	return item.NewOffsetReader(i, a.file, offsets, a.config), nil
+}
+
+// findItem returns the last item stored at path, which is not deleted.
+// The items are looked up in the index if available, otherwise the
+// archive is scanned.
+func (a Archive) findItem(path string) (*item.Item, error) {
+	if err := a.flushSolid(); err != nil {
+		return nil, err
+	}
+
+	var found *item.Item
+	if a.in == nil && a.idx.items != nil {
+		items := a.idx.lookup(path)
+		for n := len(items) - 1; n >= 0 && found == nil; n-- {
+			if items[n].Header.Deleted == 0 {
+				found = items[n]
+			}
+		}
+	} else {
+		err := a.eachItem(func(i *item.Item) error {
+			if i.Header.Path == path && i.Header.Deleted == 0 {
+				found = i
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if found == nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+	}
+	return found, nil
+}
+
+// chunkCache holds the offsets of the chunks of every opened item, so
+// that the chunk headers of an item are read only once, no matter how
+// often it is opened. The items are identified by the offset of their
+// body. The cache is reset when the archive is rewritten.
+type chunkCache struct {
+	mu      sync.Mutex
+	offsets map[int64][]int64
+}
+
+// get returns the chunk offsets of the item i stored in src.
+func (c *chunkCache) get(i *item.Item, src io.ReaderAt, conf *config.Config) ([]int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if offsets, ok := c.offsets[i.Offset]; ok && int64(len(offsets)) == i.Header.Chunks {
+		return offsets, nil
+	}
+	offsets, err := item.ChunkOffsets(i, src, conf)
+	if err != nil {
+		return nil, err
+	}
+	if c.offsets == nil {
+		c.offsets = map[int64][]int64{}
+	}
+	c.offsets[i.Offset] = offsets
+	return offsets, nil
+}
+
+// reset forgets all offsets.
+func (c *chunkCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.offsets = nil
+}
+
+var (
+	errStreamAccess = errors.New("items of a stream cannot be opened")
+	errNotRegular   = errors.New("item is not a regular file")
+)
@@ -0,0 +1,422 @@
+package archive
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/marcboeker/supertar/crypto"
+	"github.com/marcboeker/supertar/item"
+)
+
+// countReader counts the bytes read from it.
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Salvage recovers all intact items of a damaged archive and writes them
+// to a new archive at path. Every header and chunk is authenticated on
+// its own, so after a damaged region the next item is found by trying to
+// decrypt a header at the following offsets, which are plausible starts
+// of an item, see resync. The new archive shares the
+// key of the damaged archive, so the items are copied without decrypting
+// them to disk. Items marked as deleted and commit records are not
+// copied, all recovered items are committed at once. Intact solid blocks
+// are copied as well, so that the solid items referring to them can be
+// recovered.
+//
+// The returned report contains the number of recovered items and all
+// items and regions which were lost. Every recovered item is sent to ch.
+func (a Archive) Salvage(path string, ch chan *item.Item) (*Report, error) {
+	if ch != nil {
+		defer func() {
+			close(ch)
+		}()
+	}
+
+	limit, err := a.scanLimit()
+	if err != nil {
+		return nil, err
+	}
+
+	fh, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	if _, err := io.Copy(fh, io.NewSectionReader(a.file, 0, a.start)); err != nil {
+		return nil, err
+	}
+
+	dest := Archive{path: path, file: fh, header: a.header, start: a.start, config: a.config, idx: &index{items: []*item.Item{}, end: a.start}}
+	report := &Report{Problems: []Problem{}}
+	blocks := map[int64]int64{} // offsets of the copied blocks in dest
+	err = a.scanRecords(a.start, limit, report, func(pos, n int64) error {
+		rec := make([]byte, n)
+		if _, err := a.file.ReadAt(rec, pos); err != nil {
+			return err
+		}
+		var err error
+		blocks[pos], err = dest.appendRaw(rec)
+		return err
+	}, func(i *item.Item, pos, end int64, err error) error {
+		if err != nil {
+			report.Problems = append(report.Problems, Problem{Path: i.Header.Path, Offset: pos, Error: err.Error()})
+			return nil
+		}
+		if i.Header.Deleted != 0 {
+			return nil
+		}
+
+		if block, ok := blocks[blockOf(i)]; i.Header.IsSolid() && ok {
+			err = dest.writeSolid(i.Header, block)
+		} else if i.Header.IsSolid() {
+			// The block has not been found in front of the item.
+			report.Problems = append(report.Problems, Problem{Path: i.Header.Path, Offset: pos, Error: errInvalidBlock.Error()})
+			return nil
+		} else {
+			err = dest.copyItem(a.file, pos, end, i)
+		}
+		if err != nil {
+			return err
+		}
+		if ch != nil {
+			ch <- i
+		}
+		report.Items++
+		report.Bytes += i.Header.Size
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := dest.commit(); err != nil {
+		return nil, err
+	}
+	if err := dest.writeIndex(); err != nil {
+		return nil, err
+	}
+
+	return report, fh.Close()
+}
+
+// scanLimit returns the offset up to which items are stored. Without a
+// stored index, this is the end of the file.
+func (a Archive) scanLimit() (int64, error) {
+	if a.idx.stored {
+		return a.idx.end, nil
+	}
+	stat, err := a.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return stat.Size(), nil
+}
+
+// scanRecords reads the blocks and items between pos and limit, also
+// behind damaged regions. onBlock is called with the offset and length
+// of every intact block. onItem is called for every item with an intact
+// header with the offset of its header, the offset after its body and
+// the error found in its body, if any. Regions without any readable
+// record are added to report. The scan stops at the index.
+func (a Archive) scanRecords(pos, limit int64, report *Report, onBlock func(pos, n int64) error, onItem func(i *item.Item, pos, end int64, err error) error) error {
+	rs := &resync{a: a, limit: limit}
+	lost := int64(-1)
+	found := func() {
+		if lost >= 0 {
+			report.Problems = append(report.Problems, lostRegion(lost, pos))
+			lost = -1
+		}
+	}
+
+	for pos < limit {
+		typ, err := a.readRecordType(pos)
+		if err != nil {
+			return err
+		}
+		if typ == recordIndex && lost < 0 {
+			return nil
+		}
+		if typ == recordBlock {
+			if n, err := a.blockLength(pos); err == nil && pos+n <= limit {
+				if _, err := a.readBlock(pos); err == nil {
+					found()
+					if err := onBlock(pos, n); err != nil {
+						return err
+					}
+					pos += n
+					continue
+				}
+			}
+		}
+		if typ == recordCommit {
+			if n, err := a.readCommit(pos); err == nil {
+				found()
+				pos += n
+				continue
+			}
+		}
+
+		i, end, err := a.readIntact(pos, limit)
+		if i == nil {
+			if lost < 0 {
+				lost = pos
+			}
+			if pos, err = rs.next(pos + 1); err != nil {
+				return err
+			}
+			continue
+		}
+
+		found()
+		if err := onItem(i, pos, end, err); err != nil {
+			return err
+		}
+		if err != nil {
+			// The header is intact, but the body is damaged. Skip the
+			// body if its chunk headers are intact.
+			if end = a.skipChunksAt(i, limit); end == 0 {
+				end = i.Offset
+				lost = end
+			}
+		}
+		pos = end
+	}
+	if lost >= 0 {
+		report.Problems = append(report.Problems, lostRegion(lost, limit))
+	}
+
+	return nil
+}
+
+// resync finds the offsets behind a damaged region, at which a record or
+// an item may start. An item header starts with its length and is
+// followed by a metadata block, a chunk with sequence number 0, a record
+// or the header of the next item. Only offsets, whose header length
+// leads to a chain of headers ending at a record, at a first chunk or at
+// the end of the scan, are tried. As a metadata block cannot be told from
+// damaged data, a header followed by a record or a first chunk within
+// resyncMetaLength is tried as well. The offsets are determined for
+// windows of resyncWindow bytes, the chains are followed up to
+// resyncLookahead bytes beyond the window.
+type resync struct {
+	a     Archive
+	limit int64
+	end   int64   // end of the current window
+	cands []int64 // remaining offsets of the current window
+}
+
+const (
+	resyncWindow       = 1024 * 1024
+	resyncLookahead    = 1024 * 1024
+	resyncMetaLength   = 64 * 1024
+	resyncHeaderLength = 16 * 1024
+
+	// itemLengthLength is the length of the field in front of an item
+	// header, which holds the length of the encrypted header.
+	itemLengthLength = 2
+)
+
+// next returns the first offset at or after pos, at which a record or an
+// item may start, or the limit if there is none.
+func (r *resync) next(pos int64) (int64, error) {
+	for pos < r.limit {
+		if pos >= r.end {
+			cands, end, err := r.a.resyncCandidates(pos, r.limit)
+			if err != nil {
+				return 0, err
+			}
+			r.cands, r.end = cands, end
+		}
+		for len(r.cands) > 0 && r.cands[0] < pos {
+			r.cands = r.cands[1:]
+		}
+		if len(r.cands) > 0 {
+			return r.cands[0], nil
+		}
+		pos = r.end
+	}
+	return r.limit, nil
+}
+
+// resyncCandidates returns the offsets of the window starting at pos, at
+// which a record or an item may start, and the end of the window.
+func (a Archive) resyncCandidates(pos, limit int64) ([]int64, int64, error) {
+	end := pos + resyncWindow
+	if end > limit {
+		end = limit
+	}
+	read := end + resyncLookahead
+	if read > limit {
+		read = limit
+	}
+	buf := make([]byte, read-pos)
+	if _, err := a.file.ReadAt(buf, pos); err != nil && err != io.EOF {
+		return nil, 0, err
+	}
+	n := len(buf)
+	maxChunk := item.MaxChunkLength(a.config)
+
+	isRecord := func(i int) bool {
+		if i+recordHeaderLength > n || buf[i] != 0 || buf[i+1] != 0 {
+			return false
+		}
+		switch buf[i+recordMarkerLength] {
+		case recordIndex, recordCommit, recordBlock:
+			return true
+		}
+		return false
+	}
+	// isBoundary returns whether a header may be followed by the data at
+	// i without a metadata block in between.
+	isBoundary := func(i int) bool {
+		if i == n {
+			return read == limit
+		}
+		if isRecord(i) {
+			return true
+		}
+		if i+8 > n {
+			return false
+		}
+		seq := binary.LittleEndian.Uint32(buf[i:]) &^ item.ChunkStored
+		size := int64(binary.LittleEndian.Uint32(buf[i+4:]))
+		return seq == 0 && size > 0 && size <= maxChunk
+	}
+	// headerEnd returns the end of a header starting at i or -1.
+	headerEnd := func(i int) int {
+		if i+itemLengthLength > n {
+			return -1
+		}
+		l := int(binary.LittleEndian.Uint16(buf[i:]))
+		if l <= crypto.Overhead || i+itemLengthLength+l > n {
+			return -1
+		}
+		return i + itemLengthLength + l
+	}
+
+	// chain is set for offsets starting a chain of headers, which ends at
+	// a boundary. next is the first boundary at or after an offset.
+	boundary := make([]bool, n+1)
+	chain := make([]bool, n+1)
+	next := make([]int32, n+1)
+	next[n] = int32(n + resyncMetaLength + 1)
+	for i := n; i >= 0; i-- {
+		boundary[i] = isBoundary(i)
+		if i < n {
+			next[i] = next[i+1]
+		}
+		if boundary[i] {
+			next[i] = int32(i)
+		}
+		if e := headerEnd(i); e >= 0 {
+			chain[i] = boundary[e] || chain[e]
+		}
+	}
+
+	var cands []int64
+	for i := 0; i < int(end-pos); i++ {
+		if isRecord(i) || chain[i] {
+			cands = append(cands, pos+int64(i))
+			continue
+		}
+		if e := headerEnd(i); e >= 0 && e-i <= resyncHeaderLength && e+crypto.Overhead <= n && int(next[e+crypto.Overhead])-e <= resyncMetaLength {
+			cands = append(cands, pos+int64(i))
+		}
+	}
+
+	return cands, end, nil
+}
+
+// readIntact reads the item at pos and checks all of its chunks. It
+// returns the item and the offset after its last chunk. If the header
+// is intact but the body is not, the item is returned together with the
+// error. No item and no error is returned for an end marker.
+func (a Archive) readIntact(pos, limit int64) (*item.Item, int64, error) {
+	src := &countReader{r: io.NewSectionReader(a.file, pos, limit-pos)}
+	i, err := item.Read(src, a.config)
+	if err != nil || i == nil {
+		return nil, 0, err
+	}
+	i.Offset = pos + src.n
+
+	if i.Header.IsSolid() {
+		content, err := a.solidContent(i)
+		if err == nil {
+			err = i.ExtractSolid(bytes.NewReader(content), ioutil.Discard)
+		}
+		if err != nil {
+			return i, 0, err
+		}
+	} else if i.Header.Type() == item.ModeRegular && i.Header.Size > 0 {
+		if err := i.Extract(src, ioutil.Discard, a.config); err != nil {
+			return i, 0, err
+		}
+	} else if i.Header.Chunks != 0 {
+		return i, 0, errInvalidChunks
+	}
+
+	return i, pos + src.n, nil
+}
+
+// skipChunksAt returns the offset after the last chunk of the item by
+// reading its chunk headers. It returns 0 if the chunk headers are not
+// intact.
+func (a Archive) skipChunksAt(i *item.Item, limit int64) int64 {
+	pos := i.Offset
+	hdr := make([]byte, 8)
+	for n := int64(0); n < i.Header.Chunks; n++ {
+		if _, err := a.file.ReadAt(hdr, pos); err != nil {
+			return 0
+		}
+		seq := binary.LittleEndian.Uint32(hdr[:4]) &^ item.ChunkStored
+		size := int64(binary.LittleEndian.Uint32(hdr[4:]))
+		if int64(seq) != n || size > item.MaxChunkLength(a.config) {
+			return 0
+		}
+		pos += int64(len(hdr)) + size
+		if pos > limit {
+			return 0
+		}
+	}
+	return pos
+}
+
+// copyItem appends the raw item between start and end of src.
+func (a Archive) copyItem(src io.ReaderAt, start, end int64, i *item.Item) error {
+	if _, err := a.file.Seek(a.idx.end, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.Copy(a.file, io.NewSectionReader(src, start, end-start)); err != nil {
+		return err
+	}
+
+	e := item.NewItem(i.Header)
+	e.Offset = a.idx.end + i.Offset - start
+	a.idx.items = append(a.idx.items, e)
+	a.idx.end += end - start
+
+	return nil
+}
+
+// lostRegion returns a problem for a region without any readable item.
+func lostRegion(start, end int64) Problem {
+	return Problem{Offset: start, Error: fmt.Sprintf("%d bytes unreadable", end-start)}
+}
+
+var (
+	errInvalidChunks = errors.New("item must not have chunks")
+)
@@ -0,0 +1,285 @@
+package archive
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/marcboeker/supertar/item"
+)
+
+const (
+	recordBlock = 4
+
+	chunkHeaderLength = 8
+
+	// solidFraction limits solid files to a fraction of the chunk size,
+	// so that a block holds at least that many files.
+	solidFraction = 4
+)
+
+// A solid block record holds the content of several small files, which
+// are compressed and encrypted together. It consists of the record header
+// and a single chunk (see item.Body) of at most the chunk size. The block
+// is followed by the headers of its files, which have no chunks of their
+// own. Instead, every header holds the distance back to the start of the
+// block and the offset of the content in the block (see item.Header), so
+// that a single file is extracted by decrypting only its block.
+
+// solidBlock collects the content of small files until it is written as
+// a solid block.
+type solidBlock struct {
+	buf  []byte
+	hdrs []*item.Header
+}
+
+// blockCache holds the last decrypted block, as the files of a block are
+// usually read one after another.
+type blockCache struct {
+	mu   sync.Mutex
+	pos  int64
+	data []byte
+}
+
+// isSolid returns whether the file with the given header is packed into
+// a solid block.
+func (a Archive) isSolid(hdr *item.Header) bool {
+	return a.solid != nil && len(hdr.Sparse) == 0 && hdr.Size > 0 &&
+		hdr.Size < int64(a.config.ChunkSize/solidFraction)
+}
+
+// addSolid reads the content of a small file from src and adds it to the
+// pending block. The block is written if it is full.
+func (a Archive) addSolid(hdr *item.Header, src io.Reader) error {
+	buf := make([]byte, hdr.Size)
+	n, err := io.ReadFull(src, buf)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	buf = buf[:n]
+
+	if len(a.solid.buf)+n > a.config.ChunkSize {
+		if err := a.flushSolid(); err != nil {
+			return err
+		}
+	}
+
+	sum := sha256.Sum256(buf)
+	hdr.Size = int64(n)
+	hdr.Chunks = 0
+	hdr.Checksum = sum[:]
+	hdr.BlockOffset = int64(len(a.solid.buf))
+	a.solid.buf = append(a.solid.buf, buf...)
+	a.solid.hdrs = append(a.solid.hdrs, hdr)
+
+	return nil
+}
+
+// flushSolid writes the pending block together with the headers of its
+// files and commits them.
+func (a Archive) flushSolid() error {
+	if a.solid == nil || len(a.solid.hdrs) == 0 {
+		return nil
+	}
+	buf, hdrs := a.solid.buf, a.solid.hdrs
+	a.solid.buf, a.solid.hdrs = nil, nil
+
+	rec := bytes.NewBuffer([]byte{0, 0, recordBlock})
+	if err := new(item.Body).Write(rec, bytes.NewReader(buf), a.config); err != nil {
+		return err
+	}
+
+	if err := a.beginWrite(); err != nil {
+		return err
+	}
+	end, count := a.idx.end, len(a.idx.items)
+	if err := a.writeBlock(rec.Bytes(), hdrs); err != nil {
+		if a.out == nil {
+			// Remove the incomplete block.
+			a.file.Truncate(end)
+			a.idx.end = end
+			if a.idx.items != nil {
+				a.idx.items = a.idx.items[:count]
+				a.idx.paths = nil
+			}
+		}
+		return err
+	}
+
+	return a.commitAppend()
+}
+
+// writeBlock appends the raw block record followed by the given headers,
+// which are copied to point to the appended block.
+func (a Archive) writeBlock(rec []byte, hdrs []*item.Header) error {
+	pos, err := a.appendRaw(rec)
+	if err != nil {
+		return err
+	}
+	for _, hdr := range hdrs {
+		if err := a.writeSolid(hdr, pos); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeSolid appends a copy of the header of a solid file, whose block is
+// stored at block.
+func (a Archive) writeSolid(h *item.Header, block int64) error {
+	hdr := *h
+	pos := a.idx.end
+	if a.out != nil {
+		pos = a.out.n
+	}
+	hdr.Block = pos - block
+
+	buf := bytes.NewBuffer(nil)
+	e := item.NewItem(&hdr)
+	if err := e.Write(buf, nil, a.config); err != nil {
+		return err
+	}
+	if _, err := a.appendRaw(buf.Bytes()); err != nil {
+		return err
+	}
+
+	if a.idx.items != nil {
+		e.Offset = pos + hdr.Len()
+		a.idx.items = append(a.idx.items, e)
+	}
+
+	return nil
+}
+
+// copyBlock appends the raw block between start and end of src followed
+// by the headers of the given solid items.
+func (a Archive) copyBlock(src io.ReaderAt, start, end int64, items []*item.Item) error {
+	rec := make([]byte, end-start)
+	if _, err := src.ReadAt(rec, start); err != nil {
+		return err
+	}
+
+	hdrs := make([]*item.Header, len(items))
+	for n, i := range items {
+		hdrs[n] = i.Header
+	}
+	return a.writeBlock(rec, hdrs)
+}
+
+// appendRaw appends p to the end of the items of the archive or to the
+// stream and returns its offset.
+func (a Archive) appendRaw(p []byte) (int64, error) {
+	if a.out != nil {
+		pos := a.out.n
+		_, err := a.out.Write(p)
+		a.idx.end = a.out.n
+		return pos, err
+	}
+
+	pos := a.idx.end
+	n, err := a.file.WriteAt(p, pos)
+	a.idx.end += int64(n)
+	return pos, err
+}
+
+// blockLength returns the length of the block record at pos.
+func (a Archive) blockLength(pos int64) (int64, error) {
+	hdr := make([]byte, chunkHeaderLength)
+	if _, err := a.file.ReadAt(hdr, pos+recordHeaderLength); err != nil {
+		return 0, err
+	}
+	size := int64(binary.LittleEndian.Uint32(hdr[4:]))
+	if size > item.MaxChunkLength(a.config) {
+		return 0, errInvalidBlock
+	}
+	return recordHeaderLength + chunkHeaderLength + size, nil
+}
+
+// blockOf returns the offset of the block of the solid item i.
+func blockOf(i *item.Item) int64 {
+	return i.Offset - i.Header.Len() - i.Header.Block
+}
+
+// readBlock decrypts the block record at pos. A stream only provides the
+// last block it has read.
+func (a Archive) readBlock(pos int64) ([]byte, error) {
+	if a.blocks != nil {
+		a.blocks.mu.Lock()
+		defer a.blocks.mu.Unlock()
+		if a.blocks.data != nil && a.blocks.pos == pos {
+			return a.blocks.data, nil
+		}
+	}
+
+	var src io.Reader
+	if a.in != nil {
+		if a.in.block == nil || a.in.blockPos != pos {
+			return nil, errInvalidBlock
+		}
+		src = bytes.NewReader(a.in.block[recordHeaderLength:])
+	} else {
+		if typ, err := a.readRecordType(pos); err != nil || typ != recordBlock {
+			return nil, errInvalidBlock
+		}
+		n, err := a.blockLength(pos)
+		if err != nil {
+			return nil, err
+		}
+		src = io.NewSectionReader(a.file, pos+recordHeaderLength, n-recordHeaderLength)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if err := new(item.Body).Extract(src, buf, 1, a.config); err != nil {
+		return nil, err
+	}
+
+	if a.blocks != nil {
+		a.blocks.pos = pos
+		a.blocks.data = buf.Bytes()
+	}
+
+	return buf.Bytes(), nil
+}
+
+// solidContent returns the content of the solid item i.
+func (a Archive) solidContent(i *item.Item) ([]byte, error) {
+	pos := blockOf(i)
+	if pos < a.start {
+		return nil, errInvalidBlock
+	}
+	block, err := a.readBlock(pos)
+	if err != nil {
+		return nil, err
+	}
+	return i.SolidContent(block)
+}
+
+// readBlock reads the block record in front of the stream, so that the
+// contents of the following solid items can be read. The chunk of the
+// block must not exceed maxLength.
+func (s *streamReader) readBlock(maxLength int64) error {
+	pos := s.n
+	rec := make([]byte, recordHeaderLength+chunkHeaderLength)
+	if _, err := io.ReadFull(s, rec); err != nil {
+		return err
+	}
+	size := int64(binary.LittleEndian.Uint32(rec[recordHeaderLength+4:]))
+	if size > maxLength {
+		return errInvalidBlock
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(s, buf); err != nil {
+		return err
+	}
+
+	s.block = append(rec, buf...)
+	s.blockPos = pos
+	return nil
+}
+
+var (
+	errInvalidBlock = errors.New("solid block is invalid")
+)
@@ -0,0 +1,62 @@
+package archive
+
+import (
+	"io"
+	"os"
+	"syscall"
+
+	"github.com/marcboeker/supertar/item"
+	"golang.org/x/sys/unix"
+)
+
+// sparseSegments returns the data segments of the given file if it
+// contains holes. Files without holes return nil.
+func sparseSegments(f *os.File, stat os.FileInfo) ([]item.Segment, error) {
+	size := stat.Size()
+	st, ok := stat.Sys().(*syscall.Stat_t)
+	if !ok || size == 0 || st.Blocks*512 >= size {
+		return nil, nil
+	}
+
+	var segments []item.Segment
+	fd := int(f.Fd())
+	for offset := int64(0); offset < size; {
+		data, err := unix.Seek(fd, offset, unix.SEEK_DATA)
+		if err == unix.ENXIO {
+			break
+		}
+		if err == unix.EINVAL {
+			// The file system does not support SEEK_DATA.
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		hole, err := unix.Seek(fd, data, unix.SEEK_HOLE)
+		if err != nil {
+			return nil, err
+		}
+		if hole > size {
+			hole = size
+		}
+
+		segments = append(segments, item.Segment{Offset: data, Length: hole - data})
+		offset = hole
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	if len(segments) == 1 && segments[0].Offset == 0 && segments[0].Length == size {
+		return nil, nil
+	}
+
+	// Terminate the map at the end of the file to record a trailing hole.
+	if len(segments) == 0 || segments[len(segments)-1].Offset+segments[len(segments)-1].Length < size {
+		segments = append(segments, item.Segment{Offset: size, Length: 0})
+	}
+
+	return segments, nil
+}
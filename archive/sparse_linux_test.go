@@ -0,0 +1,84 @@
+package archive
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"github.com/marcboeker/supertar/item"
+)
+
+func (s *ArchiveTestSuite) TestSparse() {
+	src := filepath.Join(s.tmpDir, "archive-sparse-src")
+	s.Require().NoError(os.MkdirAll(src, os.ModePerm))
+	defer os.RemoveAll(src)
+
+	size := int64(8 * 1024 * 1024)
+	fh, err := os.Create(filepath.Join(src, "disk.img"))
+	s.Require().NoError(err)
+	_, err = fh.WriteAt([]byte("eekeek"), 2*1024*1024)
+	s.Require().NoError(err)
+	s.Require().NoError(fh.Truncate(size))
+	fh.Close()
+
+	err = s.arch.AddRecursive(s.tmpDir, src, nil)
+	s.Assert().NoError(err)
+
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+
+	var items []*item.Item
+	ch := make(chan *item.Item)
+	go func() {
+		for i := range ch {
+			if i.Header.Type() == item.ModeRegular {
+				items = append(items, i)
+			}
+		}
+		wg.Done()
+	}()
+
+	err = s.arch.List(ch, "")
+	s.Assert().NoError(err)
+	wg.Wait()
+
+	s.Require().Len(items, 1)
+	if len(items[0].Header.Sparse) == 0 {
+		s.T().Skip("file system does not support holes")
+	}
+	s.Assert().Equal(size, items[0].Header.Size)
+	s.Assert().True(items[0].Header.StoredSize() < size)
+
+	// The checksum matches the one of the source file including holes.
+	orig, err := ioutil.ReadFile(filepath.Join(src, "disk.img"))
+	s.Require().NoError(err)
+	sum := sha256.Sum256(orig)
+	s.Assert().Equal(sum[:], items[0].Header.Checksum)
+
+	path := filepath.Join(s.tmpDir, "archive-sparse-test")
+	defer os.RemoveAll(path)
+
+	ch = make(chan *item.Item)
+	go func() {
+		for range ch {
+		}
+	}()
+
+	err = s.arch.Extract(ch, path)
+	s.Assert().NoError(err)
+
+	extracted := filepath.Join(path, "archive-sparse-src", "disk.img")
+	data, err := ioutil.ReadFile(extracted)
+	s.Require().NoError(err)
+	expected := make([]byte, size)
+	copy(expected[2*1024*1024:], "eekeek")
+	s.Assert().True(bytes.Equal(expected, data))
+
+	stat, err := os.Stat(extracted)
+	s.Require().NoError(err)
+	s.Assert().True(stat.Sys().(*syscall.Stat_t).Blocks*512 < size)
+}
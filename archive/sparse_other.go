@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package archive
+
+import (
+	"os"
+
+	"github.com/marcboeker/supertar/item"
+)
+
+// sparseSegments is only supported on Linux, so sparse files are
+// stored with their holes filled.
+func sparseSegments(f *os.File, stat os.FileInfo) ([]item.Segment, error) {
+	return nil, nil
+}
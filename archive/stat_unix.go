@@ -0,0 +1,28 @@
+//go:build !windows
+// +build !windows
+
+package archive
+
+import (
+	"os"
+	"syscall"
+)
+
+// inodeOf returns the device and inode number of the given file
+// together with its number of hard links.
+func inodeOf(stat os.FileInfo) (inode, uint64, bool) {
+	st, ok := stat.Sys().(*syscall.Stat_t)
+	if !ok {
+		return inode{}, 0, false
+	}
+	return inode{dev: uint64(st.Dev), ino: uint64(st.Ino)}, uint64(st.Nlink), true
+}
+
+// ownerOf returns the user and group ID of the given file.
+func ownerOf(stat os.FileInfo) (int, int, bool) {
+	st, ok := stat.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(st.Uid), int(st.Gid), true
+}
@@ -0,0 +1,14 @@
+package archive
+
+import "os"
+
+// inodeOf is not supported on Windows, so hard links are stored as
+// regular files.
+func inodeOf(stat os.FileInfo) (inode, uint64, bool) {
+	return inode{}, 0, false
+}
+
+// ownerOf is not supported on Windows.
+func ownerOf(stat os.FileInfo) (int, int, bool) {
+	return 0, 0, false
+}
@@ -0,0 +1,223 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math"
+
+	"github.com/marcboeker/supertar/config"
+	"github.com/marcboeker/supertar/item"
+)
+
+// A stream is an archive which is written or read sequentially, e.g.
+// from a pipe. It uses the same format as an archive file, so a written
+// stream can be stored and opened as an archive later on. As nothing is
+// rewritten, the checksums of items are only stored if their source is
+// seekable and can be read twice, and a stream only supports adding
+// items (see NewStreamWriter) or listing and extracting them (see
+// NewStreamReader).
+
+// streamWriter buffers and counts the bytes written to a stream.
+type streamWriter struct {
+	w *bufio.Writer
+	n int64
+}
+
+func (s *streamWriter) Write(p []byte) (int, error) {
+	n, err := s.w.Write(p)
+	s.n += int64(n)
+	return n, err
+}
+
+// streamReader buffers and counts the bytes read from a stream. The last
+// solid block is kept to read the contents of the following items.
+type streamReader struct {
+	r        *bufio.Reader
+	n        int64
+	block    []byte
+	blockPos int64
+}
+
+func (s *streamReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	s.n += int64(n)
+	return n, err
+}
+
+// recordType returns the type of the special record in front of the
+// stream or 0 if an item header follows. io.EOF is returned at the end
+// of the stream.
+func (s *streamReader) recordType() (byte, error) {
+	buf, err := s.r.Peek(recordHeaderLength)
+	if len(buf) == 0 && err == io.EOF {
+		return 0, io.EOF
+	}
+	if len(buf) < recordHeaderLength {
+		// Reading the item header reports the truncated stream.
+		return 0, nil
+	}
+	return recordType(buf), nil
+}
+
+// skipChunks discards the given number of chunks.
+func (s *streamReader) skipChunks(n int64) error {
+	hdr := make([]byte, 8)
+	for i := int64(0); i < n; i++ {
+		if _, err := io.ReadFull(s, hdr); err != nil {
+			return err
+		}
+		size := binary.LittleEndian.Uint32(hdr[4:])
+		if _, err := io.CopyN(ioutil.Discard, s, int64(size)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewStreamWriter creates a new archive, which is written sequentially to
+// w. Items can only be added to it. The index is written when the archive
+// is closed.
+func NewStreamWriter(w io.Writer, c *config.Config) (*Archive, error) {
+	h, err := newHeader(c)
+	if err != nil {
+		return nil, err
+	}
+	out := &streamWriter{w: bufio.NewWriter(w)}
+	if err := h.Write(out); err != nil {
+		return nil, err
+	}
+	if c.Dict != nil {
+		if _, err := out.Write(encodeDict(c.Dict, c)); err != nil {
+			return nil, err
+		}
+	}
+
+	arch := &Archive{header: h, start: out.n, config: c, out: out, links: map[inode]string{}, owners: newOwners()}
+	if c.Solid {
+		arch.solid = &solidBlock{}
+	}
+	arch.idx = &index{items: []*item.Item{}, end: out.n, dirty: true}
+	if err := arch.commit(); err != nil {
+		return nil, err
+	}
+
+	return arch, nil
+}
+
+// NewStreamReader opens an archive, which is read sequentially from r.
+// The items can only be listed or extracted once.
+func NewStreamReader(r io.Reader, c *config.Config) (*Archive, error) {
+	buf := make([]byte, headerLength)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	h, err := readHeader(bytes.NewReader(buf), c)
+	if err != nil {
+		return nil, err
+	}
+	in := &streamReader{r: bufio.NewReader(r), n: headerLength}
+	c.Dict = nil
+	if typ, err := in.recordType(); err == nil && typ == recordDictionary {
+		if c.Dict, _, err = readDict(in, c); err != nil {
+			return nil, err
+		}
+	}
+	// The volumes of a set can be read as a stream one after another.
+	if typ, err := in.recordType(); err == nil && typ == recordVolume {
+		if _, err := readVolume(in, c); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Archive{
+		header: h,
+		start:  in.n,
+		config: c,
+		in:     in,
+		links:  map[inode]string{},
+		owners: newOwners(),
+		idx:    &index{end: math.MaxInt64},
+		blocks: &blockCache{},
+	}, nil
+}
+
+// writeStream appends a new item with the given header and body to the
+// stream.
+func (a Archive) writeStream(hdr *item.Header, src io.Reader) error {
+	e := item.NewItem(hdr)
+	pos := a.out.n
+	if err := e.Write(a.out, src, a.config); err != nil {
+		return err
+	}
+
+	a.idx.end = a.out.n
+	e.Offset = pos + hdr.Len()
+	a.idx.items = append(a.idx.items, e)
+
+	return a.commitAppend()
+}
+
+// iterateStream reads the items of the stream. The bodies, which are not
+// read by cb, are skipped.
+func (a Archive) iterateStream(cb func(*item.Item) error) error {
+	for {
+		typ, err := a.in.recordType()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case 0:
+		case recordCommit:
+			buf := make([]byte, commitLength)
+			if _, err := io.ReadFull(a.in, buf); err != nil {
+				return err
+			}
+			if err := a.checkCommit(buf); err != nil {
+				return err
+			}
+			a.idx.committed = a.in.n
+			continue
+		case recordBlock:
+			if err := a.in.readBlock(item.MaxChunkLength(a.config)); err != nil {
+				return err
+			}
+			continue
+		case recordIndex:
+			return nil
+		default:
+			return errUnknownRecord
+		}
+
+		i, err := item.Read(a.in, a.config)
+		if err != nil {
+			return err
+		}
+		if i == nil {
+			return nil
+		}
+		i.Offset = a.in.n
+
+		if err := cb(i); err != nil {
+			return err
+		}
+		if a.in.n == i.Offset {
+			if err := a.in.skipChunks(i.Header.Chunks); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// reader returns the source of the item bodies.
+func (a Archive) reader() io.Reader {
+	if a.in != nil {
+		return a.in
+	}
+	return a.file
+}
@@ -0,0 +1,28 @@
+package archive
+
+import (
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// timesOf returns the access and status change time of the given file.
+func timesOf(stat os.FileInfo) (time.Time, time.Time) {
+	st, ok := stat.Sys().(*syscall.Stat_t)
+	if !ok {
+		return time.Time{}, time.Time{}
+	}
+	return time.Unix(st.Atim.Unix()), time.Unix(st.Ctim.Unix())
+}
+
+// lchtimes changes the access and modification time of the given path
+// without following symlinks.
+func lchtimes(path string, atime, mtime time.Time) error {
+	ts := []unix.Timespec{
+		unix.NsecToTimespec(atime.UnixNano()),
+		unix.NsecToTimespec(mtime.UnixNano()),
+	}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, path, ts, unix.AT_SYMLINK_NOFOLLOW)
+}
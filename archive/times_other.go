@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package archive
+
+import (
+	"os"
+	"time"
+)
+
+// timesOf is only supported on Linux.
+func timesOf(stat os.FileInfo) (time.Time, time.Time) {
+	return time.Time{}, time.Time{}
+}
+
+// lchtimes is only supported on Linux, so the times of symlinks are not
+// restored on other platforms.
+func lchtimes(path string, atime, mtime time.Time) error {
+	return nil
+}
@@ -0,0 +1,98 @@
+package archive
+
+import (
+	"io"
+
+	"github.com/marcboeker/supertar/item"
+)
+
+const (
+	upgradeSuffix = ".upgrade"
+)
+
+// Upgrade rewrites an archive of an older version with the item headers
+// of the current version. Like a compaction, the items are written to a
+// temporary file next to the archive, which then replaces the archive,
+// and deleted items are dropped. Only the headers are rewritten, the
+// chunks and solid blocks are copied as they are, so no content is
+// decrypted. An interrupted upgrade is started over. Archives of the
+// current version are left unchanged.
+func (a *Archive) Upgrade() error {
+	if a.config.Version >= supertarVersion {
+		return nil
+	}
+
+	slices, err := a.remainingSlices()
+	if err != nil {
+		return err
+	}
+
+	c := *a.config
+	c.Version = supertarVersion
+	tmp, err := a.openRewrite(a.path+upgradeSuffix, &c)
+	if err != nil {
+		return err
+	}
+	defer tmp.file.Close()
+
+	var uncommitted int64
+	for _, sl := range slices {
+		if sl.block {
+			err = tmp.copyBlock(a.file, sl.start, sl.end, sl.items)
+		} else {
+			err = tmp.rewriteItem(a.file, sl.end, sl.items[0])
+		}
+		if err != nil {
+			return err
+		}
+
+		uncommitted += sl.end - sl.start
+		if uncommitted >= compactCommitSize {
+			if err := tmp.commit(); err != nil {
+				return err
+			}
+			uncommitted = 0
+		}
+	}
+
+	if err := tmp.commit(); err != nil {
+		return err
+	}
+	if err := tmp.writeIndex(); err != nil {
+		return err
+	}
+	if err := a.replace(tmp); err != nil {
+		return err
+	}
+
+	a.config.Version = supertarVersion
+	a.header.version = supertarVersion
+
+	return nil
+}
+
+// rewriteItem appends the item i with a newly written header and its
+// raw chunks, which end at end of src.
+func (a Archive) rewriteItem(src io.ReaderAt, end int64, i *item.Item) error {
+	pos, err := a.file.Seek(a.idx.end, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	hdr := *i.Header
+	if err := hdr.Write(a.file, a.config); err != nil {
+		return err
+	}
+	if _, err := io.Copy(a.file, io.NewSectionReader(src, i.Offset, end-i.Offset)); err != nil {
+		return err
+	}
+
+	if a.idx.end, err = a.file.Seek(0, io.SeekCurrent); err != nil {
+		return err
+	}
+	e := item.NewItem(&hdr)
+	e.Offset = pos + hdr.Len()
+	a.idx.items = append(a.idx.items, e)
+
+	return nil
+}
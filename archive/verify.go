@@ -0,0 +1,132 @@
+package archive
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/marcboeker/supertar/item"
+)
+
+// Report is the result of verifying an archive.
+type Report struct {
+	Items    int       `json:"items"`
+	Bytes    int64     `json:"bytes"`
+	Problems []Problem `json:"problems"`
+}
+
+// Problem describes an item or a region of the archive that could not
+// be verified. Path is empty if no item header could be read.
+type Problem struct {
+	Path   string `json:"path,omitempty"`
+	Offset int64  `json:"offset"`
+	Error  string `json:"error"`
+}
+
+// OK returns whether the verification did not find any problem.
+func (r Report) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// countWriter counts the bytes written to it.
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Verify reads every item of the archive by seeking from header to
+// header and decrypts and decompresses all chunks without writing them.
+// The number and order of the chunks, the size and the checksum of every
+// item are checked. The content of a solid item is checked by decrypting
+// its block. If a header cannot be read, the rest of the archive is
+// scanned up to its end like Salvage does, so that the unreadable regions
+// and the items behind them are reported as well. Every verified item is
+// sent to ch.
+func (a Archive) Verify(ch chan *item.Item) *Report {
+	if ch != nil {
+		defer func() {
+			close(ch)
+		}()
+	}
+
+	report := &Report{Problems: []Problem{}}
+	verify := func(i *item.Item, start int64) {
+		if ch != nil {
+			ch <- i
+		}
+		report.Items++
+
+		if i.Header.IsSolid() {
+			content, err := a.solidContent(i)
+			if err == nil {
+				err = i.ExtractSolid(bytes.NewReader(content), ioutil.Discard)
+			}
+			if err != nil {
+				report.Problems = append(report.Problems, Problem{Path: i.Header.Path, Offset: start, Error: err.Error()})
+			} else {
+				report.Bytes += i.Header.Size
+			}
+		} else if i.Header.Type() == item.ModeRegular && i.Header.Size > 0 {
+			cw := &countWriter{w: ioutil.Discard}
+			if err := i.Extract(a.file, cw, a.config); err != nil {
+				report.Problems = append(report.Problems, Problem{Path: i.Header.Path, Offset: start, Error: err.Error()})
+			} else if cw.n != i.Header.Size {
+				err := fmt.Errorf("size mismatch: expected %d, got %d", i.Header.Size, cw.n)
+				report.Problems = append(report.Problems, Problem{Path: i.Header.Path, Offset: start, Error: err.Error()})
+			}
+			report.Bytes += cw.n
+		} else if i.Header.Chunks != 0 {
+			err := fmt.Errorf("chunk count mismatch: expected 0, got %d", i.Header.Chunks)
+			report.Problems = append(report.Problems, Problem{Path: i.Header.Path, Offset: start, Error: err.Error()})
+		}
+	}
+
+	limit, err := a.scanLimit()
+	if err != nil {
+		report.Problems = append(report.Problems, Problem{Offset: a.start, Error: err.Error()})
+		return report
+	}
+
+	pos := a.start
+	err = a.iterateItems(func(i *item.Item) error {
+		verify(i, i.Offset-i.Header.Len())
+
+		// Continue after the last chunk even if the body is corrupt, as
+		// long as the chunk headers can be read.
+		pos = i.Offset
+		end := a.skipChunksAt(i, limit)
+		if end == 0 {
+			return io.ErrUnexpectedEOF
+		}
+		pos = end
+		_, err := a.file.Seek(pos, io.SeekStart)
+		return err
+	})
+	if err == nil && pos >= limit {
+		return report
+	}
+
+	// Scan the rest of the archive for the items behind the header,
+	// which could not be read.
+	err = a.scanRecords(pos, limit, report, func(pos, n int64) error {
+		return nil
+	}, func(i *item.Item, pos, end int64, err error) error {
+		if _, err := a.file.Seek(i.Offset, io.SeekStart); err != nil {
+			return err
+		}
+		verify(i, pos)
+		return nil
+	})
+	if err != nil {
+		report.Problems = append(report.Problems, Problem{Offset: pos, Error: err.Error()})
+	}
+
+	return report
+}
@@ -0,0 +1,477 @@
+package archive
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+
+	"github.com/marcboeker/supertar/config"
+	"github.com/marcboeker/supertar/crypto"
+)
+
+const (
+	recordVolume = 5
+
+	volumeSizeLength   = 8
+	volumeHeaderLength = recordHeaderLength + volumeSizeLength
+	volumeRecordLength = volumeHeaderLength + crypto.Overhead
+)
+
+// A volume record follows the header and the dictionary record of a
+// volume set, so that the volume size is known even if the set has a
+// single volume. It consists of the record header, the volume size (8
+// bytes) and an authentication tag over both. Volume sets written before
+// volume records were introduced use the size of their first volume.
+
+// encodeVolume returns the volume record of the given volume size.
+func encodeVolume(size int64, c *config.Config) []byte {
+	hdr := make([]byte, volumeHeaderLength)
+	hdr[recordMarkerLength] = recordVolume
+	binary.LittleEndian.PutUint64(hdr[recordHeaderLength:], uint64(size))
+
+	return append(hdr, c.Crypto.SealBytes(nil, hdr)...)
+}
+
+// readVolume reads the volume record from r and returns the volume size.
+func readVolume(r io.Reader, c *config.Config) (int64, error) {
+	buf := make([]byte, volumeRecordLength)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return 0, err
+	}
+	if recordType(buf) != recordVolume {
+		return 0, errInvalidVolume
+	}
+	if _, err := c.Crypto.OpenBytes(buf[volumeHeaderLength:], buf[:volumeHeaderLength]); err != nil {
+		return 0, errInvalidVolume
+	}
+
+	return int64(binary.LittleEndian.Uint64(buf[recordHeaderLength:])), nil
+}
+
+// loadVolume reads the volume record at pos, if there is one, and returns
+// the offset of the first item. The stored volume size is used unless a
+// volume size is set when opening the archive.
+func (a Archive) loadVolume(pos int64) (int64, error) {
+	typ, err := a.readRecordType(pos)
+	if err != nil || typ != recordVolume {
+		return pos, err
+	}
+
+	size, err := readVolume(io.NewSectionReader(a.file, pos, volumeRecordLength), a.config)
+	if err != nil {
+		return 0, err
+	}
+	if vs, ok := a.file.(*volumeSet); ok && a.config.VolumeSize == 0 {
+		a.config.VolumeSize = size
+		vs.size = size
+	}
+
+	return pos + volumeRecordLength, nil
+}
+
+// storage is the file an archive is stored in. It is either a single
+// file or a volume set.
+type storage interface {
+	io.ReadWriteSeeker
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+	Truncate(size int64) error
+	Sync() error
+	Stat() (os.FileInfo, error)
+}
+
+// volumePath returns the path of the nth volume of the archive at path.
+// Volumes are numbered from 1.
+func volumePath(path string, n int) string {
+	return fmt.Sprintf("%s.%03d", path, n)
+}
+
+// Exists returns whether an archive or the first volume of a volume set
+// exists at path.
+func Exists(path string) bool {
+	if _, err := os.Stat(path); err == nil {
+		return true
+	}
+	_, err := os.Stat(volumePath(path, 1))
+	return err == nil
+}
+
+// storagePath returns the path of the file, which the archive at path
+// starts with. This is the first volume of a volume set if it exists, or
+// if a volume size is given and the archive is created. Otherwise it is
+// path itself.
+func storagePath(path string, volumeSize int64, flag int) string {
+	first := volumePath(path, 1)
+	if _, err := os.Stat(first); err == nil {
+		return first
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) && volumeSize > 0 && flag&os.O_CREATE != 0 {
+		return first
+	}
+	return path
+}
+
+// openStorage opens the archive at path as a single file or as a volume
+// set, see storagePath. An existing single file cannot be split into
+// volumes.
+func openStorage(path string, volumeSize int64, flag int) (storage, error) {
+	if storagePath(path, volumeSize, flag) != path {
+		return openVolumes(path, volumeSize, flag)
+	}
+	if _, err := os.Stat(path); err == nil && volumeSize > 0 {
+		return nil, errNoVolumeSet
+	}
+
+	fh, err := os.OpenFile(path, flag, 0666)
+	if err != nil {
+		return nil, err
+	}
+	return fh, nil
+}
+
+// volumeSet joins the volumes foo.star.001, foo.star.002, ... of an
+// archive into a single file. Every volume is filled up to the volume
+// size before the next volume is created, so items can span volumes.
+// The offsets are based on the actual sizes of the volumes, so that the
+// volume size can be changed between writes.
+type volumeSet struct {
+	path  string
+	flag  int
+	size  int64 // maximum size of a volume, 0 if unlimited
+	files []*os.File
+	sizes []int64
+	dirty map[int]bool // volumes, which have to be synced
+	pos   int64
+}
+
+// openVolumes opens all volumes of the set at path. Without a volume
+// size, the size of the first volume is used if there is more than one,
+// until the volume record has been read, see loadVolume. Empty volumes
+// at the end of the set are removed.
+func openVolumes(path string, size int64, flag int) (_ *volumeSet, err error) {
+	v := &volumeSet{path: path, flag: flag, size: size, dirty: map[int]bool{}}
+	defer func() {
+		if err != nil {
+			v.Close()
+		}
+	}()
+
+	for n := 1; ; n++ {
+		fh, err := os.OpenFile(volumePath(path, n), flag&^os.O_CREATE, 0666)
+		if os.IsNotExist(err) && (n > 1 || flag&os.O_CREATE == 0) {
+			break
+		}
+		if os.IsNotExist(err) {
+			fh, err = os.OpenFile(volumePath(path, n), flag, 0666)
+		}
+		if err != nil {
+			return nil, err
+		}
+		v.files = append(v.files, fh)
+
+		stat, err := fh.Stat()
+		if err != nil {
+			return nil, err
+		}
+		v.sizes = append(v.sizes, stat.Size())
+	}
+	if len(v.files) == 0 {
+		return nil, &os.PathError{Op: "open", Path: volumePath(path, 1), Err: os.ErrNotExist}
+	}
+
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		for len(v.files) > 1 && v.sizes[len(v.files)-1] == 0 {
+			if err := v.removeLast(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if v.size == 0 && len(v.files) > 1 {
+		v.size = v.sizes[0]
+	}
+
+	return v, nil
+}
+
+// locate returns the volume and the offset in it of the given offset of
+// the set. The number of volumes is returned for offsets after the end
+// together with the distance to the end.
+func (v *volumeSet) locate(off int64) (int, int64) {
+	for i, s := range v.sizes {
+		if off < s {
+			return i, off
+		}
+		off -= s
+	}
+	return len(v.files), off
+}
+
+// totalSize returns the size of all volumes.
+func (v *volumeSet) totalSize() int64 {
+	var size int64
+	for _, s := range v.sizes {
+		size += s
+	}
+	return size
+}
+
+func (v *volumeSet) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		i, rel := v.locate(off + int64(n))
+		if i == len(v.files) {
+			return n, io.EOF
+		}
+
+		l := v.sizes[i] - rel
+		if l > int64(len(p)-n) {
+			l = int64(len(p) - n)
+		}
+		m, err := v.files[i].ReadAt(p[n:n+int(l)], rel)
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (v *volumeSet) WriteAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		i, rel := v.locate(off + int64(n))
+		if i == len(v.files) {
+			if rel > 0 {
+				return n, errVolumeGap
+			}
+			i = len(v.files) - 1
+			rel = v.sizes[i]
+			if v.size > 0 && rel >= v.size {
+				if err := v.addVolume(); err != nil {
+					return n, err
+				}
+				i, rel = i+1, 0
+			}
+		}
+
+		// Only the last volume grows, up to the volume size.
+		avail := v.sizes[i] - rel
+		if i == len(v.files)-1 {
+			if v.size == 0 {
+				avail = math.MaxInt64
+			} else if v.size > v.sizes[i] {
+				avail = v.size - rel
+			}
+		}
+
+		l := int64(len(p) - n)
+		if l > avail {
+			l = avail
+		}
+		m, err := v.files[i].WriteAt(p[n:n+int(l)], rel)
+		n += m
+		if end := rel + int64(m); end > v.sizes[i] {
+			v.sizes[i] = end
+		}
+		v.dirty[i] = true
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (v *volumeSet) Read(p []byte) (int, error) {
+	n, err := v.ReadAt(p, v.pos)
+	v.pos += int64(n)
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (v *volumeSet) Write(p []byte) (int, error) {
+	n, err := v.WriteAt(p, v.pos)
+	v.pos += int64(n)
+	return n, err
+}
+
+func (v *volumeSet) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += v.pos
+	case io.SeekEnd:
+		offset += v.totalSize()
+	}
+	if offset < 0 {
+		return 0, errNegativeOffset
+	}
+	v.pos = offset
+	return offset, nil
+}
+
+// Truncate truncates the set to the given size and removes all volumes,
+// which are not needed anymore.
+func (v *volumeSet) Truncate(size int64) error {
+	i, rel := v.locate(size)
+	if i == len(v.files) {
+		if rel == 0 {
+			return nil
+		}
+		i = len(v.files) - 1
+		rel += v.sizes[i]
+	}
+	if rel == 0 && i > 0 {
+		i, rel = i-1, v.sizes[i-1]
+	}
+
+	for len(v.files) > i+1 {
+		if err := v.removeLast(); err != nil {
+			return err
+		}
+	}
+
+	if err := v.files[i].Truncate(rel); err != nil {
+		return err
+	}
+	v.sizes[i] = rel
+	v.dirty[i] = true
+
+	return nil
+}
+
+// Sync syncs all modified volumes.
+func (v *volumeSet) Sync() error {
+	for i := range v.dirty {
+		if err := v.files[i].Sync(); err != nil {
+			return err
+		}
+		delete(v.dirty, i)
+	}
+	return nil
+}
+
+// Stat returns the info of the first volume with the size of the set.
+func (v *volumeSet) Stat() (os.FileInfo, error) {
+	stat, err := v.files[0].Stat()
+	if err != nil {
+		return nil, err
+	}
+	return volumeInfo{FileInfo: stat, size: v.totalSize()}, nil
+}
+
+func (v *volumeSet) Close() error {
+	var err error
+	for _, fh := range v.files {
+		if cerr := fh.Close(); err == nil {
+			err = cerr
+		}
+	}
+	v.files = nil
+	v.sizes = nil
+	return err
+}
+
+// addVolume creates the next volume of the set with the permissions and
+// the owner of the first volume.
+func (v *volumeSet) addVolume() error {
+	stat, err := v.files[0].Stat()
+	if err != nil {
+		return err
+	}
+	fh, err := os.OpenFile(volumePath(v.path, len(v.files)+1), v.flag|os.O_CREATE, stat.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if err := inheritMode(fh, stat); err != nil {
+		fh.Close()
+		return err
+	}
+	v.files = append(v.files, fh)
+	v.sizes = append(v.sizes, 0)
+	return nil
+}
+
+// removeLast removes the last volume of the set.
+func (v *volumeSet) removeLast() error {
+	n := len(v.files)
+	if err := v.files[n-1].Close(); err != nil {
+		return err
+	}
+	if err := os.Remove(volumePath(v.path, n)); err != nil {
+		return err
+	}
+	v.files = v.files[:n-1]
+	v.sizes = v.sizes[:n-1]
+	delete(v.dirty, n-1)
+	return nil
+}
+
+// volumeInfo is the file info of a volume set.
+type volumeInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (i volumeInfo) Size() int64 {
+	return i.size
+}
+
+// renameVolumes replaces the volumes of the set at path by the volumes of
+// the set at tmp. The first volume is renamed first, as it completes the
+// replacement. The set at tmp must have at least as many volumes as the
+// set at path, so that no volume of the old set is left behind.
+func renameVolumes(tmp, path string) error {
+	for n := 1; ; n++ {
+		err := os.Rename(volumePath(tmp, n), volumePath(path, n))
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// finishRename completes an interrupted replacement of the set at path by
+// the set at tmp. The replacement has begun if the first volume of tmp
+// has already been renamed.
+func finishRename(tmp, path string) error {
+	if _, err := os.Stat(volumePath(tmp, 1)); err == nil {
+		return nil
+	}
+
+	matches, err := filepath.Glob(tmp + ".[0-9][0-9][0-9]")
+	if err != nil || len(matches) == 0 {
+		return err
+	}
+
+	for n := 2; ; n++ {
+		err := os.Rename(volumePath(tmp, n), volumePath(path, n))
+		if os.IsNotExist(err) {
+			if _, err := os.Stat(volumePath(path, n)); err == nil {
+				// Renamed before the interruption.
+				continue
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+var (
+	errVolumeGap      = errors.New("cannot write behind the end of a volume set")
+	errNegativeOffset = errors.New("negative offset")
+	errInvalidVolume  = errors.New("volume record is invalid")
+	errNoVolumeSet    = errors.New("archive is a single file and cannot be split into volumes")
+)
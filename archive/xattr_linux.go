@@ -0,0 +1,87 @@
+package archive
+
+import (
+	"bytes"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// aclPrefix is the namespace in which Linux exposes POSIX ACLs as
+// extended attributes.
+const aclPrefix = "system.posix_acl_"
+
+// readXattrs returns the extended attributes and/or ACLs of the given
+// path. Links are not followed.
+func readXattrs(path string, xattrs, acls bool) (map[string][]byte, error) {
+	if !xattrs && !acls {
+		return nil, nil
+	}
+
+	size, err := unix.Llistxattr(path, nil)
+	if err != nil || size == 0 {
+		return nil, ignoreXattrErr(err)
+	}
+	buf := make([]byte, size)
+	if size, err = unix.Llistxattr(path, buf); err != nil {
+		return nil, ignoreXattrErr(err)
+	}
+
+	attrs := map[string][]byte{}
+	for _, name := range bytes.Split(buf[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+
+		isACL := strings.HasPrefix(string(name), aclPrefix)
+		if (isACL && !acls) || (!isACL && !xattrs) {
+			continue
+		}
+
+		value, err := readXattr(path, string(name))
+		if err != nil {
+			return nil, err
+		}
+		attrs[string(name)] = value
+	}
+
+	return attrs, nil
+}
+
+func readXattr(path, name string) ([]byte, error) {
+	size, err := unix.Lgetxattr(path, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	size, err = unix.Lgetxattr(path, name, buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:size], nil
+}
+
+// writeXattrs restores the extended attributes and/or ACLs of the
+// given path. Attributes that are not supported by the target file
+// system or require privileges are skipped.
+func writeXattrs(path string, attrs map[string][]byte, xattrs, acls bool) error {
+	for name, value := range attrs {
+		isACL := strings.HasPrefix(name, aclPrefix)
+		if (isACL && !acls) || (!isACL && !xattrs) {
+			continue
+		}
+
+		if err := unix.Lsetxattr(path, name, value, 0); ignoreXattrErr(err) != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func ignoreXattrErr(err error) error {
+	if err == unix.ENOTSUP || err == unix.EPERM {
+		return nil
+	}
+	return err
+}
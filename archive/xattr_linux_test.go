@@ -0,0 +1,42 @@
+package archive
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/marcboeker/supertar/item"
+	"golang.org/x/sys/unix"
+)
+
+func (s *ArchiveTestSuite) TestXattrs() {
+	src := filepath.Join(s.tmpDir, "archive-xattr-src")
+	s.Require().NoError(os.MkdirAll(src, os.ModePerm))
+	defer os.RemoveAll(src)
+
+	file := filepath.Join(src, "foo.txt")
+	s.Require().NoError(ioutil.WriteFile(file, []byte("eekeek"), 0644))
+	if err := unix.Setxattr(file, "user.supertar", []byte("bar"), 0); err != nil {
+		s.T().Skipf("file system does not support xattrs: %s", err)
+	}
+
+	s.config.Xattrs = true
+	err := s.arch.AddRecursive(s.tmpDir, src, nil)
+	s.Assert().NoError(err)
+
+	path := filepath.Join(s.tmpDir, "archive-xattr-test")
+	defer os.RemoveAll(path)
+
+	ch := make(chan *item.Item)
+	go func() {
+		for range ch {
+		}
+	}()
+
+	err = s.arch.Extract(ch, path)
+	s.Assert().NoError(err)
+
+	value, err := readXattr(filepath.Join(path, "archive-xattr-src", "foo.txt"), "user.supertar")
+	s.Assert().NoError(err)
+	s.Assert().Equal([]byte("bar"), value)
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package archive
+
+// readXattrs is only supported on Linux.
+func readXattrs(path string, xattrs, acls bool) (map[string][]byte, error) {
+	return nil, nil
+}
+
+// writeXattrs is only supported on Linux.
+func writeXattrs(path string, attrs map[string][]byte, xattrs, acls bool) error {
+	return nil
+}
@@ -2,8 +2,10 @@ package cmd
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
@@ -11,6 +13,7 @@ import (
 	"syscall"
 
 	"github.com/marcboeker/supertar/archive"
+	"github.com/marcboeker/supertar/compress"
 	"github.com/marcboeker/supertar/config"
 	"github.com/marcboeker/supertar/item"
 	"github.com/marcboeker/supertar/server"
@@ -22,35 +25,96 @@ func init() {
 	RootCmd.AddCommand(createCmd)
 	RootCmd.AddCommand(listCmd)
 	RootCmd.AddCommand(extractCmd)
+	RootCmd.AddCommand(catCmd)
 	RootCmd.AddCommand(addCmd)
 	RootCmd.AddCommand(deleteCmd)
 	RootCmd.AddCommand(moveCmd)
 	RootCmd.AddCommand(compactCmd)
+	RootCmd.AddCommand(retrainCmd)
+	RootCmd.AddCommand(upgradeCmd)
+	RootCmd.AddCommand(verifyCmd)
+	RootCmd.AddCommand(repairCmd)
 	RootCmd.AddCommand(serveCmd)
 	RootCmd.AddCommand(updatePwdCmd)
 
 	RootCmd.PersistentFlags().StringVarP(&archiveFile, "file", "f", "", "archive file (*.star)")
 	RootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "verbose output")
-	createCmd.PersistentFlags().BoolVarP(&useCompression, "compression", "c", false, "enable compression")
+	RootCmd.PersistentFlags().BoolVarP(&waitLock, "wait", "", true, "wait if the archive is locked by another process")
+	RootCmd.PersistentFlags().BoolVarP(&noWaitLock, "no-wait", "", false, "fail if the archive is locked by another process")
+	createCmd.PersistentFlags().StringVarP(&compressionAlg, "compression", "c", compress.None.String(), "Compression codec ("+strings.Join(compress.Names(), ", ")+"), -c selects "+compress.Zstd.String())
+	createCmd.PersistentFlags().Lookup("compression").NoOptDefVal = compress.Zstd.String()
 	createCmd.PersistentFlags().IntVarP(&chunkSize, "chunk-size", "", defaultChunkSize, "Chunk size in bytes")
+	createCmd.Flags().BoolVarP(&useDict, "dict", "", false, "Train a zstd dictionary from the files and compress all chunks with it")
+	for _, c := range []*cobra.Command{createCmd, retrainCmd} {
+		c.Flags().IntVarP(&dictSize, "dict-size", "", archive.DefaultDictSize, "Size of the trained dictionary in bytes")
+	}
+	for _, c := range []*cobra.Command{createCmd, addCmd} {
+		c.Flags().IntVarP(&level, "level", "", 0, "Compression level, 0 selects the level of the archive or the default level of the codec")
+		c.Flags().IntVarP(&threads, "threads", "", 1, "Number of chunks to compress and encrypt in parallel")
+		c.Flags().StringSliceVarP(&noCompress, "no-compress", "", nil, "Store files matching the name or MIME type patterns without compression, e.g. *.jpg,video/*")
+		c.Flags().BoolVarP(&solid, "solid", "", false, "Pack small files into shared blocks, which are compressed and encrypted together")
+		c.Flags().Int64VarP(&volumeSize, "volume-size", "", 0, "Split the archive into volumes of the given size in bytes")
+		c.Flags().BoolVarP(&skipSpecial, "skip-special", "", false, "Skip FIFOs and device files")
+	}
+	for _, c := range []*cobra.Command{createCmd, addCmd, extractCmd} {
+		c.Flags().BoolVarP(&useXattrs, "xattrs", "", false, "Store/restore extended attributes")
+		c.Flags().BoolVarP(&useACLs, "acls", "", false, "Store/restore POSIX ACLs")
+	}
+	listCmd.Flags().StringVarP(&listOpts.Time, "time", "", "mtime", "Timestamp to show (mtime, atime or ctime)")
+	listCmd.Flags().BoolVarP(&listOpts.FullTime, "full-time", "", false, "Show timestamps with nanoseconds")
+	listCmd.Flags().BoolVarP(&listOpts.Checksum, "checksum", "", false, "Show the SHA-256 checksum of files")
+	extractCmd.Flags().IntVarP(&threads, "threads", "", 1, "Number of files to extract in parallel")
+	extractCmd.Flags().BoolVarP(&sameOwner, "same-owner", "", false, "Restore the owner of extracted items (root only)")
+	extractCmd.Flags().BoolVarP(&numericOwner, "numeric-owner", "", false, "Restore the owner by numeric IDs instead of names (root only)")
+	catCmd.Flags().Int64VarP(&catOffset, "offset", "", 0, "Offset of the first byte to write")
+	catCmd.Flags().Int64VarP(&catLength, "length", "", -1, "Number of bytes to write, -1 writes up to the end")
+	compactCmd.Flags().BoolVarP(&resumeCompact, "resume", "", false, "Resume an interrupted compaction")
 	serveCmd.Flags().StringVarP(&bindAddr, "bind-addr", "", defaultBindAddr, "Bind address")
 }
 
 const (
 	defaultChunkSize = 1024 * 1024 * 4
 	minChunkSize     = 1024 * 64
+	minVolumeSize    = 1024 * 64
 	defaultBindAddr  = "localhost:1337"
 )
 
 var (
 	arch           *archive.Archive
 	archiveFile    string
-	useCompression bool
+	compressionAlg string
+	level          int
+	noCompress     []string
+	solid          bool
+	useDict        bool
+	dictSize       int
 	verbose        bool
 	chunkSize      int
+	volumeSize     int64
+	threads        int
 	bindAddr       string
+	skipSpecial    bool
+	useXattrs      bool
+	useACLs        bool
+	sameOwner      bool
+	numericOwner   bool
+	listOpts       item.ListOptions
+	resumeCompact  bool
+	catOffset      int64
+	catLength      int64
+	waitLock       bool
+	noWaitLock     bool
+
+	// readOnlyCmds open the archive with a shared lock.
+	readOnlyCmds = map[string]bool{"list": true, "extract": true, "cat": true, "verify": true, "repair": true, "serve": true}
+	// streamCmds support reading from stdin or writing to stdout.
+	streamCmds = map[string]bool{"create": true, "list": true, "extract": true}
 )
 
+// stdinArchive is the archive file name to write an archive to stdout or
+// to read it from stdin.
+const stdinArchive = "-"
+
 // RootCmd is the main command that is always executed.
 var RootCmd = &cobra.Command{
 	Use: "",
@@ -62,21 +126,57 @@ var RootCmd = &cobra.Command{
 		if len(archiveFile) == 0 {
 			exitWithErr(errNoArchiveFile)
 		}
-		archiveFile = fixArchivePath(archiveFile)
 
-		if cmd.Name() == "create" {
-			if archiveExists(archiveFile) {
-				exitWithErr(errArchiveExists)
+		streaming := archiveFile == stdinArchive
+		if streaming {
+			if !streamCmds[cmd.Name()] {
+				exitWithErr(errStreamNotSupported)
 			}
 		} else {
-			if !archiveExists(archiveFile) {
-				exitWithErr(errArchiveDoesNotExist)
+			archiveFile = fixArchivePath(archiveFile)
+
+			if cmd.Name() == "create" {
+				if archiveExists(archiveFile) {
+					exitWithErr(errArchiveExists)
+				}
+			} else {
+				if !archiveExists(archiveFile) {
+					exitWithErr(errArchiveDoesNotExist)
+				}
 			}
 		}
 
 		if chunkSize < minChunkSize {
 			exitWithErr(errInvalidChunkSize)
 		}
+		if threads < 1 && (cmd.Name() == "create" || cmd.Name() == "add" || cmd.Name() == "extract") {
+			exitWithErr(errInvalidThreads)
+		}
+		if volumeSize != 0 && (volumeSize < minVolumeSize || streaming) {
+			exitWithErr(errInvalidVolumeSize)
+		}
+
+		codec, err := compress.Parse(compressionAlg)
+		if err != nil {
+			exitWithErr(errInvalidCompression)
+		}
+		if cmd.Name() == "create" && compress.CheckLevel(codec, level) != nil {
+			exitWithErr(errInvalidLevel)
+		}
+
+		var dict []byte
+		if cmd.Name() == "create" && useDict && len(args) > 0 {
+			if codec != compress.Zstd {
+				exitWithErr(errDictCodec)
+			}
+			samples, err := archive.SampleFiles(args[:1])
+			if err != nil {
+				exitWithErr(err)
+			}
+			if dict, err = compress.TrainDict(samples, dictSize); err != nil {
+				exitWithErr(err)
+			}
+		}
 
 		envPwd := os.Getenv("PASSWORD")
 		password := []byte(envPwd)
@@ -94,19 +194,52 @@ var RootCmd = &cobra.Command{
 		config := config.Config{
 			Path:        archiveFile,
 			Password:    password,
-			Compression: useCompression,
+			Compression: codec != compress.None,
+			Codec:       codec,
+			Level:       level,
+			Dict:        dict,
+			NoCompress:  noCompress,
+			Solid:       solid,
 			ChunkSize:   chunkSize,
+			VolumeSize:  volumeSize,
+			Threads:     threads,
+
+			SkipSpecial:  skipSpecial,
+			Xattrs:       useXattrs,
+			ACLs:         useACLs,
+			SameOwner:    sameOwner,
+			NumericOwner: numericOwner,
+
+			ReadOnly: readOnlyCmds[cmd.Name()],
+		}
+
+		if streaming {
+			if cmd.Name() == "create" {
+				arch, err = archive.NewStreamWriter(os.Stdout, &config)
+			} else {
+				arch, err = archive.NewStreamReader(os.Stdin, &config)
+			}
+			if err != nil {
+				exitWithErr(err)
+			}
+			return
 		}
 
-		var err error
 		arch, err = archive.NewArchive(&config)
+		if lerr, ok := err.(*archive.LockedError); ok && waitLock && !noWaitLock {
+			fmt.Fprintf(os.Stderr, "Waiting, %s\n", lerr)
+			config.Wait = true
+			arch, err = archive.NewArchive(&config)
+		}
 		if err != nil {
 			exitWithErr(err)
 		}
 	},
 	PersistentPostRun: func(cmd *cobra.Command, args []string) {
 		if arch != nil {
-			arch.Close()
+			if err := arch.Close(); err != nil {
+				exitWithErr(err)
+			}
 		}
 	},
 }
@@ -116,7 +249,15 @@ var createCmd = &cobra.Command{
 	Short: "Create an archive from the given files",
 	Example: `create -cf foo_compressed.star /home/bar
 create -f foo_uncompressed.star /home/bar/baz.txt
-create -cf foo_uncompressed.star --chunk-size 4 /home/bar/baz.txt`,
+create -cf foo_uncompressed.star --chunk-size 4 /home/bar/baz.txt
+create -f foo.star --volume-size 1073741824 /home/bar
+create -cf foo.star --threads 8 /home/bar
+create -f foo.star --compression=xz /home/bar
+create -f foo.star --compression=zstd --level 19 /home/bar
+create -cf foo.star --no-compress=*.jpg,*.mp4,video/* /home/bar
+create -cf foo.star --dict /home/bar/etc
+create -cf foo.star --solid /home/bar/src
+create -f - /home/bar | ssh host 'cat > backup.star'`,
 	Args: cobra.MinimumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		cwd, _ := os.Getwd()
@@ -133,22 +274,29 @@ create -cf foo_uncompressed.star --chunk-size 4 /home/bar/baz.txt`,
 				for {
 					select {
 					case p := <-ch:
-						fmt.Printf("+ %s\n", p)
+						// Stdout may be the archive itself.
+						fmt.Fprintf(os.Stderr, "+ %s\n", p)
 					}
 				}
 			}()
 		}
 
 		basePath := filepath.Dir(path)
-		arch.AddRecursive(basePath, path, ch)
+		if err := arch.AddRecursive(basePath, path, ch); err != nil {
+			exitWithErr(err)
+		}
 	},
 }
 
 var listCmd = &cobra.Command{
 	Use:     "list <pattern>",
 	Short:   "List all items in the archive",
-	Example: "list -f foo.star *.txt\nlist -f foo.star tmp*",
+	Example: "list -f foo.star *.txt\nlist -f foo.star tmp*\nlist -f foo.star --time atime --full-time\nlist -f foo.star --checksum\ncurl https://example.com/foo.star | list -f -",
 	Run: func(cmd *cobra.Command, args []string) {
+		if listOpts.Time != "mtime" && listOpts.Time != "atime" && listOpts.Time != "ctime" {
+			exitWithErr(errInvalidTime)
+		}
+
 		wg := sync.WaitGroup{}
 		wg.Add(1)
 
@@ -157,7 +305,7 @@ var listCmd = &cobra.Command{
 			for {
 				i, more := <-ch
 				if more {
-					fmt.Println(i.Header.ToString())
+					fmt.Println(i.Header.Format(listOpts))
 				} else {
 					wg.Done()
 					return
@@ -180,7 +328,7 @@ var listCmd = &cobra.Command{
 var extractCmd = &cobra.Command{
 	Use:     "extract",
 	Short:   "Extract an archive to a given location",
-	Example: "extract -f foo.star /home/bar",
+	Example: "extract -f foo.star /home/bar\nextract -f foo.star --same-owner /home/bar\nextract -f foo.star --threads 16 /home/bar\nssh host 'cat backup.star' | extract -f - /home/bar",
 	Args:    cobra.MinimumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		wg := sync.WaitGroup{}
@@ -216,10 +364,36 @@ var extractCmd = &cobra.Command{
 	},
 }
 
+var catCmd = &cobra.Command{
+	Use:     "cat <path>",
+	Short:   "Write the content of a file in the archive to stdout",
+	Long:    "Only the chunks holding the requested range are read and decrypted, so a part of a large file is written without extracting it.",
+	Example: "cat -f foo.star home/bar/baz.txt\ncat -f foo.star --offset 1048576 --length 512 home/bar/video.mp4",
+	Args:    cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		r, err := arch.Open(args[0])
+		if err != nil {
+			exitWithErr(err)
+		}
+		defer r.Close()
+
+		if _, err := r.Seek(catOffset, io.SeekStart); err != nil {
+			exitWithErr(err)
+		}
+		var src io.Reader = r
+		if catLength >= 0 {
+			src = io.LimitReader(r, catLength)
+		}
+		if _, err := io.Copy(os.Stdout, src); err != nil {
+			exitWithErr(err)
+		}
+	},
+}
+
 var addCmd = &cobra.Command{
 	Use:     "add <pattern>",
 	Short:   "Add files to the archive",
-	Example: "add -f foo.star /home/bar/baz.txt\nadd -f foo.star /home/blah",
+	Example: "add -f foo.star /home/bar/baz.txt\nadd -f foo.star /home/blah\nadd -f foo.star --volume-size 1073741824 /home/blah\nadd -f foo.star --level 1 /home/blah",
 	Args:    cobra.MinimumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		cwd, _ := os.Getwd()
@@ -251,7 +425,9 @@ var addCmd = &cobra.Command{
 			}()
 		}
 
-		arch.AddRecursive(basePath, path, ch)
+		if err := arch.AddRecursive(basePath, path, ch); err != nil {
+			exitWithErr(err)
+		}
 	},
 }
 
@@ -326,11 +502,106 @@ var moveCmd = &cobra.Command{
 var compactCmd = &cobra.Command{
 	Use:     "compact",
 	Short:   "Remove deleted items from the archive",
-	Example: "compact -f foo.star",
+	Example: "compact -f foo.star\ncompact -f foo.star --resume",
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := arch.Compact(resumeCompact); err != nil {
+			exitWithErr(err)
+		}
+	},
+}
+
+var retrainCmd = &cobra.Command{
+	Use:     "retrain",
+	Short:   "Train a new compression dictionary and recompress all items",
+	Long:    "Trains a new zstd dictionary from the files in the archive and recompresses all items with it. Deleted items are removed like by compact.",
+	Example: "retrain -f foo.star\nretrain -f foo.star --dict-size 65536",
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := arch.Retrain(dictSize); err != nil {
+			exitWithErr(err)
+		}
+	},
+}
+
+var upgradeCmd = &cobra.Command{
+	Use:     "upgrade",
+	Short:   "Upgrade an archive to the current format version",
+	Long:    "Rewrites the item headers of an archive written by an older version of supertar in the current format. The content is copied without decrypting it. Deleted items are removed like by compact.",
+	Example: "upgrade -f old.star",
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := arch.Upgrade(); err != nil {
+			exitWithErr(err)
+		}
+	},
+}
+
+var verifyCmd = &cobra.Command{
+	Use:     "verify",
+	Short:   "Verify all items of the archive without extracting them",
+	Long:    "Decrypts and decompresses all items and checks their chunks, sizes and checksums. A JSON report is written to stdout and the exit code is 1 if any problem was found.",
+	Example: "verify -f foo.star",
+	Run: func(cmd *cobra.Command, args []string) {
+		var ch chan *item.Item
+		if verbose {
+			ch = make(chan *item.Item)
+			go func() {
+				for i := range ch {
+					fmt.Fprintln(os.Stderr, i.Header.ToString())
+				}
+			}()
+		}
+
+		report := arch.Verify(ch)
+
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			exitWithErr(err)
+		}
+
+		if !report.OK() {
+			arch.Close()
+			os.Exit(1)
+		}
+	},
+}
+
+var repairCmd = &cobra.Command{
+	Use:     "repair <target>",
+	Short:   "Recover all intact items of a damaged archive into a new archive",
+	Long:    "Scans the damaged archive for intact items, also behind damaged regions, and writes them to a new archive with the same password. A JSON report of the lost items and regions is written to stdout and the exit code is 1 if anything was lost.",
+	Example: "repair -f broken.star fixed.star",
+	Args:    cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
-		if err := arch.Compact(); err != nil {
+		target := args[0]
+		if archiveExists(target) {
+			exitWithErr(errArchiveExists)
+		}
+
+		var ch chan *item.Item
+		if verbose {
+			ch = make(chan *item.Item)
+			go func() {
+				for i := range ch {
+					fmt.Fprintln(os.Stderr, i.Header.ToString())
+				}
+			}()
+		}
+
+		report, err := arch.Salvage(target, ch)
+		if err != nil {
 			exitWithErr(err)
 		}
+
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			exitWithErr(err)
+		}
+
+		if !report.OK() {
+			arch.Close()
+			os.Exit(1)
+		}
 	},
 }
 
@@ -362,22 +633,32 @@ var updatePwdCmd = &cobra.Command{
 	},
 }
 
+// readPassword prompts for a password on the terminal. The prompt is
+// written to stderr and the terminal is opened directly if stdin is not
+// a terminal, as stdin and stdout may be used by an archive stream.
 func readPassword(desc string) []byte {
-	fmt.Printf("%s: ", desc)
-	key, err := terminal.ReadPassword(int(syscall.Stdin))
+	fd := int(syscall.Stdin)
+	if !terminal.IsTerminal(fd) {
+		tty, err := os.Open("/dev/tty")
+		if err != nil {
+			return nil
+		}
+		defer tty.Close()
+		fd = int(tty.Fd())
+	}
+
+	fmt.Fprintf(os.Stderr, "%s: ", desc)
+	key, err := terminal.ReadPassword(fd)
 	if err != nil {
 		return nil
 	}
-	fmt.Println("")
+	fmt.Fprintln(os.Stderr, "")
 
 	return key
 }
 
 func archiveExists(path string) bool {
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		return false
-	}
-	return true
+	return archive.Exists(path)
 }
 
 func fixArchivePath(path string) string {
@@ -390,7 +671,7 @@ func fixArchivePath(path string) string {
 }
 
 func exitWithErr(err error) {
-	fmt.Printf("Error: %s\n", err.Error())
+	fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
 	os.Exit(1)
 }
 
@@ -401,4 +682,11 @@ var (
 	errPWDoNotMatch        = errors.New("Passwords do not match")
 	errInvalidChunkSize    = errors.New("Chunk size smaller than 64kb")
 	errInvalidPath         = errors.New("Invalid path")
+	errInvalidTime         = errors.New("Invalid time, must be mtime, atime or ctime")
+	errInvalidVolumeSize   = errors.New("Volume size smaller than 64kb or used with a stream")
+	errInvalidCompression  = errors.New("Invalid compression codec, must be one of " + strings.Join(compress.Names(), ", "))
+	errInvalidLevel        = errors.New("Invalid compression level for the codec")
+	errDictCodec           = errors.New("Dictionaries require --compression=zstd")
+	errInvalidThreads      = errors.New("Number of threads must be at least 1")
+	errStreamNotSupported  = errors.New("Command does not support reading or writing the archive as a stream")
 )
@@ -1,16 +1,139 @@
 package compress
 
 import (
-	"github.com/DataDog/zstd"
+	"errors"
+	"sort"
 )
 
-// Decompress decompresses a byte stream to the given destination.
+// ID identifies a codec in the archive header.
+type ID byte
+
+// IDs of all codecs. They are stored in the archive, so they must never
+// change.
+const (
+	None ID = iota
+	Zstd
+	LZ4
+	Gzip
+	XZ
+)
+
+// MaxLevel is the highest level, which can be stored in an archive.
+const MaxLevel = 31
+
+// Codec compresses and decompresses chunks. A codec must be safe for
+// concurrent use.
+type Codec interface {
+	// Compress compresses src with the given level. Level 0 selects the
+	// default level of the codec.
+	Compress(src []byte, level int) ([]byte, error)
+	Decompress(src []byte) ([]byte, error)
+	// MaxLevel returns the highest level or 0 if the codec has no levels.
+	MaxLevel() int
+}
+
+type codec struct {
+	name  string
+	codec Codec
+}
+
+var codecs = map[ID]codec{}
+
+// Register registers a codec with the given ID and name.
+func Register(id ID, name string, c Codec) {
+	codecs[id] = codec{name: name, codec: c}
+}
+
+// Lookup returns the codec with the given ID.
+func Lookup(id ID) (Codec, error) {
+	c, ok := codecs[id]
+	if !ok || id == None {
+		return nil, ErrUnknownCodec
+	}
+	return c.codec, nil
+}
+
+// Parse returns the ID of the codec with the given name.
+func Parse(name string) (ID, error) {
+	if name == None.String() {
+		return None, nil
+	}
+	for id, c := range codecs {
+		if c.name == name {
+			return id, nil
+		}
+	}
+	return None, ErrUnknownCodec
+}
+
+// CheckLevel returns an error if the codec does not support the given
+// level. Level 0 is always supported.
+func CheckLevel(id ID, level int) error {
+	if level == 0 {
+		return nil
+	}
+
+	max := 0
+	if c, ok := codecs[id]; ok && id != None {
+		max = c.codec.MaxLevel()
+	}
+	if level < 0 || level > max || level > MaxLevel {
+		return ErrInvalidLevel
+	}
+	return nil
+}
+
+// ClampLevel returns the given level limited to the highest level of the
+// codec.
+func ClampLevel(c Codec, level int) int {
+	if max := c.MaxLevel(); level > max {
+		return max
+	}
+	return level
+}
+
+// String returns the name of the codec.
+func (id ID) String() string {
+	if id == None {
+		return "none"
+	}
+	if c, ok := codecs[id]; ok {
+		return c.name
+	}
+	return "unknown"
+}
+
+// Names returns the names of all codecs ordered by their ID.
+func Names() []string {
+	ids := make([]int, 0, len(codecs))
+	for id := range codecs {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+
+	names := []string{None.String()}
+	for _, id := range ids {
+		names = append(names, ID(id).String())
+	}
+	return names
+}
+
+// Decompress decompresses a byte stream to the given destination using
+// Zstandard.
 func Decompress(src []byte) ([]byte, error) {
-	return zstd.Decompress(nil, src)
+	return codecs[Zstd].codec.Decompress(src)
 }
 
-// Compress compresses a byte stream to the given destination.
+// Compress compresses a byte stream to the given destination using
+// Zstandard.
 func Compress(src []byte) []byte {
-	buf, _ := zstd.Compress(nil, src)
+	buf, _ := codecs[Zstd].codec.Compress(src, 0)
 	return buf
 }
+
+var (
+	// ErrUnknownCodec is returned for codecs which are not registered.
+	ErrUnknownCodec = errors.New("unknown compression codec")
+	// ErrInvalidLevel is returned for levels not supported by a codec.
+	ErrInvalidLevel = errors.New("invalid compression level")
+)
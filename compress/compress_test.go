@@ -1,6 +1,8 @@
 package compress
 
 import (
+	"bytes"
+	"fmt"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -16,3 +18,102 @@ func TestCompress(t *testing.T) {
 
 	assert.Equal(t, data, text)
 }
+
+func TestCodecs(t *testing.T) {
+	text := bytes.Repeat([]byte("hello"), 1000)
+	for _, name := range Names()[1:] {
+		id, err := Parse(name)
+		assert.NoError(t, err)
+		assert.Equal(t, name, id.String())
+
+		c, err := Lookup(id)
+		assert.NoError(t, err)
+
+		out, err := c.Compress(text, 0)
+		assert.NoError(t, err, name)
+		assert.True(t, len(out) < len(text), name)
+
+		data, err := c.Decompress(out)
+		assert.NoError(t, err, name)
+		assert.Equal(t, text, data, name)
+	}
+
+	assert.Equal(t, []string{"none", "zstd", "lz4", "gzip", "xz"}, Names())
+
+	_, err := Lookup(None)
+	assert.Equal(t, ErrUnknownCodec, err)
+	_, err = Parse("rar")
+	assert.Equal(t, ErrUnknownCodec, err)
+}
+
+func TestLevels(t *testing.T) {
+	text := bytes.Repeat([]byte("hello world "), 1000)
+	for _, id := range []ID{Zstd, Gzip} {
+		c, err := Lookup(id)
+		assert.NoError(t, err)
+
+		for _, level := range []int{1, c.MaxLevel()} {
+			assert.NoError(t, CheckLevel(id, level))
+			out, err := c.Compress(text, level)
+			assert.NoError(t, err)
+			data, err := c.Decompress(out)
+			assert.NoError(t, err)
+			assert.Equal(t, text, data)
+		}
+		assert.Equal(t, ErrInvalidLevel, CheckLevel(id, c.MaxLevel()+1))
+	}
+
+	// Archives written by cgo and pure Go builds accept the same levels.
+	c, err := Lookup(Zstd)
+	assert.NoError(t, err)
+	g, err := newZstdGo(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, g.MaxLevel(), c.MaxLevel())
+
+	assert.Equal(t, c.MaxLevel(), ClampLevel(c, MaxLevel))
+	assert.Equal(t, 3, ClampLevel(c, 3))
+
+	assert.NoError(t, CheckLevel(LZ4, 0))
+	assert.Equal(t, ErrInvalidLevel, CheckLevel(LZ4, 1))
+	assert.Equal(t, ErrInvalidLevel, CheckLevel(None, 1))
+	assert.Equal(t, ErrInvalidLevel, CheckLevel(Zstd, -1))
+}
+
+func TestDict(t *testing.T) {
+	var samples [][]byte
+	for n := 0; n < 200; n++ {
+		samples = append(samples, []byte(fmt.Sprintf("[server]\nname = host%d\nport = %d\nenabled = true\n", n, 8000+n)))
+	}
+
+	dict, err := TrainDict(samples, 4096)
+	assert.NoError(t, err)
+	assert.True(t, len(dict) <= 4096+1024)
+
+	c, err := WithDict(Zstd, dict)
+	assert.NoError(t, err)
+	same, err := WithDict(Zstd, dict)
+	assert.NoError(t, err)
+	assert.Equal(t, c, same)
+
+	text := []byte("[server]\nname = host1234\nport = 9234\nenabled = true\n")
+	plain, err := codecs[Zstd].codec.Compress(text, 0)
+	assert.NoError(t, err)
+	out, err := c.Compress(text, 0)
+	assert.NoError(t, err)
+	assert.True(t, len(out) < len(plain))
+
+	data, err := c.Decompress(out)
+	assert.NoError(t, err)
+	assert.Equal(t, text, data)
+
+	// Identical samples are matched completely by the dictionary.
+	_, err = TrainDict([][]byte{text, text, text}, 4096)
+	assert.NoError(t, err)
+
+	_, err = WithDict(Gzip, dict)
+	assert.Equal(t, ErrDictNotSupported, err)
+	_, err = TrainDict(nil, 4096)
+	assert.Equal(t, ErrNoSamples, err)
+	_, err = TrainDict(samples, 1)
+	assert.Equal(t, ErrInvalidDictSize, err)
+}
@@ -0,0 +1,120 @@
+package compress
+
+import (
+	"errors"
+	"hash/crc32"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// minDictSize is the smallest dictionary, which can be trained.
+	minDictSize = 256
+	// maxDictSize is the largest dictionary, which can be trained.
+	maxDictSize = 1024 * 1024
+	// minSampleLength is the least number of bytes taken from a sample.
+	minSampleLength = 64
+)
+
+var (
+	dictMu     sync.Mutex
+	dictCodecs = map[string]Codec{}
+)
+
+// WithDict returns a codec, which compresses and decompresses with the
+// given dictionary. Only Zstandard supports dictionaries. Dictionaries
+// are always handled by the pure Go implementation, whose frames can be
+// decompressed by the C library as well.
+func WithDict(id ID, dict []byte) (Codec, error) {
+	if id != Zstd {
+		return nil, ErrDictNotSupported
+	}
+
+	dictMu.Lock()
+	defer dictMu.Unlock()
+
+	if c, ok := dictCodecs[string(dict)]; ok {
+		return c, nil
+	}
+	c, err := newZstdGo(dict)
+	if err != nil {
+		return nil, err
+	}
+	dictCodecs[string(dict)] = c
+
+	return c, nil
+}
+
+// TrainDict builds a Zstandard dictionary of at most size bytes from the
+// given samples. The content of the dictionary is taken evenly from the
+// beginning of all samples, the entropy tables are computed from the
+// complete samples.
+func TrainDict(samples [][]byte, size int) ([]byte, error) {
+	if size < minDictSize || size > maxDictSize {
+		return nil, ErrInvalidDictSize
+	}
+
+	var nonEmpty [][]byte
+	for _, s := range samples {
+		if len(s) > 0 {
+			nonEmpty = append(nonEmpty, s)
+		}
+	}
+	if len(nonEmpty) == 0 {
+		return nil, ErrNoSamples
+	}
+
+	// At most the first half of every sample is taken, so that the
+	// entropy tables are not computed from content which is completely
+	// part of the dictionary.
+	per := size / len(nonEmpty)
+	if per < minSampleLength {
+		per = minSampleLength
+	}
+	var hist []byte
+	for _, s := range nonEmpty {
+		if n := (len(s) + 1) / 2; n < per {
+			s = s[:n]
+		} else {
+			s = s[:per]
+		}
+		if len(hist)+len(s) > size {
+			s = s[:size-len(hist)]
+		}
+		hist = append(hist, s...)
+		if len(hist) == size {
+			break
+		}
+	}
+	if len(hist) < minSampleLength {
+		return nil, ErrNoSamples
+	}
+
+	// IDs below 32768 are reserved for registered dictionaries.
+	id := 32768 + crc32.ChecksumIEEE(hist)%(1<<31-32768)
+
+	// A sample of all byte values lets the literal table cover every
+	// byte, even if the samples repeat each other.
+	all := make([]byte, 256)
+	for n := range all {
+		all[n] = byte(n)
+	}
+
+	return zstd.BuildDict(zstd.BuildDictOptions{
+		ID:       id,
+		Contents: append(nonEmpty, all),
+		History:  hist,
+		Offsets:  [3]int{1, 4, 8},
+	})
+}
+
+var (
+	// ErrDictNotSupported is returned for codecs without dictionaries.
+	ErrDictNotSupported = errors.New("compression codec does not support dictionaries")
+	// ErrInvalidDictSize is returned for dictionary sizes out of range.
+	ErrInvalidDictSize = errors.New("invalid dictionary size")
+	// ErrNoSamples is returned if there is not enough data to train a
+	// dictionary.
+	ErrNoSamples = errors.New("not enough samples to train a dictionary")
+)
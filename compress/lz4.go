@@ -0,0 +1,25 @@
+package compress
+
+import (
+	"github.com/bkaradzic/go-lz4"
+)
+
+func init() {
+	Register(LZ4, "lz4", lz4Codec{})
+}
+
+// lz4Codec stores an LZ4 block prefixed with the length of the
+// uncompressed data (4 bytes).
+type lz4Codec struct{}
+
+func (lz4Codec) Compress(src []byte, level int) ([]byte, error) {
+	return lz4.Encode(nil, src)
+}
+
+func (lz4Codec) Decompress(src []byte) ([]byte, error) {
+	return lz4.Decode(nil, src)
+}
+
+func (lz4Codec) MaxLevel() int {
+	return 0
+}
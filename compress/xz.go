@@ -0,0 +1,42 @@
+package compress
+
+import (
+	"bytes"
+	"io/ioutil"
+
+	"github.com/ulikunitz/xz"
+)
+
+func init() {
+	Register(XZ, "xz", xzCodec{})
+}
+
+// xzCodec stores every chunk as an xz stream.
+type xzCodec struct{}
+
+func (xzCodec) Compress(src []byte, level int) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	w, err := xz.NewWriter(buf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (xzCodec) Decompress(src []byte) ([]byte, error) {
+	r, err := xz.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+func (xzCodec) MaxLevel() int {
+	return 0
+}
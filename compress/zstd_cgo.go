@@ -0,0 +1,30 @@
+//go:build cgo
+// +build cgo
+
+package compress
+
+import (
+	"github.com/DataDog/zstd"
+)
+
+func init() {
+	Register(Zstd, "zstd", zstdCodec{})
+}
+
+// zstdCodec uses the Zstandard C library.
+type zstdCodec struct{}
+
+func (zstdCodec) Compress(src []byte, level int) ([]byte, error) {
+	if level == 0 {
+		return zstd.Compress(nil, src)
+	}
+	return zstd.CompressLevel(nil, src, level)
+}
+
+func (zstdCodec) Decompress(src []byte) ([]byte, error) {
+	return zstd.Decompress(nil, src)
+}
+
+func (zstdCodec) MaxLevel() int {
+	return zstdMaxLevel
+}
@@ -0,0 +1,77 @@
+package compress
+
+import (
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// zstdMaxLevel is the highest level of Zstandard. Both the C library and
+// the pure Go implementation accept the same levels.
+const zstdMaxLevel = 22
+
+// zstdGo is a pure Go implementation of Zstandard. It writes frames like
+// the C library, without checksum and as a single segment. The levels of
+// the C library are mapped to the nearest level of the implementation.
+type zstdGo struct {
+	dict []byte
+	mu   sync.Mutex
+	enc  map[int]*zstd.Encoder
+	dec  *zstd.Decoder
+}
+
+// newZstdGo returns a pure Go codec, which uses the given dictionary if
+// it is not nil.
+func newZstdGo(dict []byte) (*zstdGo, error) {
+	var opts []zstd.DOption
+	if dict != nil {
+		opts = append(opts, zstd.WithDecoderDicts(dict))
+	}
+	dec, err := zstd.NewReader(nil, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &zstdGo{dict: dict, enc: map[int]*zstd.Encoder{}, dec: dec}, nil
+}
+
+func (c *zstdGo) Compress(src []byte, level int) ([]byte, error) {
+	enc, err := c.encoder(level)
+	if err != nil {
+		return nil, err
+	}
+	return enc.EncodeAll(src, nil), nil
+}
+
+func (c *zstdGo) Decompress(src []byte) ([]byte, error) {
+	return c.dec.DecodeAll(src, nil)
+}
+
+func (c *zstdGo) MaxLevel() int {
+	return zstdMaxLevel
+}
+
+// encoder returns the encoder of the given level.
+func (c *zstdGo) encoder(level int) (*zstd.Encoder, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if enc, ok := c.enc[level]; ok {
+		return enc, nil
+	}
+
+	opts := []zstd.EOption{zstd.WithEncoderCRC(false), zstd.WithSingleSegment(true)}
+	if level > 0 {
+		opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+	}
+	if c.dict != nil {
+		opts = append(opts, zstd.WithEncoderDict(c.dict))
+	}
+	enc, err := zstd.NewWriter(nil, opts...)
+	if err != nil {
+		return nil, err
+	}
+	c.enc[level] = enc
+
+	return enc, nil
+}
@@ -0,0 +1,12 @@
+//go:build !cgo
+// +build !cgo
+
+package compress
+
+func init() {
+	c, err := newZstdGo(nil)
+	if err != nil {
+		panic(err)
+	}
+	Register(Zstd, "zstd", c)
+}
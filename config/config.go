@@ -1,6 +1,9 @@
 package config
 
-import "github.com/marcboeker/supertar/crypto"
+import (
+	"github.com/marcboeker/supertar/compress"
+	"github.com/marcboeker/supertar/crypto"
+)
 
 // Config holds all parameters for an archive.
 type Config struct {
@@ -9,4 +12,61 @@ type Config struct {
 	Compression bool
 	Crypto      *crypto.Crypto
 	ChunkSize   int
+
+	// Codec is the compression codec if compression is enabled. Zstandard
+	// is used if no codec is set.
+	Codec compress.ID
+	// Level is the compression level of the codec. The level of a new
+	// archive is stored in its header and used for all later writes,
+	// unless a level is set when opening the archive. Level 0 selects the
+	// default level of the codec.
+	Level int
+	// Version is the format version of the item headers, see
+	// item.Version1 and item.Version2. It is read from the header of an
+	// existing archive. Otherwise version 0 selects item.Version1, except
+	// for new archives, which use the current version.
+	Version int
+	// Dict is the Zstandard dictionary used for all chunks. It is stored
+	// encrypted after the header of a new archive and read from existing
+	// archives.
+	Dict []byte
+	// NoCompress stores files without compression, whose base name or
+	// MIME type matches one of the patterns, e.g. *.jpg or video/*.
+	NoCompress []string
+	// Solid packs small regular files into shared solid blocks when
+	// adding items, which are compressed and encrypted as a whole.
+	Solid bool
+
+	// VolumeSize splits a new archive into the volumes foo.star.001,
+	// foo.star.002, ... of at most the given size. It is stored in the
+	// archive and read from an existing volume set, unless a volume size
+	// is set when opening it. An existing single file cannot be split.
+	VolumeSize int64
+
+	// Threads is the number of chunks, which are compressed and encrypted
+	// in parallel when adding items, and the number of files, which are
+	// extracted in parallel.
+	Threads int
+
+	// ReadOnly opens the archive for reading with a shared lock, so that
+	// other readers can open the archive at the same time. Otherwise the
+	// archive is locked exclusively.
+	ReadOnly bool
+	// Wait waits for the lock if the archive is locked by another
+	// process instead of returning an error.
+	Wait bool
+
+	// SkipSpecial skips FIFOs and devices when adding items.
+	SkipSpecial bool
+
+	// Xattrs stores and restores extended attributes.
+	Xattrs bool
+	// ACLs stores and restores POSIX ACLs.
+	ACLs bool
+
+	// SameOwner restores the stored owner on extraction.
+	SameOwner bool
+	// NumericOwner restores the stored owner by its numeric IDs instead
+	// of the user and group names.
+	NumericOwner bool
 }
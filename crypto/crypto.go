@@ -3,6 +3,7 @@ package crypto
 import (
 	"crypto/cipher"
 	"crypto/rand"
+	"errors"
 	"io"
 
 	"golang.org/x/crypto/argon2"
@@ -137,7 +138,14 @@ func (c Crypto) SealBytes(plaintext, data []byte) []byte {
 
 // OpenBytes decrypts the contents of an io.Reader to an io.Writer.
 func (c Crypto) OpenBytes(ciphertext, data []byte) ([]byte, error) {
+	if len(ciphertext) < Overhead {
+		return nil, errCiphertextTooShort
+	}
 	nonce := ciphertext[0:chacha20poly1305.NonceSizeX]
 
 	return c.aead.Open(nil, nonce, ciphertext[chacha20poly1305.NonceSizeX:], data)
 }
+
+var (
+	errCiphertextTooShort = errors.New("ciphertext is too short")
+)
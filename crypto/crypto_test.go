@@ -56,3 +56,8 @@ func TestSealBytes(t *testing.T) {
 	assert.NoError(t, err)
 	assert.EqualValues(t, plaintext, data)
 }
+
+func TestOpenShortBytes(t *testing.T) {
+	_, err := defaultCrypto.OpenBytes([]byte{0, 1, 2}, nil)
+	assert.Equal(t, errCiphertextTooShort, err)
+}
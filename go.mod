@@ -1,16 +1,35 @@
 module github.com/marcboeker/supertar
 
-go 1.12
+go 1.22
 
 require (
 	github.com/DataDog/zstd v1.4.5
+	github.com/bkaradzic/go-lz4 v1.0.0
 	github.com/gin-gonic/gin v1.6.3
+	github.com/klauspost/compress v1.18.0
+	github.com/spf13/cobra v1.1.0
+	github.com/stretchr/testify v1.4.0
+	github.com/ulikunitz/xz v0.5.15
+	golang.org/x/crypto v0.9.0
+	golang.org/x/sys v0.8.0
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/gin-contrib/sse v0.1.0 // indirect
+	github.com/go-playground/locales v0.13.0 // indirect
+	github.com/go-playground/universal-translator v0.17.0 // indirect
 	github.com/go-playground/validator/v10 v10.4.1 // indirect
 	github.com/golang/protobuf v1.4.3 // indirect
+	github.com/inconshreveable/mousetrap v1.0.0 // indirect
 	github.com/json-iterator/go v1.1.10 // indirect
-	github.com/spf13/cobra v1.1.0
-	github.com/stretchr/testify v1.4.0
+	github.com/leodido/go-urn v1.2.0 // indirect
+	github.com/mattn/go-isatty v0.0.12 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/spf13/pflag v1.0.5 // indirect
 	github.com/ugorji/go v1.1.12 // indirect
-	golang.org/x/crypto v0.9.0
+	github.com/ugorji/go/codec v1.1.12 // indirect
+	golang.org/x/term v0.8.0 // indirect
 	google.golang.org/protobuf v1.25.0 // indirect
+	gopkg.in/yaml.v2 v2.3.0 // indirect
 )
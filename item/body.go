@@ -1,166 +1,380 @@
 package item
 
 import (
+	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
+	"hash"
 	"io"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
 
 	"github.com/marcboeker/supertar/compress"
 	"github.com/marcboeker/supertar/config"
 	"github.com/marcboeker/supertar/crypto"
 )
 
+// MaxChunkLength returns the maximum length of an encrypted chunk. Data
+// which does not compress grows slightly during compression.
+func MaxChunkLength(c *config.Config) int64 {
+	return int64(c.ChunkSize+c.ChunkSize>>7+1024) + crypto.Overhead
+}
+
+// ChunkStored is set in the sequence number of a chunk, which is stored
+// without compression in a compressed archive.
+const ChunkStored = 1 << 31
+
 // Body wraps all functions to write and extract the body of an item.
-type Body struct{}
+type Body struct {
+	// Checksum holds the SHA-256 checksum of the plaintext after the
+	// body has been written or extracted.
+	Checksum []byte
+
+	path  string // matched against config.NoCompress
+	store bool   // store all chunks without compression
+}
+
+// Write splits src into chunks, which are compressed, encrypted and
+// written to dest. With more than one thread, the chunks are compressed
+// and encrypted in parallel and written in sequence. At most one chunk
+// per thread is held in memory, plus the chunks being read and written.
+// Chunks, which do not get smaller by compression, are stored as they
+// are. The same applies to all chunks of a body, which matches one of the
+// patterns in c.NoCompress.
+func (b *Body) Write(dest io.Writer, src io.Reader, c *config.Config) error {
+	if c.Threads > 1 {
+		return b.writeParallel(dest, src, c)
+	}
 
-func (b Body) Write(dest io.Writer, src io.Reader, c *config.Config) error {
+	hash := sha256.New()
 	seq := 0
 	for {
-		buf := make([]byte, c.ChunkSize)
-		n, err := src.Read(buf)
-		if err != nil && err != io.EOF {
+		buf, err := readChunk(src, hash, c)
+		if err != nil || buf == nil {
 			return err
 		}
-		if n == 0 {
-			break
+		if seq == 0 {
+			b.store = skipCompression(b.path, buf, c.NoCompress)
 		}
 
-		seqB := make([]byte, 4)
-		binary.LittleEndian.PutUint32(seqB, uint32(seq))
+		chunk, err := sealChunk(seq, buf, b.store, c)
+		if err != nil {
+			return err
+		}
+		if _, err := dest.Write(chunk); err != nil {
+			return err
+		}
 
-		cb := buf[:n]
-		if c.Compression {
-			cb = compress.Compress(cb)
+		if len(buf) < c.ChunkSize {
+			break
 		}
 
-		sizeB := make([]byte, 4)
-		size := len(cb) + crypto.Overhead
-		binary.LittleEndian.PutUint32(sizeB, uint32(size))
+		seq++
+	}
+
+	b.Checksum = hash.Sum(nil)
+
+	return nil
+}
+
+// writeParallel is Write with a pool of c.Threads workers.
+func (b *Body) writeParallel(dest io.Writer, src io.Reader, c *config.Config) error {
+	type result struct {
+		chunk []byte
+		err   error
+	}
+	type job struct {
+		seq int
+		buf []byte
+		res chan result
+	}
+
+	jobs := make(chan job)
+	for n := 0; n < c.Threads; n++ {
+		go func() {
+			for j := range jobs {
+				chunk, err := sealChunk(j.seq, j.buf, b.store, c)
+				j.res <- result{chunk, err}
+			}
+		}()
+	}
 
-		hdr := append(seqB, sizeB...)
+	// The results are queued in sequence and written one after another.
+	// A failed chunk stops reading, the queued chunks are discarded.
+	pending := make(chan chan result, c.Threads)
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		var err error
+		for res := range pending {
+			r := <-res
+			if err != nil {
+				continue
+			}
+			if err = r.err; err == nil {
+				_, err = dest.Write(r.chunk)
+			}
+			if err != nil {
+				close(stop)
+			}
+		}
+		done <- err
+	}()
 
-		res := c.Crypto.SealBytes(cb, hdr)
+	hash := sha256.New()
+	var err error
+read:
+	for seq := 0; ; seq++ {
+		var buf []byte
+		if buf, err = readChunk(src, hash, c); err != nil || buf == nil {
+			break
+		}
+		if seq == 0 {
+			b.store = skipCompression(b.path, buf, c.NoCompress)
+		}
 
-		dest.Write(hdr)
-		dest.Write(res)
+		res := make(chan result, 1)
+		select {
+		case pending <- res:
+		case <-stop:
+			break read
+		}
+		jobs <- job{seq: seq, buf: buf, res: res}
 
-		if n < c.ChunkSize {
+		if len(buf) < c.ChunkSize {
 			break
 		}
+	}
+	close(jobs)
+	close(pending)
 
-		seq++
+	if werr := <-done; werr != nil {
+		return werr
+	}
+	if err != nil {
+		return err
 	}
 
+	b.Checksum = hash.Sum(nil)
+
 	return nil
 }
 
+// readChunk reads the next chunk from src and adds it to hash. nil is
+// returned at the end of src.
+func readChunk(src io.Reader, h hash.Hash, c *config.Config) ([]byte, error) {
+	buf := make([]byte, c.ChunkSize)
+	n, err := io.ReadFull(src, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	h.Write(buf[:n])
+
+	return buf[:n], nil
+}
+
+// sealChunk compresses and encrypts a chunk and returns it with its
+// chunk header. If store is set or the chunk does not get smaller, it is
+// not compressed and flagged as stored.
+func sealChunk(seq int, buf []byte, store bool, c *config.Config) ([]byte, error) {
+	cb := buf
+	if c.Compression && !store {
+		codec, err := codecOf(c)
+		if err != nil {
+			return nil, err
+		}
+		if cb, err = codec.Compress(cb, compress.ClampLevel(codec, c.Level)); err != nil {
+			return nil, err
+		}
+		if len(cb) >= len(buf) {
+			cb = buf
+			store = true
+		}
+	}
+
+	seqB := make([]byte, 4)
+	if c.Compression && store {
+		binary.LittleEndian.PutUint32(seqB, uint32(seq)|ChunkStored)
+	} else {
+		binary.LittleEndian.PutUint32(seqB, uint32(seq))
+	}
+
+	sizeB := make([]byte, 4)
+	size := len(cb) + crypto.Overhead
+	binary.LittleEndian.PutUint32(sizeB, uint32(size))
+
+	hdr := append(seqB, sizeB...)
+
+	return append(hdr, c.Crypto.SealBytes(cb, hdr)...), nil
+}
+
+// codecOf returns the compression codec of the config. Archives, which
+// only have compression enabled, use Zstandard.
+func codecOf(c *config.Config) (compress.Codec, error) {
+	id := c.Codec
+	if id == compress.None {
+		id = compress.Zstd
+	}
+	if c.Dict != nil {
+		return compress.WithDict(id, c.Dict)
+	}
+	return compress.Lookup(id)
+}
+
+// skipCompression returns whether the base name of path or the MIME type
+// of head matches one of the patterns. Patterns containing a slash match
+// the MIME type, e.g. video/*. All matches are case insensitive.
+func skipCompression(p string, head []byte, patterns []string) bool {
+	if len(patterns) == 0 {
+		return false
+	}
+
+	name := strings.ToLower(filepath.Base(p))
+	mime := http.DetectContentType(head)
+	if n := strings.IndexByte(mime, ';'); n >= 0 {
+		mime = mime[:n]
+	}
+
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if strings.Contains(pattern, "/") {
+			if ok, _ := path.Match(pattern, mime); ok {
+				return true
+			}
+		} else if ok, _ := filepath.Match(pattern, name); ok && p != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// decompress decompresses a chunk with the codec of the config.
+func decompress(buf []byte, c *config.Config) ([]byte, error) {
+	codec, err := codecOf(c)
+	if err != nil {
+		return nil, err
+	}
+	return codec.Decompress(buf)
+}
+
 // Extract extracts the body to the destination file.
-func (b Body) Extract(src io.Reader, dest io.Writer, chunks int64, c *config.Config) error {
+func (b *Body) Extract(src io.Reader, dest io.Writer, chunks int64, c *config.Config) error {
+	hash := sha256.New()
+	dest = io.MultiWriter(dest, hash)
 	for i := int64(0); i < chunks; i++ {
 		hdr := make([]byte, 8)
-		if _, err := src.Read(hdr); err != nil {
+		if _, err := io.ReadFull(src, hdr); err != nil {
 			return err
 		}
 
-		seq := binary.LittleEndian.Uint32(hdr[:4])
-		size := binary.LittleEndian.Uint32(hdr[4:])
-
-		if int64(seq) != i {
-			return fmt.Errorf("chunk order incorrect: expected %d, got %d", i, seq)
+		size, err := checkChunk(hdr, i, c)
+		if err != nil {
+			return err
 		}
 
 		buf := make([]byte, size)
-		_, err := src.Read(buf)
-		if err != nil {
+		if _, err := io.ReadFull(src, buf); err != nil {
 			return err
 		}
 
-		plaintext, err := c.Crypto.OpenBytes(buf, hdr)
+		data, err := openChunk(hdr, buf, c)
 		if err != nil {
 			return err
 		}
-
-		if c.Compression {
-			data, err := compress.Decompress(plaintext)
-			if err != nil {
-				return err
-			}
-			if _, err := dest.Write(data); err != nil {
-				return err
-			}
-		} else {
-			if _, err := dest.Write(plaintext); err != nil {
-				return err
-			}
+		if _, err := dest.Write(data); err != nil {
+			return err
 		}
 	}
 
+	b.Checksum = hash.Sum(nil)
+
 	return nil
 }
 
-// ExtractRange extracts the given range to the destination file.
-func (b Body) ExtractRange(src io.ReadSeeker, dest io.Writer, start, end int, chunks int64, c *config.Config) error {
-	counter := 0
+// ExtractRange extracts the given range to the destination file. The
+// chunk headers are read from the start of the body, see Reader for
+// random access.
+func (b Body) ExtractRange(src io.ReadSeeker, dest io.Writer, start, end int64, chunks int64, c *config.Config) error {
+	var counter int64
+	chunkSize := int64(c.ChunkSize)
 	for i := int64(0); i < chunks; i++ {
 		hdr := make([]byte, 8)
-		if _, err := src.Read(hdr); err != nil {
+		if _, err := io.ReadFull(src, hdr); err != nil {
 			return err
 		}
 
-		seq := binary.LittleEndian.Uint32(hdr[:4])
-		size := binary.LittleEndian.Uint32(hdr[4:8])
-
-		if int64(seq) != i {
-			return fmt.Errorf("chunk order incorrect: expected %d, got %d", i, seq)
+		size, err := checkChunk(hdr, i, c)
+		if err != nil {
+			return err
 		}
 
-		if counter+c.ChunkSize >= start && counter < end {
+		if counter+chunkSize >= start && counter < end {
 			buf := make([]byte, size)
-			_, err := src.Read(buf)
-			if err != nil {
+			if _, err := io.ReadFull(src, buf); err != nil {
 				return err
 			}
 
-			plaintext, err := c.Crypto.OpenBytes(buf, hdr)
+			data, err := openChunk(hdr, buf, c)
 			if err != nil {
 				return err
 			}
 
-			startOffset := 0
-			if start > counter && start < counter+c.ChunkSize {
+			startOffset := int64(0)
+			if start > counter && start < counter+chunkSize {
 				startOffset = start - counter
 			}
 
-			endOffset := c.ChunkSize
-			if counter+c.ChunkSize > end {
-				endOffset = c.ChunkSize - ((counter + c.ChunkSize) - end)
+			endOffset := chunkSize
+			if counter+chunkSize > end {
+				endOffset = chunkSize - ((counter + chunkSize) - end)
 			}
-
-			if c.Compression {
-				data, err := compress.Decompress(plaintext)
-				if err != nil {
-					return err
-				}
-				if endOffset < len(data) {
-					endOffset++
-				}
-				if _, err := dest.Write(data[startOffset:endOffset]); err != nil {
-					return err
-				}
-			} else {
-				if endOffset < len(plaintext) {
-					endOffset++
-				}
-				if _, err := dest.Write(plaintext[startOffset:endOffset]); err != nil {
-					return err
-				}
+			if endOffset < int64(len(data)) {
+				endOffset++
 			}
-		} else {
-			src.Seek(int64(size), io.SeekCurrent)
+			if _, err := dest.Write(data[startOffset:endOffset]); err != nil {
+				return err
+			}
+		} else if _, err := src.Seek(int64(size), io.SeekCurrent); err != nil {
+			return err
 		}
 
-		counter += c.ChunkSize
+		counter += chunkSize
 	}
 
 	return nil
 }
+
+// checkChunk checks the sequence number of the chunk header hdr against
+// the expected number seq and returns the length of the chunk.
+func checkChunk(hdr []byte, seq int64, c *config.Config) (int64, error) {
+	n := binary.LittleEndian.Uint32(hdr[:4]) &^ ChunkStored
+	size := int64(binary.LittleEndian.Uint32(hdr[4:8]))
+
+	if int64(n) != seq {
+		return 0, fmt.Errorf("chunk order incorrect: expected %d, got %d", seq, n)
+	}
+	if size > MaxChunkLength(c) {
+		return 0, fmt.Errorf("chunk size invalid: %d", size)
+	}
+	return size, nil
+}
+
+// openChunk decrypts the chunk buf with its chunk header hdr and
+// decompresses it, unless it is stored.
+func openChunk(hdr, buf []byte, c *config.Config) ([]byte, error) {
+	plaintext, err := c.Crypto.OpenBytes(buf, hdr)
+	if err != nil {
+		return nil, err
+	}
+
+	stored := binary.LittleEndian.Uint32(hdr[:4])&ChunkStored != 0
+	if c.Compression && !stored {
+		return decompress(plaintext, c)
+	}
+	return plaintext, nil
+}
@@ -2,8 +2,12 @@ package item
 
 import (
 	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"testing"
 	"time"
@@ -57,3 +61,174 @@ func TestWriteReadPartialBody(t *testing.T) {
 
 	assert.EqualValues(t, "eek", out.Bytes())
 }
+
+func TestWriteReadSparseBody(t *testing.T) {
+	c := config.Config{Crypto: defaultCrypto, ChunkSize: 1024 * 1024, Compression: true}
+	hdr := Header{Path: "sparse", Mode: 0644, Size: 10, Chunks: 1, Sparse: []Segment{{Offset: 2, Length: 3}, {Offset: 10, Length: 0}}}
+
+	buf := bytes.NewBuffer(nil)
+	i := NewItem(&hdr)
+	err := i.Write(buf, bytes.NewBufferString("eek"), &c)
+	assert.NoError(t, err)
+
+	r, err := Read(buf, &c)
+	assert.NoError(t, err)
+	assert.Equal(t, hdr.Sparse, r.Header.Sparse)
+	assert.Equal(t, int64(3), r.Header.StoredSize())
+
+	out := bytes.NewBuffer(nil)
+	err = r.Extract(buf, out, &c)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0, 0, 'e', 'e', 'k', 0, 0, 0, 0, 0}, out.Bytes())
+}
+
+func TestWriteParallelBody(t *testing.T) {
+	c := config.Config{Crypto: defaultCrypto, ChunkSize: 1024, Compression: true, Threads: 4}
+	data := bytes.Repeat([]byte("eekeek"), 10000)
+
+	buf := bytes.NewBuffer(nil)
+	b := new(Body)
+	err := b.Write(buf, bytes.NewReader(data), &c)
+	assert.NoError(t, err)
+
+	out := bytes.NewBuffer(nil)
+	chunks := int64(len(data)+c.ChunkSize-1) / int64(c.ChunkSize)
+	err = new(Body).Extract(buf, out, chunks, &c)
+	assert.NoError(t, err)
+	assert.Equal(t, data, out.Bytes())
+
+	sum := sha256.Sum256(data)
+	assert.Equal(t, sum[:], b.Checksum)
+
+	err = b.Write(failingWriter{}, bytes.NewReader(data), &c)
+	assert.Equal(t, io.ErrShortWrite, err)
+}
+
+func TestStoredChunks(t *testing.T) {
+	random := make([]byte, 1024)
+	_, err := rand.Read(random)
+	assert.NoError(t, err)
+	data := append(bytes.Repeat([]byte("eekeek"), 1024)[:1024], random...)
+
+	for _, threads := range []int{1, 4} {
+		c := config.Config{Crypto: defaultCrypto, ChunkSize: 1024, Compression: true, Threads: threads}
+		buf := bytes.NewBuffer(nil)
+		err := new(Body).Write(buf, bytes.NewReader(data), &c)
+		assert.NoError(t, err)
+
+		// Only the random chunk is stored.
+		chunks := buf.Bytes()
+		size := binary.LittleEndian.Uint32(chunks[4:8])
+		assert.Equal(t, uint32(0), binary.LittleEndian.Uint32(chunks[:4]))
+		assert.Equal(t, uint32(1|ChunkStored), binary.LittleEndian.Uint32(chunks[8+size:]))
+
+		out := bytes.NewBuffer(nil)
+		err = new(Body).Extract(bytes.NewReader(chunks), out, 2, &c)
+		assert.NoError(t, err)
+		assert.Equal(t, data, out.Bytes())
+
+		out.Reset()
+		err = new(Body).ExtractRange(bytes.NewReader(chunks), out, 1000, 1100, 2, &c)
+		assert.NoError(t, err)
+		assert.Equal(t, data[1000:1101], out.Bytes())
+
+		// All chunks of matching files are stored.
+		c.NoCompress = []string{"*.jpg"}
+		buf.Reset()
+		err = (&Body{path: "foo/bar.JPG"}).Write(buf, bytes.NewReader(data), &c)
+		assert.NoError(t, err)
+		assert.Equal(t, uint32(ChunkStored), binary.LittleEndian.Uint32(buf.Bytes()[:4]))
+	}
+}
+
+func TestReader(t *testing.T) {
+	random := make([]byte, 1024)
+	_, err := rand.Read(random)
+	assert.NoError(t, err)
+	data := append(bytes.Repeat([]byte("eekeek"), 1024), random...)
+
+	c := config.Config{Crypto: defaultCrypto, ChunkSize: 1024, Compression: true}
+	hdr := Header{Path: "foo", Mode: 0644, Size: int64(len(data)), Chunks: 7}
+	buf := bytes.NewBuffer([]byte("header"))
+	assert.NoError(t, new(Body).Write(buf, bytes.NewReader(data), &c))
+
+	src := &countingReaderAt{r: bytes.NewReader(buf.Bytes())}
+	i := &Item{Header: &hdr, Offset: 6}
+	r, err := NewReader(i, src, &c)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(data)), r.Size())
+
+	// Reading within a chunk reads only its header and the chunk.
+	src.reads = 0
+	p := make([]byte, 100)
+	n, err := r.ReadAt(p, 6000)
+	assert.NoError(t, err)
+	assert.Equal(t, 100, n)
+	assert.Equal(t, data[6000:6100], p)
+	assert.Equal(t, 2, src.reads)
+
+	p = make([]byte, 2000)
+	n, err = r.ReadAt(p, 1000)
+	assert.NoError(t, err)
+	assert.Equal(t, data[1000:3000], p[:n])
+
+	_, err = r.Seek(-10, io.SeekEnd)
+	assert.NoError(t, err)
+	out, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, data[len(data)-10:], out)
+
+	n, err = r.ReadAt(p, int64(len(data)))
+	assert.Equal(t, 0, n)
+	assert.Equal(t, io.EOF, err)
+	_, err = r.Seek(-1, io.SeekStart)
+	assert.Equal(t, ErrInvalidOffset, err)
+	assert.NoError(t, r.Close())
+
+	// Holes of sparse items are read as zeros.
+	sparse := Header{Path: "sparse", Mode: 0644, Size: 10, Chunks: 1, Sparse: []Segment{{Offset: 2, Length: 3}, {Offset: 10, Length: 0}}}
+	buf.Reset()
+	assert.NoError(t, new(Body).Write(buf, bytes.NewBufferString("eek"), &c))
+	r, err = NewReader(&Item{Header: &sparse}, bytes.NewReader(buf.Bytes()), &c)
+	assert.NoError(t, err)
+	out, err = ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0, 0, 'e', 'e', 'k', 0, 0, 0, 0, 0}, out)
+
+	// Solid items are read from their block.
+	solid := Header{Path: "solid", Mode: 0644, Size: 3, Block: 1, BlockOffset: 2}
+	r, err = NewSolidReader(&Item{Header: &solid}, []byte("fooeekbar"))
+	assert.NoError(t, err)
+	out, err = ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("oee"), out)
+}
+
+// countingReaderAt counts the reads from r.
+type countingReaderAt struct {
+	r     io.ReaderAt
+	reads int
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	c.reads++
+	return c.r.ReadAt(p, off)
+}
+
+func TestSkipCompression(t *testing.T) {
+	png := []byte("\x89PNG\x0D\x0A\x1A\x0A")
+	patterns := []string{"*.jpg", " *.mp4", "image/*"}
+
+	assert.True(t, skipCompression("foo/bar.jpg", nil, patterns))
+	assert.True(t, skipCompression("bar.MP4", nil, patterns))
+	assert.True(t, skipCompression("foo/bar", png, patterns))
+	assert.False(t, skipCompression("foo/bar.txt", []byte("hello"), patterns))
+	assert.False(t, skipCompression("", []byte("hello"), []string{"*"}))
+	assert.False(t, skipCompression("foo/bar.jpg", png, nil))
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, io.ErrShortWrite
+}
@@ -0,0 +1,213 @@
+package item
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"time"
+)
+
+const (
+	fieldTypeLength = 1
+	fieldSizeLength = 2
+
+	fieldPath     = 1
+	fieldSize     = 2
+	fieldChunks   = 3
+	fieldMTime    = 4
+	fieldMode     = 5
+	fieldDeleted  = 6
+	fieldLink     = 7
+	fieldOwner    = 8
+	fieldUname    = 9
+	fieldGname    = 10
+	fieldMeta     = 11
+	fieldATime    = 12
+	fieldCTime    = 13
+	fieldDevice   = 14
+	fieldChecksum = 15
+	fieldBlock    = 16
+)
+
+// A Version2 header consists of fields, each prefixed by its type (1 byte)
+// and length (2 bytes). Fields of unknown types are skipped, so that new
+// fields can be added without breaking older readers. Fields with their
+// zero value are omitted, except for the fields which are rewritten in
+// place: the deleted flag and the checksum of regular files are always
+// stored, so that the length of the header does not change.
+
+// marshalFields serializes the fields of a Version2 header.
+func (h Header) marshalFields() []byte {
+	buf := bytes.NewBuffer(nil)
+
+	writeField(buf, fieldPath, []byte(h.Path))
+	writeField(buf, fieldSize, uint64Bytes(uint64(h.Size)))
+	writeField(buf, fieldChunks, uint64Bytes(uint64(h.Chunks)))
+	writeField(buf, fieldMTime, timeBytes(h.MTime))
+	writeField(buf, fieldMode, uint32Bytes(uint32(h.Mode)))
+	if h.Deleted == 1 {
+		writeField(buf, fieldDeleted, []byte{1})
+	} else {
+		writeField(buf, fieldDeleted, []byte{0})
+	}
+
+	if len(h.Link) > 0 {
+		writeField(buf, fieldLink, []byte(h.Link))
+	}
+	if h.UID != 0 || h.GID != 0 {
+		writeField(buf, fieldOwner, append(uint32Bytes(uint32(h.UID)), uint32Bytes(uint32(h.GID))...))
+	}
+	if len(h.Uname) > 0 {
+		writeField(buf, fieldUname, []byte(h.Uname))
+	}
+	if len(h.Gname) > 0 {
+		writeField(buf, fieldGname, []byte(h.Gname))
+	}
+	if h.metaLength > 0 {
+		writeField(buf, fieldMeta, h.metaLengthBytes())
+	}
+	if !h.ATime.IsZero() {
+		writeField(buf, fieldATime, timeBytes(h.ATime))
+	}
+	if !h.CTime.IsZero() {
+		writeField(buf, fieldCTime, timeBytes(h.CTime))
+	}
+	if h.DevMajor != 0 || h.DevMinor != 0 {
+		writeField(buf, fieldDevice, append(uint32Bytes(h.DevMajor), uint32Bytes(h.DevMinor)...))
+	}
+	if h.Mode.IsRegular() {
+		checksum := make([]byte, ChecksumLength)
+		copy(checksum, h.Checksum)
+		writeField(buf, fieldChecksum, checksum)
+	}
+	if h.Block != 0 || h.BlockOffset != 0 {
+		writeField(buf, fieldBlock, append(uint64Bytes(uint64(h.Block)), uint64Bytes(uint64(h.BlockOffset))...))
+	}
+
+	return buf.Bytes()
+}
+
+// unmarshalFields parses the fields of a Version2 header. The path and
+// the mode are required.
+func (h *Header) unmarshalFields(buf []byte) error {
+	h.Checksum = nil
+	h.metaLength = 0
+	h.Block, h.BlockOffset = 0, 0
+
+	var hasPath, hasMode bool
+	offset := 0
+	for offset < len(buf) {
+		if len(buf) < offset+fieldTypeLength+fieldSizeLength {
+			return errInvalidHeader
+		}
+		typ := buf[offset]
+		offset += fieldTypeLength
+		n := int(binary.LittleEndian.Uint16(buf[offset : offset+fieldSizeLength]))
+		offset += fieldSizeLength
+		if len(buf) < offset+n {
+			return errInvalidHeader
+		}
+		val := buf[offset : offset+n]
+		offset += n
+
+		if size, ok := fieldSizes[typ]; ok && size != n {
+			return errInvalidHeader
+		}
+
+		switch typ {
+		case fieldPath:
+			h.Path = string(val)
+			hasPath = true
+		case fieldSize:
+			h.Size = int64(binary.LittleEndian.Uint64(val))
+		case fieldChunks:
+			h.Chunks = int64(binary.LittleEndian.Uint64(val))
+		case fieldMTime:
+			h.MTime = bytesTime(val)
+		case fieldMode:
+			h.Mode = os.FileMode(binary.LittleEndian.Uint32(val))
+			hasMode = true
+		case fieldDeleted:
+			h.Deleted = int(val[0])
+		case fieldLink:
+			h.Link = string(val)
+		case fieldOwner:
+			h.UID = int(binary.LittleEndian.Uint32(val))
+			h.GID = int(binary.LittleEndian.Uint32(val[ownerLength:]))
+		case fieldUname:
+			h.Uname = string(val)
+		case fieldGname:
+			h.Gname = string(val)
+		case fieldMeta:
+			h.metaLength = binary.LittleEndian.Uint32(val)
+		case fieldATime:
+			h.ATime = bytesTime(val)
+		case fieldCTime:
+			h.CTime = bytesTime(val)
+		case fieldDevice:
+			h.DevMajor = binary.LittleEndian.Uint32(val)
+			h.DevMinor = binary.LittleEndian.Uint32(val[deviceLength:])
+		case fieldChecksum:
+			// A checksum of zeros is unknown.
+			if !bytes.Equal(val, make([]byte, ChecksumLength)) {
+				h.Checksum = append([]byte(nil), val...)
+			}
+		case fieldBlock:
+			h.Block = int64(binary.LittleEndian.Uint64(val))
+			h.BlockOffset = int64(binary.LittleEndian.Uint64(val[blockLength:]))
+		}
+	}
+
+	if !hasPath || !hasMode {
+		return errInvalidHeader
+	}
+	return nil
+}
+
+// fieldSizes holds the length of all known fields with a fixed length.
+var fieldSizes = map[byte]int{
+	fieldSize:     sizeLength,
+	fieldChunks:   chunksLength,
+	fieldMTime:    timeLength + nsecLength,
+	fieldMode:     modeLength,
+	fieldDeleted:  deletedLength,
+	fieldOwner:    2 * ownerLength,
+	fieldMeta:     metaLength,
+	fieldATime:    timeLength + nsecLength,
+	fieldCTime:    timeLength + nsecLength,
+	fieldDevice:   2 * deviceLength,
+	fieldChecksum: ChecksumLength,
+	fieldBlock:    2 * blockLength,
+}
+
+func writeField(buf *bytes.Buffer, typ byte, val []byte) {
+	hdr := make([]byte, fieldTypeLength+fieldSizeLength)
+	hdr[0] = typ
+	binary.LittleEndian.PutUint16(hdr[fieldTypeLength:], uint16(len(val)))
+	buf.Write(hdr)
+	buf.Write(val)
+}
+
+func uint32Bytes(v uint32) []byte {
+	buf := make([]byte, 4)
+	binary.LittleEndian.PutUint32(buf, v)
+	return buf
+}
+
+func uint64Bytes(v uint64) []byte {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, v)
+	return buf
+}
+
+// timeBytes serializes a timestamp as seconds and nanoseconds.
+func timeBytes(t time.Time) []byte {
+	return append(uint64Bytes(uint64(t.Unix())), uint32Bytes(uint32(t.Nanosecond()))...)
+}
+
+// bytesTime parses a timestamp serialized by timeBytes.
+func bytesTime(buf []byte) time.Time {
+	sec := int64(binary.LittleEndian.Uint64(buf))
+	nsec := int64(binary.LittleEndian.Uint32(buf[timeLength:]))
+	return time.Unix(sec, nsec)
+}
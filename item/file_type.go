@@ -8,4 +8,14 @@ const (
 	ModeRegular = iota
 	// ModeDir represents a directory
 	ModeDir
+	// ModeSymlink represents a symbolic link
+	ModeSymlink
+	// ModeHardlink represents a hard link to a previously stored file
+	ModeHardlink
+	// ModeFIFO represents a named pipe
+	ModeFIFO
+	// ModeCharDevice represents a character device
+	ModeCharDevice
+	// ModeBlockDevice represents a block device
+	ModeBlockDevice
 )
@@ -2,12 +2,15 @@ package item
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/marcboeker/supertar/config"
@@ -21,10 +24,27 @@ const (
 	chunksLength  = 8
 	timeLength    = 8
 	modeLength    = 4
+	linkLength    = 2
+	ownerLength   = 4
+	nameLength    = 2
+	nsecLength    = 4
+	deviceLength  = 4
+	blockLength   = 8
+
+	// ChecksumLength is the length of the SHA-256 checksum of an item.
+	ChecksumLength = sha256.Size
 
 	headerSizeLength = 2
 	minHeaderLength  = pathLength + timeLength + modeLength
 
+	// Version1 headers consist of fields at fixed offsets. New fields
+	// have been appended, so that shorter headers written before can
+	// still be read.
+	Version1 = 1
+	// Version2 headers consist of typed and length-prefixed fields, so
+	// that fields unknown to a reader are skipped.
+	Version2 = 2
+
 	kb = 1024
 	mb = kb * 1024
 	gb = mb * 1024
@@ -33,30 +53,85 @@ const (
 
 // Header represents a file or directory of an entry.
 type Header struct {
-	Path    string      `json:"path"`    // 2 bytes + x bytes
-	Size    int64       `json:"size"`    // 8 bytes
-	Chunks  int64       `json:"chunks"`  // 8 bytes
-	MTime   time.Time   `json:"mtime"`   // 8 bytes
-	Mode    os.FileMode `json:"mode"`    // 4 bytes
-	Deleted int         `json:"deleted"` // 1 byte
+	Path    string      `json:"path"`            // 2 bytes + x bytes
+	Size    int64       `json:"size"`            // 8 bytes
+	Chunks  int64       `json:"chunks"`          // 8 bytes
+	MTime   time.Time   `json:"mtime"`           // 8 bytes
+	Mode    os.FileMode `json:"mode"`            // 4 bytes
+	Deleted int         `json:"deleted"`         // 1 byte
+	Link    string      `json:"link,omitempty"`  // 2 bytes + x bytes
+	UID     int         `json:"uid,omitempty"`   // 4 bytes
+	GID     int         `json:"gid,omitempty"`   // 4 bytes
+	Uname   string      `json:"uname,omitempty"` // 2 bytes + x bytes
+	Gname   string      `json:"gname,omitempty"` // 2 bytes + x bytes
+
+	// ATime and CTime hold the access and status change time of the
+	// item. They are zero if unknown.
+	ATime time.Time `json:"-"` // 8 bytes + 4 bytes nanoseconds
+	CTime time.Time `json:"-"` // 8 bytes + 4 bytes nanoseconds
+
+	// DevMajor and DevMinor hold the device numbers of character and
+	// block devices.
+	DevMajor uint32 `json:"devmajor,omitempty"` // 4 bytes
+	DevMinor uint32 `json:"devminor,omitempty"` // 4 bytes
+
+	// Checksum holds the SHA-256 checksum of the content of a regular
+	// file. The holes of sparse files are included as zeros, so that it
+	// matches the checksum of the original file. It is nil if unknown.
+	Checksum []byte `json:"checksum,omitempty"` // 32 bytes
+
+	// Block holds the distance from the header back to the solid block
+	// containing the content of a small file, and BlockOffset holds the
+	// offset of the content in the block. Block is zero if the content is
+	// stored in chunks after the header.
+	Block       int64 `json:"-"` // 8 bytes
+	BlockOffset int64 `json:"-"` // 8 bytes
+
+	// Xattrs holds the extended attributes and ACLs of the item. They are
+	// stored in a separately encrypted metadata block after the header.
+	Xattrs map[string][]byte `json:"xattrs,omitempty"`
+	// Sparse holds the data segments of a sparse file. Only the data of
+	// these segments is stored in the body, everything else is a hole.
+	// The last segment always ends at the size of the file.
+	Sparse []Segment `json:"sparse,omitempty"`
 
 	serializedLength uint16
+	metaLength       uint32
+	version          int // format of the header, 0 is Version1
+}
+
+// IsSolid returns whether the content of the item is stored in a solid
+// block.
+func (h Header) IsSolid() bool {
+	return h.Block > 0
 }
 
 // Type returns the entry's type.
 func (h Header) Type() Mode {
-	if h.Mode.IsRegular() {
+	if h.Mode.IsRegular() && len(h.Link) > 0 {
+		return ModeHardlink
+	} else if h.Mode.IsRegular() {
 		return ModeRegular
 	} else if h.Mode.IsDir() {
 		return ModeDir
+	} else if h.Mode&os.ModeSymlink != 0 {
+		return ModeSymlink
+	} else if h.Mode&os.ModeNamedPipe != 0 {
+		return ModeFIFO
+	} else if h.Mode&os.ModeCharDevice != 0 {
+		return ModeCharDevice
+	} else if h.Mode&os.ModeDevice != 0 {
+		return ModeBlockDevice
 	}
 	return 0
 }
 
 // Read reads an header from a file handler and parses it.
+// A header length of zero marks a special record of the archive instead
+// of an item, which is not read.
 func (h *Header) Read(src io.Reader, config *config.Config) (bool, error) {
 	sizeBuf := make([]byte, headerSizeLength)
-	_, err := src.Read(sizeBuf)
+	_, err := io.ReadFull(src, sizeBuf)
 	if err == io.EOF {
 		return false, nil
 	}
@@ -65,13 +140,16 @@ func (h *Header) Read(src io.Reader, config *config.Config) (bool, error) {
 	}
 
 	hdrLen := binary.LittleEndian.Uint16(sizeBuf)
+	if hdrLen == 0 {
+		return false, nil
+	}
 
 	if hdrLen < minHeaderLength {
 		return false, errors.New("header is invalid as it is too short")
 	}
 
 	hdrBuf := make([]byte, hdrLen)
-	if _, err = src.Read(hdrBuf); err != nil {
+	if _, err = io.ReadFull(src, hdrBuf); err != nil {
 		return false, err
 	}
 
@@ -80,6 +158,42 @@ func (h *Header) Read(src io.Reader, config *config.Config) (bool, error) {
 		return false, err
 	}
 
+	h.version = config.Version
+	if err := h.unmarshal(hdrBuf); err != nil {
+		return false, err
+	}
+	h.serializedLength = hdrLen
+
+	if h.metaLength > 0 {
+		metaBuf := make([]byte, h.metaLength)
+		if _, err := io.ReadFull(src, metaBuf); err != nil {
+			return false, err
+		}
+
+		metaBuf, err = config.Crypto.OpenBytes(metaBuf, h.metaLengthBytes())
+		if err != nil {
+			return false, err
+		}
+		if err := h.unmarshalMeta(metaBuf); err != nil {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// unmarshal parses the decrypted header fields in the format of the
+// header's version.
+func (h *Header) unmarshal(hdrBuf []byte) error {
+	if h.version >= Version2 {
+		return h.unmarshalFields(hdrBuf)
+	}
+	h.unmarshalV1(hdrBuf)
+	return nil
+}
+
+// unmarshalV1 parses the fields of a Version1 header.
+func (h *Header) unmarshalV1(hdrBuf []byte) {
 	offset := 0
 	pathLen := binary.LittleEndian.Uint16(hdrBuf[:pathLength])
 	offset += pathLength + int(pathLen)
@@ -103,14 +217,118 @@ func (h *Header) Read(src io.Reader, config *config.Config) (bool, error) {
 	} else {
 		h.Deleted = 1
 	}
+	offset += deletedLength
 
-	h.serializedLength = hdrLen
+	// Headers written before link support end after the deleted flag.
+	if len(hdrBuf) >= offset+linkLength {
+		h.Link, offset = readString(hdrBuf, offset)
+	}
 
-	return true, nil
+	// Headers written before ownership support end after the link.
+	if len(hdrBuf) >= offset+2*ownerLength+2*nameLength {
+		h.UID = int(binary.LittleEndian.Uint32(hdrBuf[offset : offset+ownerLength]))
+		offset += ownerLength
+		h.GID = int(binary.LittleEndian.Uint32(hdrBuf[offset : offset+ownerLength]))
+		offset += ownerLength
+		h.Uname, offset = readString(hdrBuf, offset)
+		h.Gname, offset = readString(hdrBuf, offset)
+	}
+
+	// Headers written before metadata support end after the owner.
+	h.metaLength = 0
+	if len(hdrBuf) >= offset+metaLength {
+		h.metaLength = binary.LittleEndian.Uint32(hdrBuf[offset : offset+metaLength])
+		offset += metaLength
+	}
+
+	// Headers written before nanosecond support end after the metadata
+	// length and only contain the mtime in seconds.
+	if len(hdrBuf) >= offset+nsecLength+2*(timeLength+nsecLength) {
+		nsec := int64(binary.LittleEndian.Uint32(hdrBuf[offset : offset+nsecLength]))
+		h.MTime = time.Unix(mtime, nsec)
+		offset += nsecLength
+		h.ATime, offset = readTime(hdrBuf, offset)
+		h.CTime, offset = readTime(hdrBuf, offset)
+	}
+
+	// Headers written before device support end after the times.
+	if len(hdrBuf) >= offset+2*deviceLength {
+		h.DevMajor = binary.LittleEndian.Uint32(hdrBuf[offset : offset+deviceLength])
+		offset += deviceLength
+		h.DevMinor = binary.LittleEndian.Uint32(hdrBuf[offset : offset+deviceLength])
+		offset += deviceLength
+	}
+
+	// Headers written before checksum support end after the devices.
+	// A checksum of zeros is unknown.
+	h.Checksum = nil
+	if len(hdrBuf) >= offset+ChecksumLength {
+		sum := hdrBuf[offset : offset+ChecksumLength]
+		if !bytes.Equal(sum, make([]byte, ChecksumLength)) {
+			h.Checksum = append([]byte(nil), sum...)
+		}
+		offset += ChecksumLength
+	}
+
+	// Headers written before solid support end after the checksum.
+	h.Block, h.BlockOffset = 0, 0
+	if len(hdrBuf) >= offset+2*blockLength {
+		h.Block = int64(binary.LittleEndian.Uint64(hdrBuf[offset : offset+blockLength]))
+		offset += blockLength
+		h.BlockOffset = int64(binary.LittleEndian.Uint64(hdrBuf[offset : offset+blockLength]))
+		offset += blockLength
+	}
 }
 
-// Write serializes an header and writes it to a file handler.
+// Write serializes an header in the format of the config's version and
+// writes it to a file handler.
 func (h *Header) Write(dest io.Writer, config *config.Config) error {
+	h.version = config.Version
+	meta := h.marshalMeta()
+	h.metaLength = 0
+	if len(meta) > 0 {
+		h.metaLength = uint32(len(meta) + crypto.Overhead)
+	}
+
+	hdr := h.marshal()
+
+	hdrLenBuf := make([]byte, headerSizeLength)
+	overhead := len(hdr) + crypto.Overhead
+
+	binary.LittleEndian.PutUint16(hdrLenBuf, uint16(overhead))
+
+	buf := config.Crypto.SealBytes(hdr, hdrLenBuf)
+
+	if _, err := dest.Write(hdrLenBuf); err != nil {
+		return err
+	}
+
+	if _, err := dest.Write(buf); err != nil {
+		return err
+	}
+
+	h.serializedLength = uint16(overhead)
+
+	if len(meta) > 0 {
+		if _, err := dest.Write(config.Crypto.SealBytes(meta, h.metaLengthBytes())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// marshal serializes the header fields in the format of the header's
+// version before they are encrypted.
+func (h Header) marshal() []byte {
+	if h.version >= Version2 {
+		return h.marshalFields()
+	}
+	return h.marshalV1()
+}
+
+// marshalV1 serializes the fields of a Version1 header.
+func (h Header) marshalV1() []byte {
 	hdr := bytes.NewBuffer(nil)
 
 	pathSizeBuf := make([]byte, pathLength)
@@ -141,27 +359,140 @@ func (h *Header) Write(dest io.Writer, config *config.Config) error {
 		hdr.Write([]byte{0})
 	}
 
-	hdrLenBuf := make([]byte, headerSizeLength)
-	overhead := hdr.Len() + crypto.Overhead
+	writeString(hdr, h.Link)
 
-	binary.LittleEndian.PutUint16(hdrLenBuf, uint16(overhead))
+	ownerBuf := make([]byte, 2*ownerLength)
+	binary.LittleEndian.PutUint32(ownerBuf, uint32(h.UID))
+	binary.LittleEndian.PutUint32(ownerBuf[ownerLength:], uint32(h.GID))
+	hdr.Write(ownerBuf)
+	writeString(hdr, h.Uname)
+	writeString(hdr, h.Gname)
 
-	buf := config.Crypto.SealBytes(hdr.Bytes(), hdrLenBuf)
+	hdr.Write(h.metaLengthBytes())
 
-	if _, err := dest.Write(hdrLenBuf); err != nil {
+	nsecBuf := make([]byte, nsecLength)
+	binary.LittleEndian.PutUint32(nsecBuf, uint32(h.MTime.Nanosecond()))
+	hdr.Write(nsecBuf)
+	writeTime(hdr, h.ATime)
+	writeTime(hdr, h.CTime)
+
+	deviceBuf := make([]byte, 2*deviceLength)
+	binary.LittleEndian.PutUint32(deviceBuf, h.DevMajor)
+	binary.LittleEndian.PutUint32(deviceBuf[deviceLength:], h.DevMinor)
+	hdr.Write(deviceBuf)
+
+	checksumBuf := make([]byte, ChecksumLength)
+	copy(checksumBuf, h.Checksum)
+	hdr.Write(checksumBuf)
+
+	blockBuf := make([]byte, 2*blockLength)
+	binary.LittleEndian.PutUint64(blockBuf, uint64(h.Block))
+	binary.LittleEndian.PutUint64(blockBuf[blockLength:], uint64(h.BlockOffset))
+	hdr.Write(blockBuf)
+
+	return hdr.Bytes()
+}
+
+// metaLengthBytes returns the serialized length of the metadata block.
+// It is also used to authenticate the metadata block.
+func (h Header) metaLengthBytes() []byte {
+	buf := make([]byte, metaLength)
+	binary.LittleEndian.PutUint32(buf, h.metaLength)
+	return buf
+}
+
+// MarshalBinary serializes the header together with its metadata
+// without encrypting it. It is used to store headers in the archive
+// index, which is encrypted as a whole.
+func (h Header) MarshalBinary() ([]byte, error) {
+	meta := h.marshalMeta()
+	h.metaLength = 0
+	if len(meta) > 0 {
+		h.metaLength = uint32(len(meta) + crypto.Overhead)
+	}
+	hdr := h.marshal()
+
+	buf := make([]byte, headerSizeLength, headerSizeLength+len(hdr)+len(meta))
+	binary.LittleEndian.PutUint16(buf, uint16(len(hdr)))
+	buf = append(buf, hdr...)
+	return append(buf, meta...), nil
+}
+
+// UnmarshalBinary parses a header serialized by MarshalBinary. The
+// serialized length of the header is restored, as if it has been read
+// from the archive. The header must be of the same version, see
+// ParseHeader.
+func (h *Header) UnmarshalBinary(data []byte) error {
+	if len(data) < headerSizeLength {
+		return errInvalidHeader
+	}
+	hdrLen := int(binary.LittleEndian.Uint16(data))
+	if hdrLen < minHeaderLength || len(data) < headerSizeLength+hdrLen {
+		return errInvalidHeader
+	}
+
+	if err := h.unmarshal(data[headerSizeLength : headerSizeLength+hdrLen]); err != nil {
 		return err
 	}
+	h.serializedLength = uint16(hdrLen + crypto.Overhead)
 
-	_, err := dest.Write(buf)
+	return h.unmarshalMeta(data[headerSizeLength+hdrLen:])
+}
 
-	h.serializedLength = uint16(overhead)
+// ParseHeader parses a header of the given version serialized by
+// MarshalBinary.
+func ParseHeader(data []byte, version int) (*Header, error) {
+	h := &Header{version: version}
+	if err := h.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// readString reads a string prefixed with its 2 byte length from
+// buf at the given offset and returns the offset after the string.
+func readString(buf []byte, offset int) (string, int) {
+	n := int(binary.LittleEndian.Uint16(buf[offset : offset+2]))
+	offset += 2
+	return string(buf[offset : offset+n]), offset + n
+}
 
-	return err
+// writeString writes a string prefixed with its 2 byte length.
+func writeString(buf *bytes.Buffer, s string) {
+	lenBuf := make([]byte, 2)
+	binary.LittleEndian.PutUint16(lenBuf, uint16(len(s)))
+	buf.Write(lenBuf)
+	buf.Write([]byte(s))
+}
+
+// readTime reads a timestamp consisting of seconds and nanoseconds from
+// buf at the given offset and returns the offset after the timestamp.
+// A timestamp of 0 seconds and 0 nanoseconds is an unknown time.
+func readTime(buf []byte, offset int) (time.Time, int) {
+	sec := int64(binary.LittleEndian.Uint64(buf[offset : offset+timeLength]))
+	offset += timeLength
+	nsec := int64(binary.LittleEndian.Uint32(buf[offset : offset+nsecLength]))
+	offset += nsecLength
+	if sec == 0 && nsec == 0 {
+		return time.Time{}, offset
+	}
+	return time.Unix(sec, nsec), offset
 }
 
-// Len returns the serialized length of the header.
+// writeTime writes a timestamp as seconds and nanoseconds.
+func writeTime(buf *bytes.Buffer, t time.Time) {
+	timeBuf := make([]byte, timeLength+nsecLength)
+	if !t.IsZero() {
+		binary.LittleEndian.PutUint64(timeBuf, uint64(t.Unix()))
+		binary.LittleEndian.PutUint32(timeBuf[timeLength:], uint32(t.Nanosecond()))
+	}
+	buf.Write(timeBuf)
+}
+
+// Len returns the serialized length of the header including the
+// metadata block.
 func (h Header) Len() int64 {
-	return headerSizeLength + int64(h.serializedLength)
+	return headerSizeLength + int64(h.serializedLength) + int64(h.metaLength)
 }
 
 // ToJSON serializes the header to JSON.
@@ -173,9 +504,79 @@ func (h Header) ToJSON() []byte {
 	return b
 }
 
+// ListOptions controls which details of a header are formatted.
+type ListOptions struct {
+	// Time selects the timestamp to show: mtime (default), atime or ctime.
+	Time string
+	// FullTime shows the timestamp with nanoseconds.
+	FullTime bool
+	// Checksum shows the checksum of the item.
+	Checksum bool
+}
+
 // ToString formats the header to a string.
 func (h Header) ToString() string {
-	return fmt.Sprintf("%s %s%s\t%s\t%s", os.FileMode(h.Mode).String(), h.IsDeleted(), h.HumanSize(), h.MTime.Format("2006-01-02 15:04:05"), h.Path)
+	return h.Format(ListOptions{})
+}
+
+// Format formats the header to a string using the given options.
+func (h Header) Format(o ListOptions) string {
+	t := h.MTime
+	switch o.Time {
+	case "atime":
+		t = h.ATime
+	case "ctime":
+		t = h.CTime
+	}
+
+	layout := "2006-01-02 15:04:05"
+	if o.FullTime {
+		layout = "2006-01-02 15:04:05.000000000"
+	}
+
+	size := h.HumanSize()
+	if h.Type() == ModeCharDevice || h.Type() == ModeBlockDevice {
+		size = fmt.Sprintf("%11s", fmt.Sprintf("%d, %d", h.DevMajor, h.DevMinor))
+	}
+
+	if o.Checksum {
+		return fmt.Sprintf("%s %s %s%s\t%s\t%64s\t%s", os.FileMode(h.Mode).String(), h.Owner(), h.IsDeleted(), size, t.Format(layout), h.ChecksumString(), h.DisplayPath())
+	}
+
+	return fmt.Sprintf("%s %s %s%s\t%s\t%s", os.FileMode(h.Mode).String(), h.Owner(), h.IsDeleted(), size, t.Format(layout), h.DisplayPath())
+}
+
+// ChecksumString returns the checksum in hex or a dash if unknown.
+func (h Header) ChecksumString() string {
+	if len(h.Checksum) == 0 {
+		return "-"
+	}
+	return hex.EncodeToString(h.Checksum)
+}
+
+// Owner returns the owner and group of the item. The numeric IDs are
+// used if the names are unknown.
+func (h Header) Owner() string {
+	user := h.Uname
+	if len(user) == 0 {
+		user = strconv.Itoa(h.UID)
+	}
+	group := h.Gname
+	if len(group) == 0 {
+		group = strconv.Itoa(h.GID)
+	}
+	return user + "/" + group
+}
+
+// DisplayPath returns the path of the item. Links are rendered
+// together with their target like `ls -l` does.
+func (h Header) DisplayPath() string {
+	if h.Type() == ModeSymlink {
+		return fmt.Sprintf("%s -> %s", h.Path, h.Link)
+	} else if h.Type() == ModeHardlink {
+		return fmt.Sprintf("%s link to %s", h.Path, h.Link)
+	}
+	return h.Path
 }
 
 // IsDeleted returns a human readable flag if the item is marked for deletion.
@@ -200,3 +601,7 @@ func (h Header) HumanSize() string {
 
 	return fmt.Sprintf("%10.3fT", float64(h.Size)/float64(tb))
 }
+
+var (
+	errInvalidHeader = errors.New("header is invalid")
+)
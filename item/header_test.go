@@ -11,6 +11,7 @@ import (
 
 var (
 	defaultDirHeader    = Header{Path: "foo", Size: 0, MTime: time.Unix(0, 0), Mode: os.FileMode(0755) | os.ModeDir, Deleted: 0, Chunks: 0}
+	defaultLinkHeader   = Header{Path: "bar", MTime: time.Unix(0, 0), Mode: os.FileMode(0777) | os.ModeSymlink, Link: "foo.txt"}
 	defaultFileHeader   = Header{Path: "foo.txt", Size: 100, MTime: time.Unix(0, 0), Mode: os.FileMode(0777), Deleted: 0, Chunks: 1}
 	serializedDirEntry  = []byte{62, 0, 178, 122, 242, 171, 143, 117, 24, 227, 143, 47, 153, 111, 13, 161, 110, 128, 253, 77, 210, 111, 131, 114, 130, 245, 68, 33, 61, 86, 156, 182, 139, 194, 220, 139, 42, 36, 191, 115, 49, 192, 202, 21, 254, 63, 36, 240, 208, 213, 49, 33, 179, 106, 198, 50, 192, 145, 3, 103, 7, 243, 139, 252}
 	serializedFileEntry = []byte{63, 0, 33, 187, 186, 116, 71, 10, 30, 219, 87, 94, 104, 252, 39, 206, 246, 81, 246, 254, 252, 25, 8, 204, 180, 148, 176, 44, 223, 241, 235, 125, 111, 189, 195, 59, 69, 255, 130, 175, 41, 87, 46, 196, 74, 16, 27, 165, 3, 160, 75, 113, 32, 32, 35, 110, 124, 189, 170, 209, 176, 4, 170, 115, 130}
@@ -52,6 +53,225 @@ func TestReadFileHeader(t *testing.T) {
 	assert.Equal(t, h.Chunks, defaultFileHeader.Chunks)
 }
 
+func TestReadSymlinkHeader(t *testing.T) {
+	src := bytes.NewBuffer(nil)
+	err := defaultLinkHeader.Write(src, &defaultConfig)
+	assert.NoError(t, err)
+
+	h := new(Header)
+	found, err := h.Read(src, &defaultConfig)
+	assert.NoError(t, err)
+	assert.True(t, found)
+
+	assert.Equal(t, h.Path, defaultLinkHeader.Path)
+	assert.Equal(t, h.Type(), Mode(ModeSymlink))
+	assert.Equal(t, h.Link, defaultLinkHeader.Link)
+	assert.Equal(t, h.Size, int64(0))
+	assert.Equal(t, h.Chunks, int64(0))
+}
+
+func TestReadOwnerHeader(t *testing.T) {
+	hdr := Header{Path: "foo.txt", MTime: time.Unix(0, 0), Mode: os.FileMode(0644), UID: 1000, GID: 100, Uname: "chuck", Gname: "users"}
+
+	src := bytes.NewBuffer(nil)
+	err := hdr.Write(src, &defaultConfig)
+	assert.NoError(t, err)
+
+	h := new(Header)
+	found, err := h.Read(src, &defaultConfig)
+	assert.NoError(t, err)
+	assert.True(t, found)
+
+	assert.Equal(t, h.UID, hdr.UID)
+	assert.Equal(t, h.GID, hdr.GID)
+	assert.Equal(t, h.Uname, hdr.Uname)
+	assert.Equal(t, h.Gname, hdr.Gname)
+	assert.Equal(t, h.Owner(), "chuck/users")
+
+	h.Uname = ""
+	assert.Equal(t, h.Owner(), "1000/users")
+}
+
+func TestReadXattrHeader(t *testing.T) {
+	hdr := Header{Path: "foo.txt", MTime: time.Unix(0, 0), Mode: os.FileMode(0644), Xattrs: map[string][]byte{
+		"user.foo":                []byte("bar"),
+		"system.posix_acl_access": {2, 0, 0, 0},
+	}}
+
+	src := bytes.NewBuffer(nil)
+	err := hdr.Write(src, &defaultConfig)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(src.Len()), hdr.Len())
+
+	// Append a second header to make sure the metadata block is consumed.
+	err = defaultFileHeader.Write(src, &defaultConfig)
+	assert.NoError(t, err)
+
+	h := new(Header)
+	found, err := h.Read(src, &defaultConfig)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, hdr.Xattrs, h.Xattrs)
+	assert.Equal(t, hdr.Len(), h.Len())
+
+	h = new(Header)
+	found, err = h.Read(src, &defaultConfig)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, defaultFileHeader.Path, h.Path)
+	assert.Nil(t, h.Xattrs)
+}
+
+func TestReadTimesHeader(t *testing.T) {
+	hdr := Header{
+		Path:  "foo.txt",
+		Mode:  os.FileMode(0644),
+		MTime: time.Unix(1600000000, 123456789),
+		ATime: time.Unix(1600000001, 987654321),
+		CTime: time.Unix(1600000002, 1),
+	}
+
+	src := bytes.NewBuffer(nil)
+	err := hdr.Write(src, &defaultConfig)
+	assert.NoError(t, err)
+
+	h := new(Header)
+	found, err := h.Read(src, &defaultConfig)
+	assert.NoError(t, err)
+	assert.True(t, found)
+
+	assert.True(t, hdr.MTime.Equal(h.MTime))
+	assert.True(t, hdr.ATime.Equal(h.ATime))
+	assert.True(t, hdr.CTime.Equal(h.CTime))
+
+	src = bytes.NewBuffer(nil)
+	err = defaultFileHeader.Write(src, &defaultConfig)
+	assert.NoError(t, err)
+
+	h = new(Header)
+	_, err = h.Read(src, &defaultConfig)
+	assert.NoError(t, err)
+	assert.True(t, h.ATime.IsZero())
+	assert.True(t, h.CTime.IsZero())
+}
+
+func TestReadDeviceHeader(t *testing.T) {
+	hdr := Header{Path: "dev/sda1", MTime: time.Unix(0, 0), Mode: os.FileMode(0660) | os.ModeDevice, DevMajor: 8, DevMinor: 1}
+
+	src := bytes.NewBuffer(nil)
+	err := hdr.Write(src, &defaultConfig)
+	assert.NoError(t, err)
+
+	h := new(Header)
+	found, err := h.Read(src, &defaultConfig)
+	assert.NoError(t, err)
+	assert.True(t, found)
+
+	assert.Equal(t, h.Type(), Mode(ModeBlockDevice))
+	assert.Equal(t, h.DevMajor, uint32(8))
+	assert.Equal(t, h.DevMinor, uint32(1))
+	assert.EqualValues(t, h.ToString(), "Drw-rw---- 0/0 \t       8, 1\t1970-01-01 01:00:00\tdev/sda1")
+
+	fifo := Header{Mode: os.FileMode(0644) | os.ModeNamedPipe}
+	assert.Equal(t, fifo.Type(), Mode(ModeFIFO))
+	char := Header{Mode: os.FileMode(0644) | os.ModeDevice | os.ModeCharDevice}
+	assert.Equal(t, char.Type(), Mode(ModeCharDevice))
+}
+
+func TestReadSolidHeader(t *testing.T) {
+	hdr := Header{Path: "foo.txt", Size: 100, MTime: time.Unix(0, 0), Mode: os.FileMode(0644), Block: 1234, BlockOffset: 567}
+
+	src := bytes.NewBuffer(nil)
+	err := hdr.Write(src, &defaultConfig)
+	assert.NoError(t, err)
+
+	h := new(Header)
+	found, err := h.Read(src, &defaultConfig)
+	assert.NoError(t, err)
+	assert.True(t, found)
+
+	assert.True(t, h.IsSolid())
+	assert.Equal(t, h.Block, int64(1234))
+	assert.Equal(t, h.BlockOffset, int64(567))
+	assert.False(t, defaultFileHeader.IsSolid())
+}
+
+func TestReadVersion2Header(t *testing.T) {
+	c := defaultConfig
+	c.Version = Version2
+	hdr := Header{Path: "foo.txt", Size: 100, Chunks: 1, MTime: time.Unix(1, 2), Mode: os.FileMode(0644), UID: 1000, Uname: "foo", ATime: time.Unix(3, 4), Xattrs: map[string][]byte{"user.foo": []byte("bar")}}
+
+	src := bytes.NewBuffer(nil)
+	err := hdr.Write(src, &c)
+	assert.NoError(t, err)
+	written := src.Len()
+
+	h := new(Header)
+	_, err = h.Read(bytes.NewReader(src.Bytes()), &c)
+	assert.NoError(t, err)
+	assert.Equal(t, h.Path, hdr.Path)
+	assert.Equal(t, h.Size, hdr.Size)
+	assert.Equal(t, h.MTime, hdr.MTime)
+	assert.Equal(t, h.Mode, hdr.Mode)
+	assert.Equal(t, h.UID, hdr.UID)
+	assert.Equal(t, h.Uname, hdr.Uname)
+	assert.Equal(t, h.ATime, hdr.ATime)
+	assert.True(t, h.CTime.IsZero())
+	assert.Nil(t, h.Checksum)
+	assert.Equal(t, h.Xattrs, hdr.Xattrs)
+	assert.Equal(t, hdr.Len(), h.Len())
+
+	// Headers are rewritten in place, so their length must not change.
+	hdr.Deleted = 1
+	hdr.Checksum = make([]byte, ChecksumLength)
+	hdr.Checksum[0] = 1
+	src.Reset()
+	assert.NoError(t, hdr.Write(src, &c))
+	assert.Equal(t, written, src.Len())
+
+	data, err := hdr.MarshalBinary()
+	assert.NoError(t, err)
+	h, err = ParseHeader(data, Version2)
+	assert.NoError(t, err)
+	assert.Equal(t, h.Deleted, 1)
+	assert.Equal(t, h.Checksum, hdr.Checksum)
+}
+
+func TestUnknownFields(t *testing.T) {
+	hdr := Header{Path: "foo", Mode: os.FileMode(0755) | os.ModeDir, MTime: time.Unix(0, 0)}
+	buf := bytes.NewBuffer(hdr.marshalFields())
+	writeField(buf, 255, []byte("from the future"))
+
+	h := new(Header)
+	assert.NoError(t, h.unmarshalFields(buf.Bytes()))
+	assert.Equal(t, h.Path, hdr.Path)
+	assert.Equal(t, h.Type(), hdr.Type())
+
+	assert.Equal(t, errInvalidHeader, h.unmarshalFields(buf.Bytes()[:buf.Len()-1]))
+	assert.Equal(t, errInvalidHeader, h.unmarshalFields([]byte{fieldMode, 1, 0, 0}))
+}
+
+func TestMarshalBinary(t *testing.T) {
+	hdr := Header{Path: "foo.txt", Size: 100, Chunks: 1, MTime: time.Unix(0, 0), Mode: os.FileMode(0644), Xattrs: map[string][]byte{"user.foo": []byte("bar")}}
+
+	src := bytes.NewBuffer(nil)
+	err := hdr.Write(src, &defaultConfig)
+	assert.NoError(t, err)
+
+	data, err := hdr.MarshalBinary()
+	assert.NoError(t, err)
+
+	h := new(Header)
+	err = h.UnmarshalBinary(data)
+	assert.NoError(t, err)
+	assert.Equal(t, hdr.Path, h.Path)
+	assert.Equal(t, hdr.Xattrs, h.Xattrs)
+	assert.Equal(t, hdr.Len(), h.Len())
+
+	err = h.UnmarshalBinary(data[:4])
+	assert.Error(t, err)
+}
+
 func TestSerializeToJSON(t *testing.T) {
 	j := defaultFileHeader.ToJSON()
 	assert.NotNil(t, j)
@@ -60,11 +280,11 @@ func TestSerializeToJSON(t *testing.T) {
 
 func TestToString(t *testing.T) {
 	sizes := map[string]int64{
-		"---------- \t         2B\t0001-01-01 00:00:00\tfoo.txt": 2,
-		"---------- \t     2.290K\t0001-01-01 00:00:00\tfoo.txt": 2345,
-		"---------- \t    11.772M\t0001-01-01 00:00:00\tfoo.txt": 12343456,
-		"---------- \t   142.897G\t0001-01-01 00:00:00\tfoo.txt": 153434569073,
-		"---------- \t   139.548T\t0001-01-01 00:00:00\tfoo.txt": 153434569078399,
+		"---------- 0/0 \t         2B\t0001-01-01 00:00:00\tfoo.txt": 2,
+		"---------- 0/0 \t     2.290K\t0001-01-01 00:00:00\tfoo.txt": 2345,
+		"---------- 0/0 \t    11.772M\t0001-01-01 00:00:00\tfoo.txt": 12343456,
+		"---------- 0/0 \t   142.897G\t0001-01-01 00:00:00\tfoo.txt": 153434569073,
+		"---------- 0/0 \t   139.548T\t0001-01-01 00:00:00\tfoo.txt": 153434569078399,
 	}
 
 	for k, v := range sizes {
@@ -74,7 +294,18 @@ func TestToString(t *testing.T) {
 
 	j := defaultDirHeader.ToString()
 	assert.NotNil(t, j)
-	assert.EqualValues(t, j, "drwxr-xr-x \t         0B\t1970-01-01 01:00:00\tfoo")
+	assert.EqualValues(t, j, "drwxr-xr-x 0/0 \t         0B\t1970-01-01 01:00:00\tfoo")
+
+	j = defaultLinkHeader.ToString()
+	assert.EqualValues(t, j, "Lrwxrwxrwx 0/0 \t         0B\t1970-01-01 01:00:00\tbar -> foo.txt")
+
+	nh := Header{Path: "foo.txt", MTime: time.Unix(0, 5), ATime: time.Unix(60, 0)}
+	assert.EqualValues(t, nh.Format(ListOptions{Time: "atime"}), "---------- 0/0 \t         0B\t1970-01-01 01:01:00\tfoo.txt")
+	assert.EqualValues(t, nh.Format(ListOptions{FullTime: true}), "---------- 0/0 \t         0B\t1970-01-01 01:00:00.000000005\tfoo.txt")
+
+	hardlink := Header{Path: "bar.txt", MTime: time.Unix(0, 0), Mode: os.FileMode(0644), Link: "foo.txt"}
+	assert.Equal(t, hardlink.Type(), Mode(ModeHardlink))
+	assert.EqualValues(t, hardlink.ToString(), "-rw-r--r-- 0/0 \t         0B\t1970-01-01 01:00:00\tbar.txt link to foo.txt")
 }
 
 func TestIsDeleted(t *testing.T) {
@@ -1,6 +1,9 @@
 package item
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
 	"io"
 
 	"github.com/marcboeker/supertar/config"
@@ -30,35 +33,178 @@ func Read(src io.Reader, config *config.Config) (*Item, error) {
 }
 
 // Write serializes an item to the archive file.
+// The checksum of a regular file is only known after its body has been
+// written. If dest is seekable, the header is written again including
+// the checksum. Otherwise the checksum is computed in advance if src is
+// seekable, or left unknown.
+// Solid items have no body and keep the checksum computed when their
+// content has been added to the block.
 func (i Item) Write(dest io.Writer, src io.Reader, config *config.Config) error {
+	hasBody := i.Header.Type() == ModeRegular && i.Header.Size > 0 && !i.Header.IsSolid()
+	if i.Header.IsSolid() {
+		// Keep the checksum.
+	} else if i.Header.Type() == ModeRegular && !hasBody {
+		sum := sha256.Sum256(nil)
+		i.Header.Checksum = sum[:]
+	} else {
+		i.Header.Checksum = nil
+	}
+
+	ws, seekable := dest.(io.WriteSeeker)
+	var start int64
+	if hasBody && seekable {
+		var err error
+		if start, err = ws.Seek(0, io.SeekCurrent); err != nil {
+			return err
+		}
+	} else if rs, ok := src.(io.ReadSeeker); hasBody && ok {
+		var err error
+		if i.Header.Checksum, err = checksum(rs); err != nil {
+			return err
+		}
+	}
+
 	if err := i.Header.Write(dest, config); err != nil {
 		return err
 	}
 
-	if i.Header.Type() == ModeRegular && i.Header.Size > 0 {
-		body := new(Body)
+	if hasBody {
+		body := &Body{path: i.Header.Path}
+		var sum *sparseSum
+		if len(i.Header.Sparse) > 0 {
+			sum = newSparseSum(i.Header.Sparse)
+			src = io.TeeReader(src, sum)
+		}
 		if err := body.Write(dest, src, config); err != nil {
 			return err
 		}
+
+		if seekable {
+			end, err := ws.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return err
+			}
+			if _, err := ws.Seek(start, io.SeekStart); err != nil {
+				return err
+			}
+
+			i.Header.Checksum = body.Checksum
+			if sum != nil {
+				if i.Header.Checksum, err = sum.Sum(i.Header.Size); err != nil {
+					return err
+				}
+			}
+			if err := i.Header.Write(dest, config); err != nil {
+				return err
+			}
+
+			if _, err := ws.Seek(end, io.SeekStart); err != nil {
+				return err
+			}
+		}
 	}
 
 	return nil
 }
 
+// checksum returns the SHA-256 checksum of the remaining content of src
+// and seeks back to the current position afterwards.
+func checksum(src io.ReadSeeker) ([]byte, error) {
+	pos, err := src.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, src); err != nil {
+		return nil, err
+	}
+	if _, err := src.Seek(pos, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	return hash.Sum(nil), nil
+}
+
 // Extract reads the body of an item and writes it to dest.
+// Holes of sparse items are skipped if dest is seekable and
+// truncatable, otherwise they are filled with zeros.
+// The extracted content is verified against the checksum if known.
 func (i Item) Extract(src io.Reader, dest io.Writer, config *config.Config) error {
 	body := new(Body)
-	if err := body.Extract(src, dest, i.Header.Chunks, config); err != nil {
-		return err
+	var checksum []byte
+	if len(i.Header.Sparse) > 0 {
+		sw := newSparseWriter(dest, i.Header.Sparse)
+		sum := newSparseSum(i.Header.Sparse)
+		if err := body.Extract(src, io.MultiWriter(sw, sum), i.Header.Chunks, config); err != nil {
+			return err
+		}
+		if err := sw.Finish(i.Header.Size); err != nil {
+			return err
+		}
+		var err error
+		if checksum, err = sum.Sum(i.Header.Size); err != nil {
+			return err
+		}
+	} else {
+		if err := body.Extract(src, dest, i.Header.Chunks, config); err != nil {
+			return err
+		}
+		checksum = body.Checksum
+	}
+
+	if len(i.Header.Checksum) > 0 && !bytes.Equal(i.Header.Checksum, checksum) {
+		return ErrChecksumMismatch
 	}
 	return nil
 }
 
 // ExtractRange reads the given range from an item and writes it to dest.
-func (i Item) ExtractRange(src io.ReadSeeker, dest io.Writer, start, end int, config *config.Config) error {
+func (i Item) ExtractRange(src io.ReadSeeker, dest io.Writer, start, end int64, config *config.Config) error {
+	if len(i.Header.Sparse) > 0 {
+		return i.Extract(src, &rangeWriter{dest: dest, start: start, end: end}, config)
+	}
+
 	body := new(Body)
 	if err := body.ExtractRange(src, dest, start, end, i.Header.Chunks, config); err != nil {
 		return err
 	}
 	return nil
 }
+
+// SolidContent returns the content of a solid item from its decrypted
+// block.
+func (i Item) SolidContent(block []byte) ([]byte, error) {
+	start, end := i.Header.BlockOffset, i.Header.BlockOffset+i.Header.Size
+	if start < 0 || end < start || end > int64(len(block)) {
+		return nil, ErrInvalidBlock
+	}
+	return block[start:end], nil
+}
+
+// ExtractSolid copies the content of a solid item from src to dest.
+// The content is verified against the size and the checksum if known.
+func (i Item) ExtractSolid(src io.Reader, dest io.Writer) error {
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(dest, hash), src)
+	if err != nil {
+		return err
+	}
+	if n != i.Header.Size {
+		return ErrInvalidBlock
+	}
+
+	if len(i.Header.Checksum) > 0 && !bytes.Equal(i.Header.Checksum, hash.Sum(nil)) {
+		return ErrChecksumMismatch
+	}
+	return nil
+}
+
+var (
+	// ErrInvalidBlock is returned if the content of a solid item is not
+	// within its block.
+	ErrInvalidBlock = errors.New("solid block is invalid")
+	// ErrChecksumMismatch is returned if the extracted content of an item
+	// does not match its checksum.
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+)
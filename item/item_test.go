@@ -2,7 +2,12 @@ package item
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
 	"testing"
+	"time"
 
 	"github.com/marcboeker/supertar/config"
 	"github.com/marcboeker/supertar/crypto"
@@ -31,7 +36,7 @@ func TestSerializeDirItem(t *testing.T) {
 	err := i.Write(buf, nil, &defaultConfig)
 	assert.NoError(t, err)
 
-	assert.Equal(t, buf.Bytes()[:2], []byte{0x4a, 0x0})
+	assert.Equal(t, buf.Bytes()[:2], []byte{0xb0, 0x0})
 }
 
 func TestSerializeFileItem(t *testing.T) {
@@ -44,5 +49,69 @@ func TestSerializeFileItem(t *testing.T) {
 	err := i.Write(buf, mockFile, &defaultConfig)
 	assert.NoError(t, err)
 
-	assert.Equal(t, buf.Bytes()[:2], []byte{0x4e, 0x0})
+	assert.Equal(t, buf.Bytes()[:2], []byte{0xb4, 0x0})
+}
+
+func TestItemChecksum(t *testing.T) {
+	data := []byte("eekeek")
+	hdr := Header{Path: "foo.txt", Size: int64(len(data)), Chunks: 1, MTime: time.Unix(0, 0), Mode: os.FileMode(0644)}
+
+	path := fmt.Sprintf("/tmp/%s", time.Now().Format(time.RFC1123))
+	fh, err := os.Create(path)
+	assert.NoError(t, err)
+	defer func() {
+		fh.Close()
+		os.Remove(path)
+	}()
+
+	err = NewItem(&hdr).Write(fh, bytes.NewBuffer(data), &defaultConfig)
+	assert.NoError(t, err)
+
+	sum := sha256.Sum256(data)
+	assert.Equal(t, sum[:], hdr.Checksum)
+
+	fh.Seek(0, io.SeekStart)
+	i, err := Read(fh, &defaultConfig)
+	assert.NoError(t, err)
+	assert.Equal(t, sum[:], i.Header.Checksum)
+
+	out := bytes.NewBuffer(nil)
+	err = i.Extract(fh, out, &defaultConfig)
+	assert.NoError(t, err)
+	assert.Equal(t, data, out.Bytes())
+
+	fh.Seek(hdr.Len(), io.SeekStart)
+	i.Header.Checksum[0]++
+	err = i.Extract(fh, bytes.NewBuffer(nil), &defaultConfig)
+	assert.Equal(t, ErrChecksumMismatch, err)
+}
+
+func TestSparseChecksum(t *testing.T) {
+	hdr := Header{Path: "sparse", Mode: 0644, Size: 10, Chunks: 1, MTime: time.Unix(0, 0), Sparse: []Segment{{Offset: 2, Length: 3}, {Offset: 10, Length: 0}}}
+
+	path := fmt.Sprintf("/tmp/%s", time.Now().Format(time.RFC1123))
+	fh, err := os.Create(path)
+	assert.NoError(t, err)
+	defer func() {
+		fh.Close()
+		os.Remove(path)
+	}()
+
+	err = NewItem(&hdr).Write(fh, bytes.NewBufferString("eek"), &defaultConfig)
+	assert.NoError(t, err)
+
+	// The checksum covers the holes like the one of the original file.
+	sum := sha256.Sum256([]byte{0, 0, 'e', 'e', 'k', 0, 0, 0, 0, 0})
+	assert.Equal(t, sum[:], hdr.Checksum)
+
+	fh.Seek(0, io.SeekStart)
+	i, err := Read(fh, &defaultConfig)
+	assert.NoError(t, err)
+	err = i.Extract(fh, bytes.NewBuffer(nil), &defaultConfig)
+	assert.NoError(t, err)
+
+	fh.Seek(hdr.Len(), io.SeekStart)
+	i.Header.Checksum[0]++
+	err = i.Extract(fh, bytes.NewBuffer(nil), &defaultConfig)
+	assert.Equal(t, ErrChecksumMismatch, err)
 }
@@ -0,0 +1,104 @@
+package item
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+const (
+	metaLength       = 4
+	metaTypeLength   = 1
+	metaRecordLength = 4
+
+	metaTypeXattr  = 1
+	metaTypeSparse = 2
+
+	segmentLength = 16
+)
+
+// marshalMeta serializes the optional metadata of the header. The
+// metadata consists of records, each prefixed by its type and length,
+// so that readers can skip record types they do not know.
+func (h Header) marshalMeta() []byte {
+	buf := bytes.NewBuffer(nil)
+
+	names := make([]string, 0, len(h.Xattrs))
+	for name := range h.Xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		rec := bytes.NewBuffer(nil)
+		writeString(rec, name)
+		rec.Write(h.Xattrs[name])
+		writeMetaRecord(buf, metaTypeXattr, rec.Bytes())
+	}
+
+	if len(h.Sparse) > 0 {
+		rec := make([]byte, segmentLength*len(h.Sparse))
+		for i, s := range h.Sparse {
+			binary.LittleEndian.PutUint64(rec[i*segmentLength:], uint64(s.Offset))
+			binary.LittleEndian.PutUint64(rec[i*segmentLength+8:], uint64(s.Length))
+		}
+		writeMetaRecord(buf, metaTypeSparse, rec)
+	}
+
+	return buf.Bytes()
+}
+
+// unmarshalMeta parses the metadata records written by marshalMeta.
+func (h *Header) unmarshalMeta(buf []byte) error {
+	offset := 0
+	for offset < len(buf) {
+		if len(buf) < offset+metaTypeLength+metaRecordLength {
+			return errInvalidMeta
+		}
+		typ := buf[offset]
+		offset += metaTypeLength
+		n := int(binary.LittleEndian.Uint32(buf[offset : offset+metaRecordLength]))
+		offset += metaRecordLength
+		if len(buf) < offset+n {
+			return errInvalidMeta
+		}
+		rec := buf[offset : offset+n]
+		offset += n
+
+		switch typ {
+		case metaTypeXattr:
+			if len(rec) < nameLength {
+				return errInvalidMeta
+			}
+			name, valueOffset := readString(rec, 0)
+			if h.Xattrs == nil {
+				h.Xattrs = map[string][]byte{}
+			}
+			h.Xattrs[name] = rec[valueOffset:]
+		case metaTypeSparse:
+			if len(rec)%segmentLength != 0 {
+				return errInvalidMeta
+			}
+			h.Sparse = make([]Segment, len(rec)/segmentLength)
+			for i := range h.Sparse {
+				h.Sparse[i].Offset = int64(binary.LittleEndian.Uint64(rec[i*segmentLength:]))
+				h.Sparse[i].Length = int64(binary.LittleEndian.Uint64(rec[i*segmentLength+8:]))
+			}
+		}
+	}
+
+	return nil
+}
+
+func writeMetaRecord(buf *bytes.Buffer, typ byte, rec []byte) {
+	hdr := make([]byte, metaTypeLength+metaRecordLength)
+	hdr[0] = typ
+	binary.LittleEndian.PutUint32(hdr[metaTypeLength:], uint32(len(rec)))
+	buf.Write(hdr)
+	buf.Write(rec)
+}
+
+var (
+	errInvalidMeta = errors.New("item metadata is invalid")
+)
@@ -0,0 +1,251 @@
+package item
+
+import (
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/marcboeker/supertar/config"
+)
+
+// Reader provides random access to the content of an item. The offsets
+// of all chunks are known when the reader is created, so that reading at
+// any offset decrypts only the chunk holding it. The last decrypted
+// chunk is kept for subsequent reads. The content is not verified against
+// the checksum of the item, but every chunk is authenticated when it is
+// decrypted. Holes of sparse items are read as zeros.
+type Reader struct {
+	header  *Header
+	src     io.ReaderAt
+	config  *config.Config
+	offsets []int64 // offsets of the chunk headers in src
+	content []byte  // content of a solid item
+
+	mu    sync.Mutex
+	chunk int64 // number of the decrypted chunk, -1 if none
+	data  []byte
+	pos   int64
+}
+
+// NewReader returns a reader of the item i, whose chunks are stored at
+// i.Offset of src. Only the chunk headers are read.
+func NewReader(i *Item, src io.ReaderAt, c *config.Config) (*Reader, error) {
+	offsets, err := ChunkOffsets(i, src, c)
+	if err != nil {
+		return nil, err
+	}
+	return NewOffsetReader(i, src, offsets, c), nil
+}
+
+// NewOffsetReader returns a reader of the item i, whose chunks are stored
+// in src at the given offsets, see ChunkOffsets. Nothing is read, so that
+// the offsets of an item can be reused by several readers.
+func NewOffsetReader(i *Item, src io.ReaderAt, offsets []int64, c *config.Config) *Reader {
+	return &Reader{header: i.Header, src: src, config: c, offsets: offsets, chunk: -1}
+}
+
+// ChunkOffsets reads the chunk headers of the item i, whose chunks are
+// stored at i.Offset of src, and returns their offsets.
+func ChunkOffsets(i *Item, src io.ReaderAt, c *config.Config) ([]int64, error) {
+	var offsets []int64
+	hdr := make([]byte, 8)
+	off := i.Offset
+	for n := int64(0); n < i.Header.Chunks; n++ {
+		if _, err := src.ReadAt(hdr, off); err != nil {
+			return nil, err
+		}
+		size, err := checkChunk(hdr, n, c)
+		if err != nil {
+			return nil, err
+		}
+		offsets = append(offsets, off)
+		off += int64(len(hdr)) + size
+	}
+	return offsets, nil
+}
+
+// NewSolidReader returns a reader of the solid item i, whose block has
+// been decrypted already.
+func NewSolidReader(i *Item, block []byte) (*Reader, error) {
+	content, err := i.SolidContent(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{header: i.Header, content: content, chunk: -1}, nil
+}
+
+// Size returns the size of the content.
+func (r *Reader) Size() int64 {
+	return r.header.Size
+}
+
+// ReadAt reads len(p) bytes of the content starting at off.
+func (r *Reader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, ErrInvalidOffset
+	}
+
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= r.header.Size {
+			return n, io.EOF
+		}
+		buf := p[n:]
+		if left := r.header.Size - pos; int64(len(buf)) > left {
+			buf = buf[:left]
+		}
+
+		m, err := r.readAt(buf, pos)
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+// readAt reads the beginning of p at the logical offset pos. Holes of
+// sparse items are filled with zeros.
+func (r *Reader) readAt(p []byte, pos int64) (int, error) {
+	if len(r.header.Sparse) == 0 {
+		return r.readStored(p, pos)
+	}
+
+	// stored is the offset of the current segment in the stored data.
+	var stored int64
+	for _, s := range r.header.Sparse {
+		if pos < s.Offset {
+			// Zeros up to the next segment.
+			if int64(len(p)) > s.Offset-pos {
+				p = p[:s.Offset-pos]
+			}
+			return zero(p), nil
+		}
+		if pos < s.Offset+s.Length {
+			if int64(len(p)) > s.Offset+s.Length-pos {
+				p = p[:s.Offset+s.Length-pos]
+			}
+			return r.readStored(p, stored+pos-s.Offset)
+		}
+		stored += s.Length
+	}
+
+	// Trailing hole.
+	return zero(p), nil
+}
+
+// readStored reads the beginning of p from the stored data at off.
+func (r *Reader) readStored(p []byte, off int64) (int, error) {
+	if r.content != nil {
+		if off >= int64(len(r.content)) {
+			return 0, ErrInvalidBlock
+		}
+		return copy(p, r.content[off:]), nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	chunkSize := int64(r.config.ChunkSize)
+	n := off / chunkSize
+	if err := r.load(n); err != nil {
+		return 0, err
+	}
+	if off-n*chunkSize >= int64(len(r.data)) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	return copy(p, r.data[off-n*chunkSize:]), nil
+}
+
+// load decrypts the chunk with number n unless it is decrypted already.
+func (r *Reader) load(n int64) error {
+	if n == r.chunk {
+		return nil
+	}
+	if n >= int64(len(r.offsets)) {
+		return io.ErrUnexpectedEOF
+	}
+
+	hdr := make([]byte, 8)
+	if _, err := r.src.ReadAt(hdr, r.offsets[n]); err != nil {
+		return err
+	}
+	size, err := checkChunk(hdr, n, r.config)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, size)
+	if _, err := r.src.ReadAt(buf, r.offsets[n]+int64(len(hdr))); err != nil {
+		return err
+	}
+
+	data, err := openChunk(hdr, buf, r.config)
+	if err != nil {
+		return err
+	}
+	// All chunks but the last are full.
+	if n < int64(len(r.offsets))-1 && len(data) != r.config.ChunkSize {
+		return ErrInvalidChunk
+	}
+
+	r.chunk = n
+	r.data = data
+	return nil
+}
+
+// Read reads the content at the current offset.
+func (r *Reader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	n, err := r.ReadAt(p, r.pos)
+	r.pos += int64(n)
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// Seek sets the offset for the next Read.
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.header.Size
+	}
+	if offset < 0 {
+		return 0, ErrInvalidOffset
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+// Close releases the decrypted chunk. The source is not closed.
+func (r *Reader) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.chunk = -1
+	r.data = nil
+	return nil
+}
+
+// zero fills p with zeros and returns its length.
+func zero(p []byte) int {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p)
+}
+
+var (
+	// ErrInvalidOffset is returned if a negative offset is read or
+	// seeked to.
+	ErrInvalidOffset = errors.New("offset is invalid")
+	// ErrInvalidChunk is returned if a decrypted chunk is shorter than the
+	// chunk size, although it is not the last chunk of the item.
+	ErrInvalidChunk = errors.New("chunk is invalid")
+)
@@ -0,0 +1,166 @@
+package item
+
+import (
+	"crypto/sha256"
+	"errors"
+	"hash"
+	"io"
+)
+
+// Segment describes a region of a sparse file that contains data.
+type Segment struct {
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+}
+
+// StoredSize returns the number of bytes stored in the body of the item.
+// For sparse items only the data segments are stored.
+func (h Header) StoredSize() int64 {
+	if len(h.Sparse) == 0 {
+		return h.Size
+	}
+	var size int64
+	for _, s := range h.Sparse {
+		size += s.Length
+	}
+	return size
+}
+
+// truncater is implemented by destinations that can create holes,
+// like *os.File.
+type truncater interface {
+	io.WriteSeeker
+	Truncate(size int64) error
+}
+
+// sparseWriter distributes the stored data of a sparse item to its
+// segments. Holes are skipped by seeking if the destination supports it
+// or otherwise filled with zeros.
+type sparseWriter struct {
+	dest     io.Writer
+	segments []Segment
+	seg      int
+	left     int64
+	pos      int64
+}
+
+func newSparseWriter(dest io.Writer, segments []Segment) *sparseWriter {
+	return &sparseWriter{dest: dest, segments: segments, seg: -1}
+}
+
+func (w *sparseWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		for w.left == 0 {
+			w.seg++
+			if w.seg >= len(w.segments) {
+				return written, errSparseOverflow
+			}
+			if err := w.skipTo(w.segments[w.seg].Offset); err != nil {
+				return written, err
+			}
+			w.left = w.segments[w.seg].Length
+		}
+
+		n := int64(len(p))
+		if n > w.left {
+			n = w.left
+		}
+		m, err := w.dest.Write(p[:n])
+		written += m
+		w.pos += int64(m)
+		w.left -= int64(m)
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+
+	return written, nil
+}
+
+// Finish extends the destination to the logical size of the item, so
+// that a trailing hole is created.
+func (w *sparseWriter) Finish(size int64) error {
+	if t, ok := w.dest.(truncater); ok {
+		return t.Truncate(size)
+	}
+	return w.skipTo(size)
+}
+
+func (w *sparseWriter) skipTo(offset int64) error {
+	if offset < w.pos {
+		return errSparseOverflow
+	}
+	if t, ok := w.dest.(truncater); ok {
+		if _, err := t.Seek(offset-w.pos, io.SeekCurrent); err != nil {
+			return err
+		}
+	} else {
+		zeros := make([]byte, 32*1024)
+		for n := offset - w.pos; n > 0; {
+			c := int64(len(zeros))
+			if c > n {
+				c = n
+			}
+			if _, err := w.dest.Write(zeros[:c]); err != nil {
+				return err
+			}
+			n -= c
+		}
+	}
+	w.pos = offset
+	return nil
+}
+
+// sparseSum computes the checksum of the logical content of a sparse
+// item from its stored data. The holes are hashed as zeros, so that the
+// checksum matches the one of the original file.
+type sparseSum struct {
+	*sparseWriter
+	hash hash.Hash
+}
+
+func newSparseSum(segments []Segment) *sparseSum {
+	h := sha256.New()
+	return &sparseSum{sparseWriter: newSparseWriter(h, segments), hash: h}
+}
+
+// Sum hashes the trailing hole up to the logical size of the item and
+// returns the checksum.
+func (s *sparseSum) Sum(size int64) ([]byte, error) {
+	if err := s.Finish(size); err != nil {
+		return nil, err
+	}
+	return s.hash.Sum(nil), nil
+}
+
+// rangeWriter passes only the bytes within the inclusive range
+// [start, end] of the written stream to dest.
+type rangeWriter struct {
+	dest       io.Writer
+	start, end int64
+	pos        int64
+}
+
+func (w *rangeWriter) Write(p []byte) (int, error) {
+	from := w.start - w.pos
+	if from < 0 {
+		from = 0
+	}
+	to := w.end - w.pos + 1
+	if to > int64(len(p)) {
+		to = int64(len(p))
+	}
+	w.pos += int64(len(p))
+	if from < to {
+		if _, err := w.dest.Write(p[from:to]); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+var (
+	errSparseOverflow = errors.New("item data exceeds its sparse map")
+)
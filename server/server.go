@@ -2,11 +2,8 @@ package server
 
 import (
 	"errors"
-	"fmt"
-	"mime"
 	"net/http"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -134,57 +131,22 @@ func (s Server) streamItem(c *gin.Context) {
 	mutex.Lock()
 	defer mutex.Unlock()
 
-	item, err := s.resolveItem(c.Param("path"))
+	item, err := s.resolveContent(c.Param("path"))
 	if err != nil {
 		c.Status(http.StatusNotFound)
 		return
 	}
 
-	c.Header("Accept-Ranges", "bytes")
-
-	ext := filepath.Ext(item.Header.Path)
-	mt := mime.TypeByExtension(ext)
-	c.Header("Content-Type", mt)
-
-	start := 0
-	end := int(item.Header.Size)
-
-	rh := c.GetHeader("Range")
-	if len(rh) > 0 {
-		rh = strings.TrimPrefix(rh, "bytes=")
-		r := strings.Split(rh, "-")
-		if start, err = strconv.Atoi(r[0]); err != nil {
-			c.AbortWithStatus(http.StatusBadRequest)
-			return
-		}
-		if len(r[1]) > 0 {
-			if end, err = strconv.Atoi(r[1]); err != nil {
-				c.AbortWithStatus(http.StatusBadRequest)
-				return
-			}
-		}
-
-		if start > end {
-			start = 0
-		}
-
-		c.Status(http.StatusPartialContent)
-		if int64(end) == item.Header.Size {
-			c.Header("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end-1, item.Header.Size))
-			c.Header("Content-Length", strconv.FormatInt(int64(end-start), 10))
-		} else {
-			c.Header("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, item.Header.Size))
-			c.Header("Content-Length", strconv.FormatInt(int64(end-start)+1, 10))
-		}
-	} else {
-		c.Status(http.StatusOK)
-		c.Header("Content-Length", strconv.FormatInt(item.Header.Size, 10))
-	}
-
-	if err := s.archive.Stream(item, c.Writer, start, end); err != nil {
+	r, err := s.archive.OpenItem(item)
+	if err != nil {
 		c.Status(http.StatusBadRequest)
 		return
 	}
+	defer r.Close()
+
+	// The content type is detected from the extension of the path, range
+	// requests seek the reader to the first requested byte.
+	http.ServeContent(c.Writer, c.Request, item.Header.Path, item.Header.MTime, r)
 }
 
 func (s Server) serveStatic(c *gin.Context) {
@@ -234,6 +196,19 @@ func (s Server) resolveItem(path string) (*item.Item, error) {
 	return nil, errItemNotFound
 }
 
+// resolveContent resolves the item holding the content for the given
+// path. Hard links are resolved to the item they are linked to.
+func (s Server) resolveContent(path string) (*item.Item, error) {
+	i, err := s.resolveItem(path)
+	if err != nil {
+		return nil, err
+	}
+	if i.Header.Type() == item.ModeHardlink {
+		return s.resolveItem(i.Header.Link)
+	}
+	return i, nil
+}
+
 var (
 	errItemNotFound = errors.New("could not find item")
 )